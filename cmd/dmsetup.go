@@ -36,6 +36,23 @@ func lvmDemo() {
 	}
 }
 
+// printTree prints a device and the devices underlying it, in the style of `dmsetup ls --tree`.
+func printTree(node *devmapper.TopologyNode, prefix string, last, root bool) {
+	if root {
+		fmt.Println(node)
+	} else if last {
+		fmt.Printf("%s└─%s\n", prefix, node)
+		prefix += "   "
+	} else {
+		fmt.Printf("%s├─%s\n", prefix, node)
+		prefix += "│  "
+	}
+
+	for x, slave := range node.Slaves {
+		printTree(slave, prefix, x == len(node.Slaves)-1, false)
+	}
+}
+
 func main() {
 	lvmDemo()
 
@@ -51,4 +68,13 @@ func main() {
 			}
 		}
 	}
+
+	fmt.Println()
+
+	// Device tree
+	if topo, err := devmapper.GetTopology(); err == nil {
+		for _, node := range topo.Roots() {
+			printTree(node, " ", true, true)
+		}
+	}
 }
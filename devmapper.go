@@ -5,133 +5,431 @@
 
 // Package devicemapper is a collection of wrappers around libdevmapper / liblvm2.
 //
+// Two devicemapper backends are available. By default, libdevmapper is used via cgo. Building
+// with the "dmioctl" tag (or with cgo disabled) instead selects a pure-Go backend, which issues
+// DM_* ioctls directly against /dev/mapper/control and has no dependency on libdevmapper.
+//
 package devmapper
 
-// #cgo LDFLAGS: -ldevmapper
-// #include <stdlib.h>
-// #include <libdevmapper.h>
-import "C"
-
 import (
-	"unsafe"
-)
+	"errors"
+	"fmt"
+	"strings"
 
-type dmTarget struct {
-	Start  uint64
-	Length uint64
-	Type   string
-	Params string
-}
+	"golang.org/x/sys/unix"
+)
 
 type dmDevice struct {
 	Dev  uint64
 	Name string
 }
 
-// GetDeviceList returns a list of devmapper devices, including device number and name
-func GetDeviceList() (devices []dmDevice, err error) {
-	var info C.struct_dm_info
+var (
+	// ErrDeviceNotFound is returned when the specified devmapper device does not exist.
+	ErrDeviceNotFound = errors.New("Device does not exist")
 
-	dmt, err := C.dm_task_create(C.DM_DEVICE_LIST)
-	if err != nil {
-		return
+	// ErrDeviceExists is returned when a device cannot be renamed, because a device with the new
+	// name already exists.
+	ErrDeviceExists = errors.New("Device already exists")
+
+	// ErrUUIDAlreadySet is returned by SetUUID when the device already has a UUID. The kernel
+	// does not permit a device's UUID to be changed once it has been set.
+	ErrUUIDAlreadySet = errors.New("Device UUID already set")
+)
+
+// DeviceInfo describes the state of a devmapper device.
+type DeviceInfo struct {
+	Name           string
+	UUID           string
+	Exists         bool
+	Suspended      bool
+	LiveTable      bool  // Device has an active table
+	InactiveTable  bool  // Device has a table loaded, which will become active when resumed
+	ReadOnly       bool  // Active table is read-only
+	DeferredRemove bool  // Device will be removed when it is no longer open
+	OpenCount      int32 // Number of times the device is currently open
+	EventNr        uint32
+	TargetCount    int32 // Number of targets in the active table
+	Major          uint32
+	Minor          uint32
+}
+
+// DMError represents a failed devmapper operation, and the errno reported by the kernel.
+type DMError struct {
+	op    string
+	errno unix.Errno
+}
+
+func (e *DMError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.op, e.errno)
+}
+
+// Errno returns the errno reported by the kernel for the failed operation.
+func (e *DMError) Errno() unix.Errno {
+	return e.errno
+}
+
+// Unwrap returns the underlying errno.
+func (e *DMError) Unwrap() error {
+	return e.errno
+}
+
+// Is reports whether the error is equivalent to target. The kernel signals that a device does
+// not exist with ENXIO, so such errors are considered equivalent to ErrDeviceNotFound.
+func (e *DMError) Is(target error) bool {
+	return target == ErrDeviceNotFound && e.errno == unix.ENXIO
+}
+
+// An InvalidNameError is returned when a device name or UUID does not meet devmapper's length or
+// character restrictions.
+type InvalidNameError struct {
+	Field  string // "name" or "UUID"
+	Value  string
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("Invalid device %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// validateName checks that s is usable as a device name or UUID (according to field), i.e. that
+// it fits in the corresponding dm_ioctl field, and consists only of characters which udev accepts
+// in device node names without mangling.
+func validateName(field, s string, maxLen int) error {
+	if s == "" {
+		return &InvalidNameError{field, s, "must not be empty"}
 	}
 
-	defer C.dm_task_destroy(dmt)
+	// Length limits include the terminating NUL
+	if len(s) >= maxLen {
+		return &InvalidNameError{field, s, fmt.Sprintf("longer than %d characters", maxLen-1)}
+	}
 
-	_, err = C.dm_task_run(dmt)
-	if err != nil {
-		return
+	if s == "." || s == ".." {
+		return &InvalidNameError{field, s, "reserved name"}
 	}
 
-	// FIXME: dmsetup.c also checks value of info.exists
-	_, err = C.dm_task_get_info(dmt, &info)
-	if err != nil {
-		return
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case strings.ContainsRune("#+-.:=@_", c):
+		default:
+			return &InvalidNameError{field, s, fmt.Sprintf("invalid character %q", c)}
+		}
 	}
 
-	dm_names, err := C.dm_task_get_names(dmt)
-	if err != nil {
-		return
-	}
-
-	if dm_names.dev != 0 {
-		/*
-			dm_names is a "variable length" struct which is tricky to process due to Go's disdain
-			for pointer arithmetic.
-
-			struct dm_names {
-				uint64_t dev;
-				uint32_t next;	// Offset to next struct from start of this struct
-				char name[0];
-			};
-		*/
-		for dm_dev := dm_names; ; dm_dev = (*C.struct_dm_names)(unsafe.Pointer(uintptr(unsafe.Pointer(dm_dev)) + uintptr(dm_dev.next))) {
-			devices = append(devices, dmDevice{
-				uint64(dm_dev.dev),
-				C.GoString((*C.char)(unsafe.Pointer(&dm_dev.name))),
-			})
-
-			if dm_dev.next == 0 {
-				break
-			}
+	return nil
+}
+
+// dmTaskType is the type of a devmapper task, and corresponds to the libdevmapper DM_DEVICE_*
+// task types.
+type dmTaskType int
+
+const (
+	dmDeviceCreate dmTaskType = iota
+	dmDeviceReload
+	dmDeviceRemove
+	dmDeviceSuspend
+	dmDeviceResume
+	dmDeviceStatus
+	dmDeviceInfo
+	dmDeviceTable
+	dmDeviceTargetMsg
+	dmDeviceDeps
+	dmDeviceRename
+	dmDeviceClear
+)
+
+var dmTaskNames = map[dmTaskType]string{
+	dmDeviceCreate:    "DM_DEVICE_CREATE",
+	dmDeviceReload:    "DM_DEVICE_RELOAD",
+	dmDeviceRemove:    "DM_DEVICE_REMOVE",
+	dmDeviceSuspend:   "DM_DEVICE_SUSPEND",
+	dmDeviceResume:    "DM_DEVICE_RESUME",
+	dmDeviceStatus:    "DM_DEVICE_STATUS",
+	dmDeviceInfo:      "DM_DEVICE_INFO",
+	dmDeviceTable:     "DM_DEVICE_TABLE",
+	dmDeviceTargetMsg: "DM_DEVICE_TARGET_MSG",
+	dmDeviceDeps:      "DM_DEVICE_DEPS",
+	dmDeviceRename:    "DM_DEVICE_RENAME",
+	dmDeviceClear:     "DM_DEVICE_CLEAR",
+}
+
+// A dmTask describes a single devmapper operation. Tasks are executed by the run() method of the
+// backend that the package was built with.
+type dmTask struct {
+	typ     dmTaskType
+	name    string
+	uuid    string
+	flags   uint32     // Kernel DM_*_FLAG bits, e.g. unix.DM_READONLY_FLAG
+	targets []dmTarget // Table to be loaded, or table / status returned
+	sector  uint64     // Sector used to select the target to which a message is sent
+	message string     // Target message to be sent
+	newName string     // New name, or new UUID if DM_UUID_FLAG is set, for a rename task
+
+	response string   // Target message response, populated by run()
+	deps     []uint64 // Device numbers of underlying devices, populated by run()
+
+	// Device info, populated by run(). As with libdevmapper, DM_DEVICE_INFO and DM_DEVICE_STATUS
+	// tasks succeed for nonexistent devices, in which case info.Exists is false.
+	info DeviceInfo
+}
+
+// CreateDevice creates a devmapper device with the specified name and optional UUID. If table is
+// not empty, it is loaded and the device is resumed, making it available for I/O. Otherwise the
+// device is created without a table, and must be populated with LoadTable and ResumeDevice. The
+// name and UUID are subject to the same restrictions as in Rename and SetUUID.
+func CreateDevice(name, uuid string, table []dmTarget, readOnly bool) error {
+	if err := validateName("name", name, unix.DM_NAME_LEN); err != nil {
+		return err
+	}
+
+	if uuid != "" {
+		if err := validateName("UUID", uuid, unix.DM_UUID_LEN); err != nil {
+			return err
 		}
 	}
 
-	return
+	task := dmTask{typ: dmDeviceCreate, name: name, uuid: uuid}
+	if err := task.run(); err != nil {
+		return err
+	}
+
+	if len(table) == 0 {
+		return nil
+	}
+
+	err := LoadTable(name, table, readOnly)
+	if err == nil {
+		err = ResumeDevice(name)
+	}
+
+	if err != nil {
+		// Don't leave a half-configured device lying around
+		RemoveDevice(name, false)
+	}
+
+	return err
 }
 
-func GetDeviceTable(name string) (targets []dmTarget, err error) {
-	var (
-		info C.struct_dm_info
-		next uintptr
-	)
+// LoadTable loads a table into the inactive table slot of an existing device. The new table does
+// not take effect until the device is resumed.
+func LoadTable(name string, table []dmTarget, readOnly bool) error {
+	task := dmTask{typ: dmDeviceReload, name: name, targets: table}
+
+	if readOnly {
+		task.flags |= unix.DM_READONLY_FLAG
+	}
 
-	dmt, err := C.dm_task_create(C.DM_DEVICE_TABLE)
+	return task.run()
+}
+
+// ClearInactiveTable discards a table which has been loaded into the inactive table slot of a
+// device, but not yet made live by resuming the device.
+func ClearInactiveTable(name string) error {
+	task := dmTask{typ: dmDeviceClear, name: name}
+	return task.run()
+}
+
+// ReplaceTable replaces the live table of a device, by loading the new table, then suspending and
+// resuming the device. The device's read-only state is preserved. If the device cannot be
+// suspended, the new table remains loaded in the inactive slot, and takes effect on next resume.
+func ReplaceTable(name string, table []dmTarget) error {
+	info, err := GetDeviceInfo(name)
 	if err != nil {
-		return
+		return err
 	}
 
-	defer C.dm_task_destroy(dmt)
+	if err := LoadTable(name, table, info.ReadOnly); err != nil {
+		return err
+	}
 
-	Cname := C.CString(name)
-	defer C.free(unsafe.Pointer(Cname))
+	if err := SuspendDevice(name, false); err != nil {
+		return err
+	}
+
+	return ResumeDevice(name)
+}
 
-	_, err = C.dm_task_set_name(dmt, Cname)
+// SuspendDevice suspends a device. Outstanding I/O is flushed before the device is suspended,
+// unless noFlush is true, in which case it is queued until the device is resumed.
+func SuspendDevice(name string, noFlush bool) error {
+	task := dmTask{typ: dmDeviceSuspend, name: name, flags: unix.DM_SUSPEND_FLAG}
+
+	if noFlush {
+		task.flags |= unix.DM_NOFLUSH_FLAG
+	}
+
+	return task.run()
+}
+
+// ResumeDevice resumes a suspended device. If a table has been loaded into the inactive table
+// slot, it replaces the live table.
+func ResumeDevice(name string) error {
+	task := dmTask{typ: dmDeviceResume, name: name}
+	return task.run()
+}
+
+// RemoveDevice removes a device. If deferred is true and the device is currently open, the
+// kernel removes it once the last user closes it, rather than failing with EBUSY.
+func RemoveDevice(name string, deferred bool) error {
+	task := dmTask{typ: dmDeviceRemove, name: name}
+
+	if deferred {
+		task.flags |= unix.DM_DEFERRED_REMOVE
+	}
+
+	return task.run()
+}
+
+// Rename changes the name of a device. The rename is atomic, so a device can be set up under a
+// temporary name and then renamed into place.
+func Rename(oldName, newName string) error {
+	if err := validateName("name", newName, unix.DM_NAME_LEN); err != nil {
+		return err
+	}
+
+	if _, err := GetDeviceInfo(newName); err == nil {
+		return ErrDeviceExists
+	} else if err != ErrDeviceNotFound {
+		return err
+	}
+
+	// The check above is racy, so also handle the kernel rejecting a name which is already in use
+	task := dmTask{typ: dmDeviceRename, name: oldName, newName: newName}
+	if err := task.run(); errors.Is(err, unix.EBUSY) {
+		return ErrDeviceExists
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetUUID sets the UUID of a device which was created without one. ErrUUIDAlreadySet is returned
+// if the device already has a UUID.
+func SetUUID(name, uuid string) error {
+	if err := validateName("UUID", uuid, unix.DM_UUID_LEN); err != nil {
+		return err
+	}
+
+	info, err := GetDeviceInfo(name)
 	if err != nil {
-		return
+		return err
+	}
+
+	if info.UUID != "" {
+		return ErrUUIDAlreadySet
 	}
 
-	_, err = C.dm_task_run(dmt)
+	task := dmTask{typ: dmDeviceRename, name: name, newName: uuid, flags: unix.DM_UUID_FLAG}
+	return task.run()
+}
+
+// GetDeviceTable returns the active table of a device. The keys of any crypt targets are redacted;
+// use GetDeviceTableWithKeys to retrieve them.
+func GetDeviceTable(name string) ([]dmTarget, error) {
+	table, err := getDeviceTable(name, 0)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	// FIXME: dmsetup.c also checks value of info.exists
-	_, err = C.dm_task_get_info(dmt, &info)
+	return redactCryptKeys(table), nil
+}
+
+// GetDeviceTableWithKeys returns the active table of a device, including the keys of any crypt
+// targets.
+func GetDeviceTableWithKeys(name string) ([]dmTarget, error) {
+	return getDeviceTable(name, 0)
+}
+
+// GetInactiveDeviceTable returns the inactive table of a device, i.e. a table which has been
+// loaded but will not take effect until the device is resumed. As with GetDeviceTable, the keys
+// of any crypt targets are redacted.
+func GetInactiveDeviceTable(name string) ([]dmTarget, error) {
+	table, err := getDeviceTable(name, unix.DM_QUERY_INACTIVE_TABLE_FLAG)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	for x := 0; x < int(info.target_count); x++ {
-		var (
-			Cstart, Clength      C.uint64_t
-			CtargetType, Cparams *C.char
-		)
+	return redactCryptKeys(table), nil
+}
 
-		nextp := C.dm_get_next_target(dmt, unsafe.Pointer(next), &Cstart, &Clength, &CtargetType, &Cparams)
-		targets = append(targets, dmTarget{
-			uint64(Cstart),
-			uint64(Clength),
-			C.GoString(CtargetType),
-			C.GoString(Cparams),
-		})
+func getDeviceTable(name string, flags uint32) ([]dmTarget, error) {
+	task := dmTask{typ: dmDeviceTable, name: name, flags: flags}
 
-		if nextp == nil {
-			break
-		}
+	if err := task.run(); err != nil {
+		return nil, err
+	}
+
+	if !task.info.Exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	return task.targets, nil
+}
+
+// GetDeviceDeps returns the device numbers of the block devices used by the active table of a
+// device, in the same encoding as dmDevice.Dev.
+func GetDeviceDeps(name string) ([]uint64, error) {
+	task := dmTask{typ: dmDeviceDeps, name: name}
+
+	if err := task.run(); err != nil {
+		return nil, err
+	}
+
+	return task.deps, nil
+}
+
+// GetDeviceStatus returns the status of each target of a device. Each target's status line is
+// returned in its Params field, and can be parsed with ParseTargetStatus.
+func GetDeviceStatus(name string) ([]dmTarget, error) {
+	task := dmTask{typ: dmDeviceStatus, name: name}
+
+	if err := task.run(); err != nil {
+		return nil, err
+	}
+
+	if !task.info.Exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	return task.targets, nil
+}
+
+// GetDeviceInfo returns information about the device with the specified name. ErrDeviceNotFound
+// is returned if no such device exists.
+func GetDeviceInfo(name string) (*DeviceInfo, error) {
+	return getDeviceInfo(dmTask{typ: dmDeviceInfo, name: name})
+}
+
+// GetDeviceInfoByUUID returns information about the device with the specified UUID.
+// ErrDeviceNotFound is returned if no such device exists.
+func GetDeviceInfoByUUID(uuid string) (*DeviceInfo, error) {
+	return getDeviceInfo(dmTask{typ: dmDeviceInfo, uuid: uuid})
+}
+
+func getDeviceInfo(task dmTask) (*DeviceInfo, error) {
+	if err := task.run(); err != nil {
+		return nil, err
+	}
+
+	if !task.info.Exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	return &task.info, nil
+}
+
+// SendMessage sends a message to the target of a device which spans the specified sector, and
+// returns the target's response, if any. Messages which do not depend on a sector (e.g. thin-pool
+// and cache messages, or dm-stats messages) should be sent to sector zero.
+func SendMessage(name string, sector uint64, message string) (string, error) {
+	task := dmTask{typ: dmDeviceTargetMsg, name: name, sector: sector, message: message}
+
+	if err := task.run(); err != nil {
+		return "", err
 	}
 
-	// TODO: loop over possible multiple targets
-	return
+	return task.response, nil
 }
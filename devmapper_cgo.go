@@ -0,0 +1,344 @@
+// +build linux,cgo,!dmioctl
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// libdevmapper backend.
+
+package devmapper
+
+// #cgo LDFLAGS: -ldevmapper
+// #include <stdlib.h>
+// #include <libdevmapper.h>
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dmTaskTypes maps devmapper task types to libdevmapper task types.
+var dmTaskTypes = map[dmTaskType]C.int{
+	dmDeviceCreate:    C.DM_DEVICE_CREATE,
+	dmDeviceReload:    C.DM_DEVICE_RELOAD,
+	dmDeviceRemove:    C.DM_DEVICE_REMOVE,
+	dmDeviceSuspend:   C.DM_DEVICE_SUSPEND,
+	dmDeviceResume:    C.DM_DEVICE_RESUME,
+	dmDeviceStatus:    C.DM_DEVICE_STATUS,
+	dmDeviceInfo:      C.DM_DEVICE_INFO,
+	dmDeviceTable:     C.DM_DEVICE_TABLE,
+	dmDeviceTargetMsg: C.DM_DEVICE_TARGET_MSG,
+	dmDeviceDeps:      C.DM_DEVICE_DEPS,
+	dmDeviceRename:    C.DM_DEVICE_RENAME,
+	dmDeviceClear:     C.DM_DEVICE_CLEAR,
+}
+
+// run executes a devmapper task via libdevmapper.
+func (t *dmTask) run() error {
+	dmt := C.dm_task_create(dmTaskTypes[t.typ])
+	if dmt == nil {
+		return fmt.Errorf("Cannot create %s task", dmTaskNames[t.typ])
+	}
+
+	defer C.dm_task_destroy(dmt)
+
+	if t.name != "" {
+		Cname := C.CString(t.name)
+		defer C.free(unsafe.Pointer(Cname))
+
+		if C.dm_task_set_name(dmt, Cname) == 0 {
+			return t.error(dmt)
+		}
+	}
+
+	if t.uuid != "" {
+		Cuuid := C.CString(t.uuid)
+		defer C.free(unsafe.Pointer(Cuuid))
+
+		if C.dm_task_set_uuid(dmt, Cuuid) == 0 {
+			return t.error(dmt)
+		}
+	}
+
+	for _, target := range t.targets {
+		CtargetType := C.CString(target.Type)
+		Cparams := C.CString(target.Params)
+
+		// libdevmapper copies the target type and params
+		ok := C.dm_task_add_target(dmt, C.uint64_t(target.Start), C.uint64_t(target.Length), CtargetType, Cparams)
+
+		C.free(unsafe.Pointer(CtargetType))
+		C.free(unsafe.Pointer(Cparams))
+
+		if ok == 0 {
+			return t.error(dmt)
+		}
+	}
+
+	if t.typ == dmDeviceTargetMsg {
+		Cmessage := C.CString(t.message)
+		defer C.free(unsafe.Pointer(Cmessage))
+
+		if C.dm_task_set_sector(dmt, C.uint64_t(t.sector)) == 0 || C.dm_task_set_message(dmt, Cmessage) == 0 {
+			return t.error(dmt)
+		}
+	}
+
+	if t.typ == dmDeviceRename {
+		CnewName := C.CString(t.newName)
+		defer C.free(unsafe.Pointer(CnewName))
+
+		if t.flags&unix.DM_UUID_FLAG != 0 {
+			if C.dm_task_set_newuuid(dmt, CnewName) == 0 {
+				return t.error(dmt)
+			}
+		} else if C.dm_task_set_newname(dmt, CnewName) == 0 {
+			return t.error(dmt)
+		}
+	}
+
+	if t.flags&unix.DM_READONLY_FLAG != 0 {
+		C.dm_task_set_ro(dmt)
+	}
+
+	if t.flags&unix.DM_NOFLUSH_FLAG != 0 {
+		C.dm_task_no_flush(dmt)
+	}
+
+	if t.flags&unix.DM_DEFERRED_REMOVE != 0 {
+		C.dm_task_deferred_remove(dmt)
+	}
+
+	if t.flags&unix.DM_QUERY_INACTIVE_TABLE_FLAG != 0 {
+		C.dm_task_query_inactive_table(dmt)
+	}
+
+	if C.dm_task_run(dmt) == 0 {
+		return t.error(dmt)
+	}
+
+	var info C.struct_dm_info
+
+	if C.dm_task_get_info(dmt, &info) == 0 {
+		return t.error(dmt)
+	}
+
+	t.info = DeviceInfo{
+		Exists:         info.exists != 0,
+		Suspended:      info.suspended != 0,
+		LiveTable:      info.live_table != 0,
+		InactiveTable:  info.inactive_table != 0,
+		ReadOnly:       info.read_only != 0,
+		DeferredRemove: info.deferred_remove != 0,
+		OpenCount:      int32(info.open_count),
+		EventNr:        uint32(info.event_nr),
+		TargetCount:    int32(info.target_count),
+		Major:          uint32(info.major),
+		Minor:          uint32(info.minor),
+	}
+
+	if info.exists != 0 {
+		t.info.Name = C.GoString(C.dm_task_get_name(dmt))
+		t.info.UUID = C.GoString(C.dm_task_get_uuid(dmt))
+	}
+
+	switch t.typ {
+	case dmDeviceStatus, dmDeviceTable:
+		t.targets = getTargets(dmt)
+
+	case dmDeviceDeps:
+		t.deps = getDeps(dmt)
+
+	case dmDeviceTargetMsg:
+		t.response = C.GoString(C.dm_task_get_message_response(dmt))
+	}
+
+	return nil
+}
+
+// getDeps returns the device numbers from a completed libdevmapper DM_DEVICE_DEPS task.
+func getDeps(dmt *C.struct_dm_task) []uint64 {
+	deps := C.dm_task_get_deps(dmt)
+	if deps == nil {
+		return nil
+	}
+
+	// struct dm_deps is a "variable length" struct; its device array immediately follows the
+	// count and filler fields. Cgo does not expose zero-length array fields.
+	ptr := unsafe.Pointer(uintptr(unsafe.Pointer(deps)) + unsafe.Sizeof(*deps))
+	devices := (*[1 << 20]C.uint64_t)(ptr)[:deps.count:deps.count]
+
+	result := make([]uint64, len(devices))
+	for x, dev := range devices {
+		result[x] = uint64(dev)
+	}
+
+	return result
+}
+
+// getTargets returns the table or status targets of a completed libdevmapper task.
+func getTargets(dmt *C.struct_dm_task) (targets []dmTarget) {
+	var next unsafe.Pointer
+
+	for {
+		var (
+			Cstart, Clength      C.uint64_t
+			CtargetType, Cparams *C.char
+		)
+
+		next = C.dm_get_next_target(dmt, next, &Cstart, &Clength, &CtargetType, &Cparams)
+
+		// Target type is NULL if the table is empty
+		if CtargetType != nil {
+			targets = append(targets, dmTarget{
+				uint64(Cstart),
+				uint64(Clength),
+				C.GoString(CtargetType),
+				C.GoString(Cparams),
+			})
+		}
+
+		if next == nil {
+			break
+		}
+	}
+
+	return
+}
+
+// error returns a DMError for a failed libdevmapper task.
+func (t *dmTask) error(dmt *C.struct_dm_task) error {
+	return &DMError{dmTaskNames[t.typ], unix.Errno(C.dm_task_get_errno(dmt))}
+}
+
+// GetDeviceList returns a list of devmapper devices, including device number and name
+func GetDeviceList() (devices []dmDevice, err error) {
+	var info C.struct_dm_info
+
+	dmt, err := C.dm_task_create(C.DM_DEVICE_LIST)
+	if err != nil {
+		return
+	}
+
+	defer C.dm_task_destroy(dmt)
+
+	_, err = C.dm_task_run(dmt)
+	if err != nil {
+		return
+	}
+
+	_, err = C.dm_task_get_info(dmt, &info)
+	if err != nil {
+		return
+	}
+
+	if info.exists == 0 {
+		return
+	}
+
+	dm_names, err := C.dm_task_get_names(dmt)
+	if err != nil {
+		return
+	}
+
+	if dm_names.dev != 0 {
+		/*
+			dm_names is a "variable length" struct which is tricky to process due to Go's disdain
+			for pointer arithmetic.
+
+			struct dm_names {
+				uint64_t dev;
+				uint32_t next;	// Offset to next struct from start of this struct
+				char name[0];
+			};
+		*/
+		for dm_dev := dm_names; ; dm_dev = (*C.struct_dm_names)(unsafe.Pointer(uintptr(unsafe.Pointer(dm_dev)) + uintptr(dm_dev.next))) {
+			devices = append(devices, dmDevice{
+				uint64(dm_dev.dev),
+				C.GoString((*C.char)(unsafe.Pointer(&dm_dev.name))),
+			})
+
+			if dm_dev.next == 0 {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// ListTargetVersions returns the target types registered with the kernel, and their versions.
+// Target types provided by modules which have not yet been loaded are not listed.
+func ListTargetVersions() ([]TargetVersion, error) {
+	dmt := C.dm_task_create(C.DM_DEVICE_LIST_VERSIONS)
+	if dmt == nil {
+		return nil, fmt.Errorf("Cannot create DM_DEVICE_LIST_VERSIONS task")
+	}
+
+	defer C.dm_task_destroy(dmt)
+
+	if C.dm_task_run(dmt) == 0 {
+		return nil, &DMError{"DM_DEVICE_LIST_VERSIONS", unix.Errno(C.dm_task_get_errno(dmt))}
+	}
+
+	return getVersions(dmt), nil
+}
+
+// GetTargetVersion returns the version of the named target type. Unlike ListTargetVersions, the
+// kernel loads the target's module if necessary. ErrTargetNotFound is returned if the kernel does
+// not provide the target type.
+func GetTargetVersion(name string) (*TargetVersion, error) {
+	dmt := C.dm_task_create(C.DM_DEVICE_GET_TARGET_VERSION)
+	if dmt == nil {
+		return nil, fmt.Errorf("Cannot create DM_DEVICE_GET_TARGET_VERSION task")
+	}
+
+	defer C.dm_task_destroy(dmt)
+
+	Cname := C.CString(name)
+	defer C.free(unsafe.Pointer(Cname))
+
+	if C.dm_task_set_name(dmt, Cname) == 0 || C.dm_task_run(dmt) == 0 {
+		switch errno := unix.Errno(C.dm_task_get_errno(dmt)); errno {
+		case unix.EINVAL:
+			return nil, ErrTargetNotFound
+		case unix.ENOTTY:
+			// DM_GET_TARGET_VERSION requires kernel 4.17 or later
+			return getTargetVersionFromList(name)
+		default:
+			return nil, &DMError{"DM_DEVICE_GET_TARGET_VERSION", errno}
+		}
+	}
+
+	return findTargetVersion(getVersions(dmt), name)
+}
+
+// getVersions returns the target versions from a completed libdevmapper DM_DEVICE_LIST_VERSIONS
+// or DM_DEVICE_GET_TARGET_VERSION task.
+func getVersions(dmt *C.struct_dm_task) (versions []TargetVersion) {
+	v := C.dm_task_get_versions(dmt)
+	if v == nil {
+		return
+	}
+
+	for {
+		// struct dm_versions is a "variable length" struct; its name immediately follows the
+		// version array.
+		name := (*C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(v)) + unsafe.Sizeof(*v)))
+
+		versions = append(versions, TargetVersion{
+			C.GoString(name),
+			Version{uint32(v.version[0]), uint32(v.version[1]), uint32(v.version[2])},
+		})
+
+		if v.next == 0 {
+			break
+		}
+
+		v = (*C.struct_dm_versions)(unsafe.Pointer(uintptr(unsafe.Pointer(v)) + uintptr(v.next)))
+	}
+
+	return
+}
@@ -0,0 +1,225 @@
+// +build linux,dmioctl linux,!cgo
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Pure-Go devmapper backend, which issues ioctls directly against the devmapper control device.
+
+package devmapper
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Initial size of ioctl buffers. Buffers are grown as necessary if the kernel indicates that
+	// the result did not fit.
+	dmIoctlBufSize = 16 * 1024
+	dmIoctlBufMax  = 16 * 1024 * 1024
+)
+
+// dmIoctlNames maps ioctl request numbers to names, for use in error messages.
+var dmIoctlNames = map[uintptr]string{
+	unix.DM_VERSION:            "DM_VERSION",
+	unix.DM_REMOVE_ALL:         "DM_REMOVE_ALL",
+	unix.DM_LIST_DEVICES:       "DM_LIST_DEVICES",
+	unix.DM_DEV_CREATE:         "DM_DEV_CREATE",
+	unix.DM_DEV_REMOVE:         "DM_DEV_REMOVE",
+	unix.DM_DEV_RENAME:         "DM_DEV_RENAME",
+	unix.DM_DEV_SUSPEND:        "DM_DEV_SUSPEND",
+	unix.DM_DEV_STATUS:         "DM_DEV_STATUS",
+	unix.DM_DEV_WAIT:           "DM_DEV_WAIT",
+	unix.DM_TABLE_LOAD:         "DM_TABLE_LOAD",
+	unix.DM_TABLE_CLEAR:        "DM_TABLE_CLEAR",
+	unix.DM_TABLE_DEPS:         "DM_TABLE_DEPS",
+	unix.DM_TABLE_STATUS:       "DM_TABLE_STATUS",
+	unix.DM_LIST_VERSIONS:      "DM_LIST_VERSIONS",
+	unix.DM_TARGET_MSG:         "DM_TARGET_MSG",
+	unix.DM_DEV_SET_GEOMETRY:   "DM_DEV_SET_GEOMETRY",
+	unix.DM_GET_TARGET_VERSION: "DM_GET_TARGET_VERSION",
+}
+
+// dmTaskIoctls maps devmapper task types to the ioctls which implement them.
+var dmTaskIoctls = map[dmTaskType]uintptr{
+	dmDeviceCreate:    unix.DM_DEV_CREATE,
+	dmDeviceReload:    unix.DM_TABLE_LOAD,
+	dmDeviceRemove:    unix.DM_DEV_REMOVE,
+	dmDeviceSuspend:   unix.DM_DEV_SUSPEND,
+	dmDeviceResume:    unix.DM_DEV_SUSPEND,
+	dmDeviceStatus:    unix.DM_TABLE_STATUS,
+	dmDeviceInfo:      unix.DM_DEV_STATUS,
+	dmDeviceTable:     unix.DM_TABLE_STATUS,
+	dmDeviceTargetMsg: unix.DM_TARGET_MSG,
+	dmDeviceDeps:      unix.DM_TABLE_DEPS,
+	dmDeviceRename:    unix.DM_DEV_RENAME,
+	dmDeviceClear:     unix.DM_TABLE_CLEAR,
+}
+
+// run executes a devmapper task by issuing the corresponding ioctl.
+func (t *dmTask) run() error {
+	flags := t.flags
+
+	// Table and status requests are distinguished only by a flag
+	if t.typ == dmDeviceTable {
+		flags |= unix.DM_STATUS_TABLE_FLAG
+	}
+
+	hdr, err := newDmIoctl(t.name, flags)
+	if err != nil {
+		return err
+	}
+
+	if err := hdr.setUUID(t.uuid); err != nil {
+		return err
+	}
+
+	var payload []byte
+
+	switch t.typ {
+	case dmDeviceReload:
+		if payload, err = marshalTargets(t.targets); err != nil {
+			return err
+		}
+
+		hdr.TargetCount = uint32(len(t.targets))
+
+	case dmDeviceTargetMsg:
+		payload = marshalTargetMsg(t.sector, t.message)
+
+	case dmDeviceRename:
+		// New name or UUID, NUL-terminated
+		payload = append([]byte(t.newName), 0)
+	}
+
+	res, data, err := dmIoctlRun(dmTaskIoctls[t.typ], hdr, payload)
+	if err != nil {
+		// As with libdevmapper, a nonexistent device is not an error for info and status tasks
+		if dmErr, ok := err.(*DMError); ok && dmErr.errno == unix.ENXIO &&
+			(t.typ == dmDeviceInfo || t.typ == dmDeviceStatus) {
+			t.info = DeviceInfo{}
+			return nil
+		}
+
+		return err
+	}
+
+	t.info = res.info()
+
+	switch t.typ {
+	case dmDeviceStatus, dmDeviceTable:
+		t.targets, err = unmarshalTargets(data, int(res.TargetCount))
+
+	case dmDeviceDeps:
+		t.deps, err = unmarshalDeps(data)
+
+	case dmDeviceTargetMsg:
+		if res.Flags&unix.DM_DATA_OUT_FLAG != 0 {
+			t.response = cString(data)
+		}
+	}
+
+	return err
+}
+
+// dmIoctlRun issues devmapper ioctl `req` with the specified header and payload, and returns the
+// header and data area of the result. If the kernel reports that the result did not fit in the
+// buffer, the ioctl is retried with a larger buffer.
+func dmIoctlRun(req uintptr, hdr *dmIoctl, payload []byte) (*dmIoctl, []byte, error) {
+	fd, err := unix.Open(dmControlPath, unix.O_RDWR|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot open %s - %s", dmControlPath, err)
+	}
+
+	defer unix.Close(fd)
+
+	for bufSize := dmIoctlBufSize; ; bufSize *= 2 {
+		buf := hdr.marshal(payload, bufSize)
+
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return nil, nil, &DMError{dmIoctlNames[req], errno}
+		}
+
+		res, data, err := unmarshalDmIoctl(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if res.Flags&unix.DM_BUFFER_FULL_FLAG == 0 {
+			return res, data, nil
+		}
+
+		if bufSize >= dmIoctlBufMax {
+			return nil, nil, fmt.Errorf("%s result exceeds %d bytes", dmIoctlNames[req], dmIoctlBufMax)
+		}
+	}
+}
+
+// GetDeviceList returns a list of devmapper devices, including device number and name
+func GetDeviceList() ([]dmDevice, error) {
+	hdr, err := newDmIoctl("", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := dmIoctlRun(unix.DM_LIST_DEVICES, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalNames(data)
+}
+
+// ListTargetVersions returns the target types registered with the kernel, and their versions.
+// Target types provided by modules which have not yet been loaded are not listed.
+func ListTargetVersions() ([]TargetVersion, error) {
+	hdr, err := newDmIoctl("", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := dmIoctlRun(unix.DM_LIST_VERSIONS, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalVersions(data)
+}
+
+// GetTargetVersion returns the version of the named target type. Unlike ListTargetVersions, the
+// kernel loads the target's module if necessary. ErrTargetNotFound is returned if the kernel does
+// not provide the target type.
+func GetTargetVersion(name string) (*TargetVersion, error) {
+	hdr, err := newDmIoctl(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err := dmIoctlRun(unix.DM_GET_TARGET_VERSION, hdr, nil)
+	if err != nil {
+		dmErr, ok := err.(*DMError)
+		if !ok {
+			return nil, err
+		}
+
+		switch dmErr.errno {
+		case unix.EINVAL:
+			return nil, ErrTargetNotFound
+		case unix.ENOTTY:
+			// DM_GET_TARGET_VERSION requires kernel 4.17 or later
+			return getTargetVersionFromList(name)
+		}
+
+		return nil, err
+	}
+
+	versions, err := unmarshalVersions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return findTargetVersion(versions, name)
+}
@@ -0,0 +1,589 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for Go devmapper bindings, using loop devices.
+
+package devmapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func randString(length int) string {
+	rand.Seed(time.Now().UnixNano())
+
+	letters := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	b := make([]byte, length)
+
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+
+	return string(b)
+}
+
+// requireDM skips the calling test if devmapper devices cannot be managed, e.g. because the
+// test is not running as root, or the kernel lacks devmapper support.
+func requireDM(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Test requires root privileges")
+	}
+
+	if _, err := os.Stat("/dev/mapper/control"); err != nil {
+		t.Skip("Devmapper not available:", err)
+	}
+}
+
+// testLoopDev is a loop device backed by a sparse temporary file.
+type testLoopDev struct {
+	nr      int
+	path    string // e.g. "/dev/loop0"
+	devNo   string // e.g. "7:0", as reported in devmapper tables
+	backing string
+}
+
+// newTestLoopDev creates a sparse file of the specified size and attaches it to the next
+// available loop device.
+func newTestLoopDev(t *testing.T, size int64) *testLoopDev {
+	tmpfile, err := ioutil.TempFile("", "devmapper_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tmpfile.Close()
+
+	if err := unix.Ftruncate(int(tmpfile.Fd()), size); err != nil {
+		os.Remove(tmpfile.Name())
+		t.Fatal(err)
+	}
+
+	loopNr, err := getFreeLoopDev()
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		t.Fatal("Cannot determine next available loop device:", err)
+	}
+
+	if err := attachLoopDev(loopNr, tmpfile.Name()); err != nil {
+		os.Remove(tmpfile.Name())
+		t.Fatal("Cannot attach loop device:", err)
+	}
+
+	l := &testLoopDev{nr: loopNr, path: fmt.Sprintf("/dev/loop%d", loopNr), backing: tmpfile.Name()}
+
+	var st unix.Stat_t
+	if err := unix.Stat(l.path, &st); err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	l.devNo = fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+
+	return l
+}
+
+// Close detaches the loop device and removes its backing file.
+func (l *testLoopDev) Close() {
+	detachLoopDev(l.nr)
+	os.Remove(l.backing)
+}
+
+// testDeviceName returns a random device name, which is unlikely to clash with existing devices.
+func testDeviceName() string {
+	return "devmapper-test-" + randString(8)
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	requireDM(t)
+
+	loop := newTestLoopDev(t, 16*(1<<20))
+	defer loop.Close()
+
+	name := testDeviceName()
+	table := []dmTarget{{0, 8192, "linear", loop.path + " 2048"}}
+
+	if err := CreateDevice(name, "DEVMAPPER-TEST-"+name, table, false); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := false
+	defer func() {
+		if !removed {
+			RemoveDevice(name, false)
+		}
+	}()
+
+	// The kernel reports devices by major:minor, regardless of how they were specified
+	expected := dmTarget{0, 8192, "linear", loop.devNo + " 2048"}
+
+	if targets, err := GetDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if len(targets) != 1 || targets[0] != expected {
+		t.Fatalf("Got table %#v, expected %#v", targets, expected)
+	}
+
+	if err := SuspendDevice(name, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadTable(name, []dmTarget{{0, 8192, "zero", ""}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResumeDevice(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if targets, err := GetDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if len(targets) != 1 || targets[0].Type != "zero" {
+		t.Fatalf("Got table %#v after reload, expected zero target", targets)
+	}
+
+	if err := RemoveDevice(name, true); err != nil {
+		t.Fatal(err)
+	}
+
+	removed = true
+
+	if _, err := GetDeviceTable(name); err == nil {
+		t.Error("Device still exists after removal")
+	}
+}
+
+func TestCreateDeviceInvalidTable(t *testing.T) {
+	requireDM(t)
+
+	name := testDeviceName()
+
+	// Targets must be contiguous, so the table load must fail
+	table := []dmTarget{{0, 8, "zero", ""}, {16, 8, "zero", ""}}
+
+	if err := CreateDevice(name, "", table, false); err == nil {
+		RemoveDevice(name, false)
+		t.Fatal("Expected error for non-contiguous table")
+	}
+
+	if _, err := GetDeviceTable(name); err == nil {
+		RemoveDevice(name, false)
+		t.Error("Device was not removed after failed table load")
+	}
+}
+
+func TestGetDeviceStatus(t *testing.T) {
+	requireDM(t)
+
+	name := testDeviceName()
+	table := []dmTarget{{0, 8, "zero", ""}, {8, 8, "error", ""}}
+
+	if err := CreateDevice(name, "", table, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	targets, err := GetDeviceStatus(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(targets, table) {
+		t.Errorf("Got status %#v, expected %#v", targets, table)
+	}
+
+	for _, target := range targets {
+		if status, err := ParseTargetStatus(target); err != nil || status != "" {
+			t.Errorf("Unexpected %s status %#v, %v", target.Type, status, err)
+		}
+	}
+}
+
+func TestGetDeviceInfo(t *testing.T) {
+	requireDM(t)
+
+	name := testDeviceName()
+	uuid := "DEVMAPPER-TEST-" + name
+
+	if err := CreateDevice(name, uuid, []dmTarget{{0, 8, "zero", ""}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	info, err := GetDeviceInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name != name || info.UUID != uuid || !info.Exists || !info.LiveTable || !info.ReadOnly ||
+		info.Suspended || info.InactiveTable || info.TargetCount != 1 || info.OpenCount != 0 {
+		t.Errorf("Unexpected device info: %+v", info)
+	}
+
+	if err := SuspendDevice(name, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadTable(name, []dmTarget{{0, 16, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	byUUID, err := GetDeviceInfoByUUID(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if byUUID.Name != name || byUUID.Major != info.Major || byUUID.Minor != info.Minor ||
+		!byUUID.Suspended || !byUUID.InactiveTable {
+		t.Errorf("Unexpected device info: %+v", byUUID)
+	}
+
+	if err := ResumeDevice(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetDeviceInfoNotFound(t *testing.T) {
+	requireDM(t)
+
+	if info, err := GetDeviceInfo(testDeviceName()); err != ErrDeviceNotFound {
+		t.Errorf("Got %+v, %v; expected ErrDeviceNotFound", info, err)
+	}
+
+	if info, err := GetDeviceInfoByUUID("DEVMAPPER-TEST-NONEXISTENT"); err != ErrDeviceNotFound {
+		t.Errorf("Got %+v, %v; expected ErrDeviceNotFound", info, err)
+	}
+
+	if _, err := GetDeviceStatus(testDeviceName()); err != ErrDeviceNotFound {
+		t.Errorf("Got %v; expected ErrDeviceNotFound", err)
+	}
+
+	if err := RemoveDevice(testDeviceName(), false); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Got %v; expected error equivalent to ErrDeviceNotFound", err)
+	}
+}
+
+func TestMultiSegmentTable(t *testing.T) {
+	requireDM(t)
+
+	loop1 := newTestLoopDev(t, 16*(1<<20))
+	defer loop1.Close()
+
+	loop2 := newTestLoopDev(t, 16*(1<<20))
+	defer loop2.Close()
+
+	name := testDeviceName()
+
+	// Interleave segments from both loop devices
+	table := []dmTarget{
+		{0, 2048, "linear", loop1.devNo + " 0"},
+		{2048, 4096, "linear", loop2.devNo + " 0"},
+		{6144, 1024, "linear", loop1.devNo + " 2048"},
+		{7168, 8192, "linear", loop2.devNo + " 4096"},
+		{15360, 512, "zero", ""},
+	}
+
+	if err := CreateDevice(name, "", table, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	targets, err := GetDeviceTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(targets, table) {
+		t.Errorf("Got table %#v, expected %#v", targets, table)
+	}
+
+	if info, err := GetDeviceInfo(name); err != nil {
+		t.Fatal(err)
+	} else if int(info.TargetCount) != len(table) {
+		t.Errorf("Got target count %d, expected %d", info.TargetCount, len(table))
+	}
+}
+
+func TestInactiveTable(t *testing.T) {
+	requireDM(t)
+
+	loop := newTestLoopDev(t, 16*(1<<20))
+	defer loop.Close()
+
+	name := testDeviceName()
+	active := []dmTarget{{0, 4096, "linear", loop.devNo + " 0"}}
+	inactive := []dmTarget{
+		{0, 2048, "linear", loop.devNo + " 4096"},
+		{2048, 2048, "linear", loop.devNo + " 0"},
+	}
+
+	if err := CreateDevice(name, "", active, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	if targets, err := GetInactiveDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if len(targets) != 0 {
+		t.Errorf("Got inactive table %#v, expected none", targets)
+	}
+
+	if err := LoadTable(name, inactive, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if targets, err := GetInactiveDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(targets, inactive) {
+		t.Errorf("Got inactive table %#v, expected %#v", targets, inactive)
+	}
+
+	if targets, err := GetDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(targets, active) {
+		t.Errorf("Got active table %#v, expected %#v", targets, active)
+	}
+
+	if err := SuspendDevice(name, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResumeDevice(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if targets, err := GetDeviceTable(name); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(targets, inactive) {
+		t.Errorf("Got active table %#v after resume, expected %#v", targets, inactive)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"vg0-root", "a", "pool_tdata", "LVM-abc+def=0:1@2#3.4", strings.Repeat("x", 127)}
+
+	for _, name := range valid {
+		if err := validateName("name", name, unix.DM_NAME_LEN); err != nil {
+			t.Errorf("Unexpected error for %q: %s", name, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "a/b", "with space", "caf\u00e9", "tab\t", strings.Repeat("x", 128)}
+
+	for _, name := range invalid {
+		err := validateName("name", name, unix.DM_NAME_LEN)
+		if _, ok := err.(*InvalidNameError); !ok {
+			t.Errorf("Expected InvalidNameError for %q, got %v", name, err)
+		}
+	}
+
+	// Names are validated before any device is created
+	for _, id := range [][2]string{{"with space", ""}, {"vg0-root", "bad/uuid"}} {
+		err := CreateDevice(id[0], id[1], nil, false)
+		if _, ok := err.(*InvalidNameError); !ok {
+			t.Errorf("CreateDevice: expected InvalidNameError for %q, %q, got %v", id[0], id[1], err)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	requireDM(t)
+
+	name, newName := testDeviceName(), testDeviceName()
+
+	if err := CreateDevice(name, "", []dmTarget{{0, 1024, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rename(name, newName); err != nil {
+		RemoveDevice(name, false)
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(newName, false)
+
+	if _, err := GetDeviceInfo(name); err != ErrDeviceNotFound {
+		t.Errorf("Old name: got %v, expected ErrDeviceNotFound", err)
+	}
+
+	other := testDeviceName()
+	if err := CreateDevice(other, "", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(other, false)
+
+	if err := Rename(newName, other); err != ErrDeviceExists {
+		t.Errorf("Got %v, expected ErrDeviceExists", err)
+	}
+
+	if err := Rename(newName, "in/valid"); err == nil {
+		t.Error("Expected error for invalid name")
+	}
+
+	uuid := "DEVMAPPER-TEST-" + newName
+	if err := SetUUID(newName, uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := GetDeviceInfo(newName); err != nil {
+		t.Error(err)
+	} else if info.UUID != uuid {
+		t.Errorf("Got UUID %q, expected %q", info.UUID, uuid)
+	}
+
+	if err := SetUUID(newName, uuid+"-2"); err != ErrUUIDAlreadySet {
+		t.Errorf("Got %v, expected ErrUUIDAlreadySet", err)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	requireDM(t)
+
+	name := testDeviceName()
+
+	if err := CreateDevice(name, "", []dmTarget{{0, 2048, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	// @stats_create responds with the ID of the new region
+	id, err := SendMessage(name, 0, "@stats_create - /4 devmapper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(id) != "0" {
+		t.Errorf("Got region ID %q, expected \"0\"", id)
+	}
+
+	list, err := StatsList(name, "devmapper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(list, "0: 0+2048 512 devmapper-test") {
+		t.Errorf("Unexpected @stats_list response %q", list)
+	}
+
+	if _, err := SendMessage(name, 0, "no_such_message"); err == nil {
+		t.Error("Expected error for invalid message")
+	}
+}
+
+func TestWaitEvent(t *testing.T) {
+	requireDM(t)
+
+	name := testDeviceName()
+
+	if err := CreateDevice(name, "", []dmTarget{{0, 8, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	info, err := GetDeviceInfo(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns immediately if the event number already differs
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if nr, err := WaitEvent(ctx, name, info.EventNr+1); err != nil || nr != info.EventNr {
+		t.Errorf("Got event number %d, %v; expected %d", nr, err, info.EventNr)
+	}
+
+	// Times out if no event occurs, without leaving anything running in the background
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := WaitEvent(ctx, name, info.EventNr); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, expected context.DeadlineExceeded", err)
+	}
+
+	for x := 0; runtime.NumGoroutine() > goroutines; x++ {
+		if x == 100 {
+			t.Fatalf("%d goroutines still running after WaitEvent returned", runtime.NumGoroutine()-goroutines)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Wakes up when the device is removed, which raises an event
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		RemoveDevice(name, false)
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := WaitEvent(ctx, name, info.EventNr); err != ErrDeviceNotFound {
+		t.Errorf("Got %v, expected ErrDeviceNotFound", err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	requireDM(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := NewWatcher(50 * time.Millisecond).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := testDeviceName()
+
+	if err := CreateDevice(name, "", []dmTarget{{0, 8, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := false
+	defer func() {
+		if !removed {
+			RemoveDevice(name, false)
+		}
+	}()
+
+	expect := func(typ DeviceEventType) {
+		for ev := range events {
+			if ev.Name == name && ev.Type == typ {
+				return
+			}
+		}
+
+		t.Fatalf("Did not receive %s event for %s", typ, name)
+	}
+
+	expect(DeviceAdded)
+
+	if err := RemoveDevice(name, false); err != nil {
+		t.Fatal(err)
+	}
+
+	removed = true
+
+	expect(DeviceRemoved)
+}
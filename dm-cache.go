@@ -1,69 +1,451 @@
 // Copyright 2017-18 Daniel Swarbrick. All rights reserved.
 // Use of this source code is governed by a GPL license that can be found in the LICENSE file.
 
-// dm-cache Statistics Parser.
+// dm-cache Status Parser and Table Builder.
 // See dm-cache documentation at: https://www.kernel.org/doc/Documentation/device-mapper/cache.txt
 
 package devmapper
 
-import "fmt"
-
-type dmCacheStatus struct {
-	mdataBlockSize   int // Fixed block size for each metadata block in sectors
-	mdataUsedBlocks  int // Number of metadata blocks used
-	mdataTotalBlocks int // Total number of metadata blocks
-	cacheBlockSize   int // Configurable block size for the cache device in sectors
-	cacheUsedBlocks  int // Number of blocks resident in the cache
-	cacheTotalBlocks int // Total number of cache blocks
-	readHits         int // Number of times a READ bio has been mapped to the cache
-	readMisses       int // Number of times a READ bio has been mapped to the origin
-	writeHits        int // Number of times a WRITE bio has been mapped to the cache
-	writeMisses      int // Number of times a WRITE bio has been mapped to the origin
-	demotions        int // Number of times a block has been removed from the cache
-	promotions       int // Number of times a block has been moved to the cache
-	dirty            int // Number of blocks in the cache that differ from the origin
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatus represents the status of a cache target.
+type CacheStatus struct {
+	MdataBlockSize   int // Fixed block size for each metadata block in sectors
+	MdataUsedBlocks  int // Number of metadata blocks used
+	MdataTotalBlocks int // Total number of metadata blocks
+	CacheBlockSize   int // Configurable block size for the cache device in sectors
+	CacheUsedBlocks  int // Number of blocks resident in the cache
+	CacheTotalBlocks int // Total number of cache blocks
+	ReadHits         int // Number of times a READ bio has been mapped to the cache
+	ReadMisses       int // Number of times a READ bio has been mapped to the origin
+	WriteHits        int // Number of times a WRITE bio has been mapped to the cache
+	WriteMisses      int // Number of times a WRITE bio has been mapped to the origin
+	Demotions        int // Number of times a block has been removed from the cache
+	Promotions       int // Number of times a block has been moved to the cache
+	Dirty            int // Number of blocks in the cache that differ from the origin
+
+	Failed bool // Cache has failed, and no other fields are valid
+	Error  bool // Cache status could not be read, and no other fields are valid
+
+	Features           []string          // Feature args, as reported by the kernel
+	IOMode             string            // "writeback", "writethrough" or "passthrough"
+	Metadata2          bool              // Cache uses version 2 metadata format
+	NoDiscardPassdown  bool              // Discards are not passed down to the origin device
+	MigrationThreshold int               // Maximum sectors migrated at any one time
+	Policy             string            // Replacement policy name, e.g. "smq"
+	PolicyArgs         map[string]string // Policy tunables
+	MetadataMode       string            // "rw" or "ro"
+	NeedsCheck         bool              // Metadata must be checked with cache_check
 }
 
-// cacheUsedPerc returns the percentage of cache blocks used
-func (d *dmCacheStatus) cacheUsedPerc() float64 {
-	return float64(d.cacheUsedBlocks) / float64(d.cacheTotalBlocks) * 100
+// CacheUsedPerc returns the percentage of cache blocks used
+func (d *CacheStatus) CacheUsedPerc() float64 {
+	if d.CacheTotalBlocks == 0 {
+		return 0
+	}
+
+	return float64(d.CacheUsedBlocks) / float64(d.CacheTotalBlocks) * 100
 }
 
-// mdataUsedPerc returns the percentage of metadata blocks used
-func (d *dmCacheStatus) mdataUsedPerc() float64 {
-	return float64(d.mdataUsedBlocks) / float64(d.mdataTotalBlocks) * 100
+// MdataUsedPerc returns the percentage of metadata blocks used
+func (d *CacheStatus) MdataUsedPerc() float64 {
+	if d.MdataTotalBlocks == 0 {
+		return 0
+	}
+
+	return float64(d.MdataUsedBlocks) / float64(d.MdataTotalBlocks) * 100
 }
 
-// readHitRatio returns the cache read hit ratio (0.0 - 1.0)
-func (d *dmCacheStatus) readHitRatio() float64 {
-	if d.readHits > 0 {
-		return float64(d.readHits) / float64(d.readHits+d.readMisses)
+// ReadHitRatio returns the cache read hit ratio (0.0 - 1.0)
+func (d *CacheStatus) ReadHitRatio() float64 {
+	if d.ReadHits > 0 {
+		return float64(d.ReadHits) / float64(d.ReadHits+d.ReadMisses)
 	} else {
 		return 0
 	}
 }
 
-// writeHitRatio returns the cache write hit ratio (0.0 - 1.0)
-func (d *dmCacheStatus) writeHitRatio() float64 {
-	if d.writeHits > 0 {
-		return float64(d.writeHits) / float64(d.writeHits+d.writeMisses)
+// WriteHitRatio returns the cache write hit ratio (0.0 - 1.0)
+func (d *CacheStatus) WriteHitRatio() float64 {
+	if d.WriteHits > 0 {
+		return float64(d.WriteHits) / float64(d.WriteHits+d.WriteMisses)
 	} else {
 		return 0
 	}
 }
 
-func unmarshallParams(params string) dmCacheStatus {
-	var s dmCacheStatus
+// ErrCounterReset is returned by CacheRatesBetween and StatsRatesBetween when counters were reset
+// between two samples, e.g. because the device was reloaded.
+var ErrCounterReset = errors.New("Counters were reset between samples")
+
+// A CacheSample is a cache target status, and the time at which it was taken.
+type CacheSample struct {
+	Time   time.Time
+	Status *CacheStatus
+}
+
+// CacheRates contains the rates of change of a cache target's counters between two samples.
+type CacheRates struct {
+	Interval    time.Duration // Time between samples
+	ReadHits    float64       // Read hits per second
+	ReadMisses  float64       // Read misses per second
+	WriteHits   float64       // Write hits per second
+	WriteMisses float64       // Write misses per second
+	Promotions  float64       // Promotions per second
+	Demotions   float64       // Demotions per second
+	DirtyDelta  int           // Change in number of dirty blocks; negative if the cache is cleaning
+	DirtyRate   float64       // Change in number of dirty blocks per second
+}
+
+// CacheRatesBetween computes the rates of change of a cache target's counters from an earlier
+// and a later sample. ErrCounterReset is returned if any counter decreased, or the cache geometry
+// changed, between the samples, since the rates would be meaningless. Such a pair of samples
+// should be discarded, and the later sample used as the baseline for the next computation.
+func CacheRatesBetween(prev, cur CacheSample) (*CacheRates, error) {
+	if prev.Status == nil || cur.Status == nil {
+		return nil, fmt.Errorf("Missing cache status")
+	}
+
+	p, c := prev.Status, cur.Status
+
+	if p.Failed || p.Error || c.Failed || c.Error {
+		return nil, fmt.Errorf("Cache status unavailable")
+	}
+
+	interval := cur.Time.Sub(prev.Time)
+	if interval <= 0 {
+		return nil, fmt.Errorf("Samples are not in chronological order")
+	}
+
+	if c.CacheBlockSize != p.CacheBlockSize || c.CacheTotalBlocks != p.CacheTotalBlocks {
+		return nil, ErrCounterReset
+	}
+
+	counters := [][2]int{
+		{p.ReadHits, c.ReadHits},
+		{p.ReadMisses, c.ReadMisses},
+		{p.WriteHits, c.WriteHits},
+		{p.WriteMisses, c.WriteMisses},
+		{p.Promotions, c.Promotions},
+		{p.Demotions, c.Demotions},
+	}
+
+	secs := interval.Seconds()
+	rates := make([]float64, len(counters))
+
+	for x, n := range counters {
+		if n[1] < n[0] {
+			return nil, ErrCounterReset
+		}
+
+		rates[x] = float64(n[1]-n[0]) / secs
+	}
+
+	return &CacheRates{
+		Interval:    interval,
+		ReadHits:    rates[0],
+		ReadMisses:  rates[1],
+		WriteHits:   rates[2],
+		WriteMisses: rates[3],
+		Promotions:  rates[4],
+		Demotions:   rates[5],
+		DirtyDelta:  c.Dirty - p.Dirty,
+		DirtyRate:   float64(c.Dirty-p.Dirty) / secs,
+	}, nil
+}
+
+func unmarshallParams(params string) (CacheStatus, error) {
+	var s CacheStatus
+
+	switch params {
+	case "Fail":
+		s.Failed = true
+		return s, nil
+	case "Error":
+		s.Error = true
+		return s, nil
+	}
+
+	_, err := fmt.Sscanf(params, "%d %d/%d %d %d/%d %d %d %d %d %d %d %d",
+		&s.MdataBlockSize, &s.MdataUsedBlocks, &s.MdataTotalBlocks,
+		&s.CacheBlockSize, &s.CacheUsedBlocks, &s.CacheTotalBlocks,
+		&s.ReadHits, &s.ReadMisses,
+		&s.WriteHits, &s.WriteMisses,
+		&s.Demotions, &s.Promotions, &s.Dirty)
+	if err != nil {
+		return s, err
+	}
+
+	// Remainder of status line is variable length, and is handled token by token. The usage
+	// ratios above each span a single token.
+	r := newFieldReader(params)
+	r.pos = 11
+
+	if s.Features, err = r.counted(); err != nil {
+		return s, err
+	}
+
+	for _, f := range s.Features {
+		switch f {
+		case "writeback", "writethrough", "passthrough":
+			s.IOMode = f
+		case "metadata2":
+			s.Metadata2 = true
+		case "no_discard_passdown":
+			s.NoDiscardPassdown = true
+		}
+	}
+
+	coreArgs, err := r.counted()
+	if err != nil {
+		return s, err
+	}
+
+	if len(coreArgs)%2 != 0 {
+		return s, fmt.Errorf("Odd number of core args: %q", coreArgs)
+	}
+
+	for x := 0; x < len(coreArgs); x += 2 {
+		if coreArgs[x] == "migration_threshold" {
+			if s.MigrationThreshold, err = strconv.Atoi(coreArgs[x+1]); err != nil {
+				return s, err
+			}
+		}
+	}
+
+	if s.Policy, err = r.next(); err != nil {
+		return s, err
+	}
+
+	policyArgs, err := r.counted()
+	if err != nil {
+		return s, err
+	}
+
+	if len(policyArgs)%2 != 0 {
+		return s, fmt.Errorf("Odd number of policy args: %q", policyArgs)
+	}
+
+	s.PolicyArgs = make(map[string]string, len(policyArgs)/2)
+	for x := 0; x < len(policyArgs); x += 2 {
+		s.PolicyArgs[policyArgs[x]] = policyArgs[x+1]
+	}
+
+	// Metadata mode and needs_check flag were added in later kernel versions
+	if r.more() {
+		s.MetadataMode, _ = r.next()
+	}
+
+	if r.more() {
+		f, _ := r.next()
+		s.NeedsCheck = f == "needs_check"
+	}
+
+	if r.more() {
+		return s, fmt.Errorf("Unexpected trailing parameters %q", r.fields[r.pos:])
+	}
+
+	return s, nil
+}
+
+// parseCacheStatus parses a cache target status line, for use with ParseTargetStatus.
+func parseCacheStatus(params string) (interface{}, error) {
+	s, err := unmarshallParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// CblockRange is a range of cache blocks, from Begin up to but not including End.
+type CblockRange struct {
+	Begin uint64
+	End   uint64
+}
+
+// invalidateCblocksMessage returns the invalidate_cblocks message for the specified ranges. The
+// kernel silently ignores the message if no ranges are given, so that is treated as an error.
+func invalidateCblocksMessage(cblocks []CblockRange) (string, error) {
+	if len(cblocks) == 0 {
+		return "", fmt.Errorf("No cache blocks to invalidate")
+	}
+
+	args := []string{"invalidate_cblocks"}
+
+	for _, r := range cblocks {
+		if r.End <= r.Begin {
+			return "", fmt.Errorf("Invalid cache block range %d-%d", r.Begin, r.End)
+		}
+
+		if r.End == r.Begin+1 {
+			args = append(args, fmt.Sprintf("%d", r.Begin))
+		} else {
+			args = append(args, fmt.Sprintf("%d-%d", r.Begin, r.End))
+		}
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+const (
+	cacheMinBlockSize = 64      // 32 KiB, in sectors
+	cacheMaxBlockSize = 2097152 // 1 GiB, in sectors
+)
+
+// CacheTarget is a cache target, which caches blocks of a slow origin device on a fast cache
+// device.
+type CacheTarget struct {
+	Start       uint64 // Start sector of target
+	Length      uint64 // Length of target in sectors, normally the size of the origin device
+	MetadataDev string // Metadata device path, or major:minor
+	CacheDev    string // Cache device path, or major:minor
+	OriginDev   string // Origin device path, or major:minor
+	BlockSize   uint64 // Cache block size in sectors; a multiple of 64 (32 KiB), up to 1 GiB
+
+	IOMode            string // "writeback", "writethrough" or "passthrough"; kernel default if empty
+	Metadata2         bool   // Use version 2 metadata format
+	NoDiscardPassdown bool   // Don't pass discards down to the origin device
+
+	Policy     string            // Replacement policy name, e.g. "smq" or "cleaner"; "default" if empty
+	PolicyArgs map[string]string // Policy tunables, and core args such as migration_threshold
+}
+
+// Marshal returns the table target for a cache.
+func (t CacheTarget) Marshal() (dmTarget, error) {
+	for _, dev := range []string{t.MetadataDev, t.CacheDev, t.OriginDev} {
+		if err := checkDevice(dev); err != nil {
+			return dmTarget{}, err
+		}
+	}
+
+	if t.BlockSize < cacheMinBlockSize || t.BlockSize > cacheMaxBlockSize || t.BlockSize%cacheMinBlockSize != 0 {
+		return dmTarget{}, fmt.Errorf("Invalid cache block size %d", t.BlockSize)
+	}
+
+	// Features are emitted in the same order as the kernel reports them
+	var features []string
+
+	if t.Metadata2 {
+		features = append(features, "metadata2")
+	}
+
+	switch t.IOMode {
+	case "":
+	case "writeback", "writethrough", "passthrough":
+		features = append(features, t.IOMode)
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid cache I/O mode %q", t.IOMode)
+	}
+
+	if t.NoDiscardPassdown {
+		features = append(features, "no_discard_passdown")
+	}
+
+	policy := t.Policy
+	if policy == "" {
+		policy = "default"
+	}
 
-	fmt.Sscanf(params, "%d %d/%d %d %d/%d %d %d %d %d %d %d %d",
-		&s.mdataBlockSize, &s.mdataUsedBlocks, &s.mdataTotalBlocks,
-		&s.cacheBlockSize, &s.cacheUsedBlocks, &s.cacheTotalBlocks,
-		&s.readHits, &s.readMisses,
-		&s.writeHits, &s.writeMisses,
-		&s.demotions, &s.promotions, &s.dirty)
+	// Policy args are unordered; sort them so that the table is deterministic
+	keys := make([]string, 0, len(t.PolicyArgs))
+	for k := range t.PolicyArgs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	params := []string{
+		t.MetadataDev, t.CacheDev, t.OriginDev,
+		strconv.FormatUint(t.BlockSize, 10),
+		strconv.Itoa(len(features)),
+	}
+
+	params = append(params, features...)
+	params = append(params, policy, strconv.Itoa(len(keys)*2))
+
+	for _, k := range keys {
+		params = append(params, k, t.PolicyArgs[k])
+	}
+
+	return dmTarget{t.Start, t.Length, "cache", strings.Join(params, " ")}, nil
+}
+
+// Unmarshal parses a cache table target, as returned by GetDeviceTable.
+func (t *CacheTarget) Unmarshal(target dmTarget) error {
+	var (
+		c   CacheTarget
+		err error
+	)
+
+	if err := checkTargetType(target, "cache"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	for _, dev := range []*string{&c.MetadataDev, &c.CacheDev, &c.OriginDev} {
+		if *dev, err = r.next(); err != nil {
+			return err
+		}
+	}
+
+	if c.BlockSize, err = r.uint64(); err != nil {
+		return err
+	}
+
+	features, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range features {
+		switch f {
+		case "writeback", "writethrough", "passthrough":
+			c.IOMode = f
+		case "metadata2":
+			c.Metadata2 = true
+		case "no_discard_passdown":
+			c.NoDiscardPassdown = true
+		default:
+			return fmt.Errorf("Unknown cache feature %q", f)
+		}
+	}
+
+	if c.Policy, err = r.next(); err != nil {
+		return err
+	}
+
+	args, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	if len(args)%2 != 0 {
+		return fmt.Errorf("Odd number of policy args: %q", args)
+	}
+
+	if len(args) > 0 {
+		c.PolicyArgs = make(map[string]string, len(args)/2)
+
+		for x := 0; x < len(args); x += 2 {
+			c.PolicyArgs[args[x]] = args[x+1]
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected cache parameters %q", target.Params)
+	}
 
-	// Remainder of table data needs to be handled token by token, e.g.:
-	// tokens := strings.Fields(params)[11:]
+	c.Start, c.Length = target.Start, target.Length
+	*t = c
 
-	return s
+	return nil
 }
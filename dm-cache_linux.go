@@ -0,0 +1,171 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-cache Messages, Policy Switching and Detach.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CacheSetMigrationThreshold sets the maximum number of sectors which a cache target may migrate
+// between the cache and origin devices at any one time.
+func CacheSetMigrationThreshold(name string, sectors uint64) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("migration_threshold %d", sectors))
+	return err
+}
+
+// CacheInvalidateCblocks removes the specified cache blocks from a cache target. The cache must
+// be in passthrough mode, and the invalidated blocks must not be dirty.
+func CacheInvalidateCblocks(name string, cblocks ...CblockRange) error {
+	msg, err := invalidateCblocksMessage(cblocks)
+	if err != nil {
+		return err
+	}
+
+	_, err = SendMessage(name, 0, msg)
+	return err
+}
+
+// getCacheTable returns the live table of a device, which must consist of a single cache target.
+func getCacheTable(name string) (*CacheTarget, error) {
+	table, err := GetDeviceTableWithKeys(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(table) != 1 {
+		return nil, fmt.Errorf("Device %s has %d targets, expected a single cache target", name, len(table))
+	}
+
+	var c CacheTarget
+	if err := c.Unmarshal(table[0]); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// CacheSetPolicy changes the replacement policy of a cache device, by reloading its table with the
+// new policy and policy args, and resuming it. Cache contents are preserved.
+func CacheSetPolicy(name, policy string, args map[string]string) error {
+	c, err := getCacheTable(name)
+	if err != nil {
+		return err
+	}
+
+	c.Policy, c.PolicyArgs = policy, args
+
+	target, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return ReplaceTable(name, []dmTarget{target})
+}
+
+// getCacheStatus returns the parsed status of a device consisting of a single cache target.
+func getCacheStatus(name string) (*CacheStatus, error) {
+	status, err := GetDeviceStatus(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(status) != 1 || status[0].Type != "cache" {
+		return nil, fmt.Errorf("Device %s is not a cache device", name)
+	}
+
+	s, err := unmarshallParams(status[0].Params)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Failed || s.Error {
+		return nil, fmt.Errorf("Cache device %s has failed", name)
+	}
+
+	return &s, nil
+}
+
+// CacheFlushAndDetach writes back all dirty blocks of a cache device, and replaces its table with
+// a linear mapping of the origin device, so that the cache and metadata devices can be removed.
+// The cache is switched to the cleaner policy, and polled at the specified interval until no
+// dirty blocks remain. The device is then suspended, and only if it is still clean is the linear
+// table swapped in; otherwise the device is resumed and polling continues.
+//
+// If ctx is done before the cache is clean, the device is left running with the cleaner policy,
+// and ctx.Err() is returned.
+func CacheFlushAndDetach(ctx context.Context, name string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid poll interval %v", interval)
+	}
+
+	info, err := GetDeviceInfo(name)
+	if err != nil {
+		return err
+	}
+
+	c, err := getCacheTable(name)
+	if err != nil {
+		return err
+	}
+
+	if c.IOMode == "passthrough" {
+		return fmt.Errorf("Cache device %s is in passthrough mode", name)
+	}
+
+	if c.Policy != "cleaner" {
+		if err := CacheSetPolicy(name, "cleaner", nil); err != nil {
+			return err
+		}
+	}
+
+	linear, err := LinearTarget{c.Start, c.Length, c.OriginDev, 0}.Marshal()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s, err := getCacheStatus(name)
+		if err != nil {
+			return err
+		}
+
+		if s.Dirty == 0 {
+			// Writes may have dirtied blocks since the status was read, so check again once
+			// the device is suspended and quiescent.
+			if err := SuspendDevice(name, false); err != nil {
+				return err
+			}
+
+			if s, err = getCacheStatus(name); err == nil && s.Dirty == 0 {
+				if err = LoadTable(name, []dmTarget{linear}, info.ReadOnly); err == nil {
+					return ResumeDevice(name)
+				}
+			}
+
+			// Resume with the cache table still live
+			if rerr := ResumeDevice(name); rerr != nil {
+				return rerr
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-cache policy switching and detach.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacheFlushAndDetach(t *testing.T) {
+	if err := CacheFlushAndDetach(context.Background(), "nonexistent", 0); err == nil {
+		t.Error("Expected error for zero interval")
+	}
+
+	requireDM(t)
+
+	if _, err := GetTargetVersion("cache"); err != nil {
+		t.Skip("Cache target not available:", err)
+	}
+
+	meta := newTestLoopDev(t, 8*(1<<20))
+	defer meta.Close()
+
+	fast := newTestLoopDev(t, 16*(1<<20))
+	defer fast.Close()
+
+	origin := newTestLoopDev(t, 64*(1<<20))
+	defer origin.Close()
+
+	name := testDeviceName()
+
+	target, err := CacheTarget{0, 131072, meta.path, fast.path, origin.path, 64, "writeback", false, false, "smq", nil}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateDevice(name, "", []dmTarget{target}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	f, err := os.OpenFile("/dev/mapper/"+name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(bytes.Repeat([]byte{0xa5}, 1<<20))
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := CacheFlushAndDetach(ctx, name, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := GetDeviceTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := dmTarget{0, 131072, "linear", origin.devNo + " 0"}
+	if len(table) != 1 || table[0] != expected {
+		t.Errorf("Got table %+v, expected %+v", table, expected)
+	}
+}
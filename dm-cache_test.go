@@ -5,30 +5,264 @@
 
 package devmapper
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestUnmarshallParams(t *testing.T) {
 	params := `8 13/5120 512 322/3212 193 63 423 0 0 322 0 1 writeback 2 migration_threshold 2048 smq 0 rw -`
 
-	d1 := dmCacheStatus{
-		mdataBlockSize:   8,
-		mdataUsedBlocks:  13,
-		mdataTotalBlocks: 5120,
-		cacheBlockSize:   512,
-		cacheUsedBlocks:  322,
-		cacheTotalBlocks: 3212,
-		readHits:         193,
-		readMisses:       63,
-		writeHits:        423,
-		writeMisses:      0,
-		demotions:        0,
-		promotions:       322,
-		dirty:            0,
-	}
-
-	d2 := unmarshallParams(params)
-
-	if d1 != d2 {
-		t.Fail()
+	d1 := CacheStatus{
+		MdataBlockSize:     8,
+		MdataUsedBlocks:    13,
+		MdataTotalBlocks:   5120,
+		CacheBlockSize:     512,
+		CacheUsedBlocks:    322,
+		CacheTotalBlocks:   3212,
+		ReadHits:           193,
+		ReadMisses:         63,
+		WriteHits:          423,
+		WriteMisses:        0,
+		Demotions:          0,
+		Promotions:         322,
+		Dirty:              0,
+		Features:           []string{"writeback"},
+		IOMode:             "writeback",
+		MigrationThreshold: 2048,
+		Policy:             "smq",
+		PolicyArgs:         map[string]string{},
+		MetadataMode:       "rw",
+	}
+
+	d2, err := unmarshallParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(d1, d2) {
+		t.Errorf("Got %+v, expected %+v", d2, d1)
+	}
+}
+
+func TestUnmarshallParamsFeatures(t *testing.T) {
+	params := `8 1024/8192 128 98304/98304 4029 1742 2096 811 1502 1503 42 3 passthrough metadata2 ` +
+		`no_discard_passdown 2 migration_threshold 4096 mq 4 sequential_threshold 512 random_threshold 4 ` +
+		`ro needs_check`
+
+	d1 := CacheStatus{
+		MdataBlockSize:     8,
+		MdataUsedBlocks:    1024,
+		MdataTotalBlocks:   8192,
+		CacheBlockSize:     128,
+		CacheUsedBlocks:    98304,
+		CacheTotalBlocks:   98304,
+		ReadHits:           4029,
+		ReadMisses:         1742,
+		WriteHits:          2096,
+		WriteMisses:        811,
+		Demotions:          1502,
+		Promotions:         1503,
+		Dirty:              42,
+		Features:           []string{"passthrough", "metadata2", "no_discard_passdown"},
+		IOMode:             "passthrough",
+		Metadata2:          true,
+		NoDiscardPassdown:  true,
+		MigrationThreshold: 4096,
+		Policy:             "mq",
+		PolicyArgs:         map[string]string{"sequential_threshold": "512", "random_threshold": "4"},
+		MetadataMode:       "ro",
+		NeedsCheck:         true,
+	}
+
+	d2, err := unmarshallParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(d1, d2) {
+		t.Errorf("Got %+v, expected %+v", d2, d1)
+	}
+}
+
+func TestUnmarshallParamsFailed(t *testing.T) {
+	if d, err := unmarshallParams("Fail"); err != nil || !d.Failed {
+		t.Errorf("Got %+v, %v", d, err)
+	}
+
+	if d, err := unmarshallParams("Error"); err != nil || !d.Error {
+		t.Errorf("Got %+v, %v", d, err)
+	}
+}
+
+func TestUnmarshallParamsErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`8 13/5120 512 322`,
+		`8 13/5120 512 322/3212 193 63 x 0 0 322 0 1 writeback 2 migration_threshold 2048 smq 0 rw -`,
+		`8 13/5120 512 322/3212 193 63 423 0 0 322 0 3 writeback 2`,
+		`8 13/5120 512 322/3212 193 63 423 0 0 322 0 1 writeback 1 migration_threshold smq 0 rw -`,
+		`8 13/5120 512 322/3212 193 63 423 0 0 322 0 1 writeback 2 migration_threshold x smq 0 rw -`,
+		`8 13/5120 512 322/3212 193 63 423 0 0 322 0 1 writeback 2 migration_threshold 2048 smq 1 a rw -`,
+		`8 13/5120 512 322/3212 193 63 423 0 0 322 0 1 writeback 2 migration_threshold 2048 smq 0 rw - extra`,
+	}
+
+	for _, params := range invalid {
+		if _, err := unmarshallParams(params); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
+
+func TestCacheRatesBetween(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	prev := CacheSample{t0, &CacheStatus{
+		CacheBlockSize: 512, CacheTotalBlocks: 3212,
+		ReadHits: 1000, ReadMisses: 200, WriteHits: 500, WriteMisses: 50,
+		Promotions: 20, Demotions: 10, Dirty: 100,
+	}}
+
+	cur := CacheSample{t0.Add(10 * time.Second), &CacheStatus{
+		CacheBlockSize: 512, CacheTotalBlocks: 3212,
+		ReadHits: 1500, ReadMisses: 220, WriteHits: 600, WriteMisses: 50,
+		Promotions: 40, Demotions: 15, Dirty: 60,
+	}}
+
+	rates, err := CacheRatesBetween(prev, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CacheRates{
+		Interval:    10 * time.Second,
+		ReadHits:    50,
+		ReadMisses:  2,
+		WriteHits:   10,
+		WriteMisses: 0,
+		Promotions:  2,
+		Demotions:   0.5,
+		DirtyDelta:  -40,
+		DirtyRate:   -4,
+	}
+
+	if *rates != expected {
+		t.Errorf("Got %+v, expected %+v", *rates, expected)
+	}
+
+	// Counters reset by a reload
+	reset := CacheSample{t0.Add(20 * time.Second), &CacheStatus{
+		CacheBlockSize: 512, CacheTotalBlocks: 3212, ReadHits: 10, ReadMisses: 230,
+		WriteHits: 600, WriteMisses: 50, Promotions: 40, Demotions: 15,
+	}}
+
+	if _, err := CacheRatesBetween(cur, reset); err != ErrCounterReset {
+		t.Errorf("Got %v, expected ErrCounterReset", err)
+	}
+
+	// Cache device resized
+	resized := CacheSample{t0.Add(20 * time.Second), &CacheStatus{}}
+	*resized.Status = *cur.Status
+	resized.Status.CacheTotalBlocks = 6424
+
+	if _, err := CacheRatesBetween(cur, resized); err != ErrCounterReset {
+		t.Errorf("Got %v, expected ErrCounterReset", err)
+	}
+
+	if _, err := CacheRatesBetween(cur, prev); err == nil {
+		t.Error("Expected error for samples in reverse order")
+	}
+
+	if _, err := CacheRatesBetween(prev, CacheSample{cur.Time, &CacheStatus{Failed: true}}); err == nil {
+		t.Error("Expected error for failed cache")
+	}
+}
+
+func TestCacheTarget(t *testing.T) {
+	cache := CacheTarget{
+		Start:       0,
+		Length:      41943040,
+		MetadataDev: "253:1",
+		CacheDev:    "253:2",
+		OriginDev:   "/dev/sdb",
+		BlockSize:   512,
+		IOMode:      "writeback",
+		Metadata2:   true,
+		Policy:      "smq",
+		PolicyArgs:  map[string]string{"migration_threshold": "2048"},
+	}
+
+	target, err := cache.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := dmTarget{0, 41943040, "cache",
+		"253:1 253:2 /dev/sdb 512 2 metadata2 writeback smq 2 migration_threshold 2048"}
+
+	if target != expected {
+		t.Errorf("Got %+v, expected %+v", target, expected)
+	}
+
+	var parsed CacheTarget
+	if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parsed, cache) {
+		t.Errorf("Got %+v, expected %+v", parsed, cache)
+	}
+
+	// Kernel defaults
+	target, err = CacheTarget{0, 8, "253:1", "253:2", "253:3", 64, "", false, false, "", nil}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	} else if target.Params != "253:1 253:2 253:3 64 0 default 0" {
+		t.Errorf("Got params %q", target.Params)
+	}
+
+	invalid := []CacheTarget{
+		{MetadataDev: "253:1", CacheDev: "253:2", OriginDev: "253:3", BlockSize: 32},
+		{MetadataDev: "253:1", CacheDev: "253:2", OriginDev: "253:3", BlockSize: 96},
+		{MetadataDev: "253:1", CacheDev: "253:2", OriginDev: "253:3", BlockSize: 64, IOMode: "writearound"},
+		{MetadataDev: "253:1", CacheDev: "", OriginDev: "253:3", BlockSize: 64},
+	}
+
+	for _, c := range invalid {
+		if _, err := c.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", c)
+		}
+	}
+
+	for _, params := range []string{
+		"253:1 253:2 253:3 64 1 writearound default 0",
+		"253:1 253:2 253:3 64 0 default 1 migration_threshold",
+		"253:1 253:2 253:3 64 0 default 0 extra",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "cache", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
+
+func TestInvalidateCblocksMessage(t *testing.T) {
+	msg, err := invalidateCblocksMessage([]CblockRange{{5, 6}, {10, 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "invalidate_cblocks 5 10-20"; msg != expected {
+		t.Errorf("Got %q, expected %q", msg, expected)
+	}
+
+	for _, cblocks := range [][]CblockRange{
+		nil,
+		{{5, 5}},
+		{{1, 2}, {20, 10}},
+	} {
+		if _, err := invalidateCblocksMessage(cblocks); err == nil {
+			t.Errorf("Expected error for %v", cblocks)
+		}
 	}
 }
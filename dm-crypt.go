@@ -0,0 +1,241 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-crypt Table Builder and Key Management.
+// See dm-crypt documentation at: https://www.kernel.org/doc/Documentation/device-mapper/dm-crypt.txt
+
+package devmapper
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CryptTarget is a crypt target, which transparently encrypts a device.
+type CryptTarget struct {
+	Start    uint64 // Start sector of target
+	Length   uint64 // Length of target in sectors
+	Cipher   string // Cipher specification, e.g. "aes-xts-plain64", or "capi:" kernel crypto API format
+	Key      string // Hex-encoded key, keyring reference (see CryptKeyringKey), or "-" for an empty key
+	IVOffset uint64 // Constant added to the sector number to form the IV
+	Device   string // Underlying device path, or major:minor
+	Offset   uint64 // Start sector of encrypted data on underlying device
+
+	AllowDiscards       bool   // Pass discards down to the underlying device
+	SameCPUCrypt        bool   // Encrypt on the CPU which submitted the I/O
+	SubmitFromCryptCPUs bool   // Submit writes from the encryption threads, rather than a single thread
+	NoReadWorkqueue     bool   // Decrypt reads synchronously, bypassing the workqueue
+	NoWriteWorkqueue    bool   // Encrypt writes synchronously, bypassing the workqueue
+	Integrity           string // Integrity tag size and type, "<bytes>:<type>", e.g. "28:aead"
+	SectorSize          uint32 // Encryption sector size in bytes; 512 (the default) if zero
+	IVLargeSectors      bool   // Generate IVs from SectorSize units, rather than 512-byte sectors
+}
+
+// CryptKeyringKey returns a reference to a key in the kernel keyring, for use as a CryptTarget
+// key. keyType is "logon", "user" or "encrypted", and size is the key size in bytes.
+func CryptKeyringKey(size int, keyType, description string) string {
+	return fmt.Sprintf(":%d:%s:%s", size, keyType, description)
+}
+
+// checkCryptKey returns an error if key is not a valid crypt target key.
+func checkCryptKey(key string) error {
+	switch {
+	case key == "-":
+		return nil
+
+	case strings.HasPrefix(key, ":"):
+		parts := strings.SplitN(key[1:], ":", 3)
+		if len(parts) != 3 || parts[2] == "" {
+			return fmt.Errorf("Invalid keyring key reference %q", key)
+		}
+
+		if _, err := strconv.ParseUint(parts[0], 10, 32); err != nil {
+			return fmt.Errorf("Invalid keyring key size %q", parts[0])
+		}
+
+		switch parts[1] {
+		case "logon", "user", "encrypted":
+		default:
+			return fmt.Errorf("Invalid keyring key type %q", parts[1])
+		}
+
+		if strings.IndexFunc(parts[2], func(r rune) bool { return r <= ' ' }) >= 0 {
+			return fmt.Errorf("Invalid keyring key description %q", parts[2])
+		}
+
+		return nil
+	}
+
+	if _, err := hex.DecodeString(key); err != nil || key == "" {
+		// Don't include the key in the error
+		return fmt.Errorf("Invalid hex key")
+	}
+
+	return nil
+}
+
+// Marshal returns the table target for an encrypted mapping.
+func (t CryptTarget) Marshal() (dmTarget, error) {
+	if t.Cipher == "" || strings.IndexFunc(t.Cipher, func(r rune) bool { return r <= ' ' }) >= 0 {
+		return dmTarget{}, fmt.Errorf("Invalid cipher %q", t.Cipher)
+	}
+
+	if err := checkCryptKey(t.Key); err != nil {
+		return dmTarget{}, err
+	}
+
+	if err := checkDevice(t.Device); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.SectorSize != 0 && (t.SectorSize < 512 || t.SectorSize > 4096 || t.SectorSize&(t.SectorSize-1) != 0) {
+		return dmTarget{}, fmt.Errorf("Invalid crypt sector size %d", t.SectorSize)
+	}
+
+	// Optional args are emitted in the same order as the kernel reports them
+	var args []string
+
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{t.AllowDiscards, "allow_discards"},
+		{t.SameCPUCrypt, "same_cpu_crypt"},
+		{t.SubmitFromCryptCPUs, "submit_from_crypt_cpus"},
+		{t.NoReadWorkqueue, "no_read_workqueue"},
+		{t.NoWriteWorkqueue, "no_write_workqueue"},
+	} {
+		if f.set {
+			args = append(args, f.name)
+		}
+	}
+
+	if t.Integrity != "" {
+		args = append(args, "integrity:"+t.Integrity)
+	}
+
+	if t.SectorSize != 0 && t.SectorSize != 512 {
+		args = append(args, fmt.Sprintf("sector_size:%d", t.SectorSize))
+	}
+
+	if t.IVLargeSectors {
+		args = append(args, "iv_large_sectors")
+	}
+
+	params := fmt.Sprintf("%s %s %d %s %d", t.Cipher, t.Key, t.IVOffset, t.Device, t.Offset)
+	if len(args) > 0 {
+		params += fmt.Sprintf(" %d %s", len(args), strings.Join(args, " "))
+	}
+
+	return dmTarget{t.Start, t.Length, "crypt", params}, nil
+}
+
+// Unmarshal parses a crypt table target, as returned by GetDeviceTableWithKeys. Tables returned by
+// GetDeviceTable can also be parsed, but hex keys will have been redacted.
+func (t *CryptTarget) Unmarshal(target dmTarget) error {
+	var (
+		c   CryptTarget
+		err error
+	)
+
+	if err := checkTargetType(target, "crypt"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if c.Cipher, err = r.next(); err != nil {
+		return err
+	}
+
+	if c.Key, err = r.next(); err != nil {
+		return err
+	}
+
+	if c.IVOffset, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if c.Device, err = r.next(); err != nil {
+		return err
+	}
+
+	if c.Offset, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if r.more() {
+		args, err := r.counted()
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range args {
+			name, value := arg, ""
+			if x := strings.IndexByte(arg, ':'); x >= 0 {
+				name, value = arg[:x], arg[x+1:]
+			}
+
+			switch name {
+			case "allow_discards":
+				c.AllowDiscards = true
+			case "same_cpu_crypt":
+				c.SameCPUCrypt = true
+			case "submit_from_crypt_cpus":
+				c.SubmitFromCryptCPUs = true
+			case "no_read_workqueue":
+				c.NoReadWorkqueue = true
+			case "no_write_workqueue":
+				c.NoWriteWorkqueue = true
+			case "integrity":
+				c.Integrity = value
+			case "sector_size":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid crypt sector size %q", value)
+				}
+
+				c.SectorSize = uint32(n)
+			case "iv_large_sectors":
+				c.IVLargeSectors = true
+			default:
+				return fmt.Errorf("Unknown crypt option %q", arg)
+			}
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected crypt parameters")
+	}
+
+	c.Start, c.Length = target.Start, target.Length
+	*t = c
+
+	return nil
+}
+
+// redactCryptKeys returns a copy of table, in which the hex keys of any crypt targets are replaced
+// by zeros, in the same manner as dmsetup. Keyring key references are not secret, and are left
+// intact.
+func redactCryptKeys(table []dmTarget) []dmTarget {
+	redacted := make([]dmTarget, len(table))
+	copy(redacted, table)
+
+	for x, t := range redacted {
+		if t.Type != "crypt" {
+			continue
+		}
+
+		fields := strings.Fields(t.Params)
+		if len(fields) < 2 || fields[1] == "-" || strings.HasPrefix(fields[1], ":") {
+			continue
+		}
+
+		fields[1] = strings.Repeat("0", len(fields[1]))
+		redacted[x].Params = strings.Join(fields, " ")
+	}
+
+	return redacted
+}
@@ -0,0 +1,39 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-crypt Kernel Keyring Helper.
+
+package devmapper
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddCryptLogonKey adds a key to the specified kernel keyring (e.g. unix.KEY_SPEC_USER_KEYRING)
+// as a "logon" key, which the kernel can use but userspace cannot read back. It returns a key
+// reference for use as a CryptTarget key, so that the key itself never appears in a table, and
+// the key's serial number, which can be used to revoke it with unix.KeyctlInt.
+//
+// Logon key descriptions must have a "<prefix>:" service prefix, e.g. "cryptsetup:vg0-data".
+// The key must be visible to the process which loads the table.
+func AddCryptLogonKey(description string, key []byte, keyring int) (string, int, error) {
+	if x := strings.IndexByte(description, ':'); x < 1 {
+		return "", 0, fmt.Errorf("Logon key description %q lacks a service prefix", description)
+	}
+
+	if strings.IndexFunc(description, func(r rune) bool { return r <= ' ' }) >= 0 {
+		return "", 0, fmt.Errorf("Invalid logon key description %q", description)
+	}
+
+	id, err := unix.AddKey("logon", description, key, keyring)
+	if err != nil {
+		return "", 0, fmt.Errorf("Cannot add logon key %q - %s", description, err)
+	}
+
+	return CryptKeyringKey(len(key), "logon", description), id, nil
+}
@@ -0,0 +1,18 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-crypt kernel keyring helper.
+
+package devmapper
+
+import "testing"
+
+func TestAddCryptLogonKeyInvalid(t *testing.T) {
+	for _, desc := range []string{"", "nocolon", ":noprefix", "cryptsetup:with space"} {
+		if _, _, err := AddCryptLogonKey(desc, make([]byte, 32), 0); err == nil {
+			t.Errorf("Expected error for description %q", desc)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-crypt table builder and key redaction.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCryptTargetMarshal(t *testing.T) {
+	tests := []struct {
+		target CryptTarget
+		params string
+	}{
+		{
+			CryptTarget{Length: 2048, Cipher: "aes-xts-plain64", Key: "00112233445566778899aabbccddeeff", Device: "7:0"},
+			"aes-xts-plain64 00112233445566778899aabbccddeeff 0 7:0 0",
+		},
+		{
+			CryptTarget{
+				Length:              2048,
+				Cipher:              "capi:authenc(hmac(sha256),xts(aes))-random",
+				Key:                 CryptKeyringKey(96, "logon", "cryptsetup:test"),
+				IVOffset:            8,
+				Device:              "/dev/loop0",
+				Offset:              4096,
+				AllowDiscards:       true,
+				SameCPUCrypt:        true,
+				SubmitFromCryptCPUs: true,
+				NoReadWorkqueue:     true,
+				NoWriteWorkqueue:    true,
+				Integrity:           "28:aead",
+				SectorSize:          4096,
+				IVLargeSectors:      true,
+			},
+			"capi:authenc(hmac(sha256),xts(aes))-random :96:logon:cryptsetup:test 8 /dev/loop0 4096 " +
+				"8 allow_discards same_cpu_crypt submit_from_crypt_cpus no_read_workqueue no_write_workqueue " +
+				"integrity:28:aead sector_size:4096 iv_large_sectors",
+		},
+		{
+			CryptTarget{Length: 8, Cipher: "cipher_null-ecb", Key: "-", Device: "7:0", SectorSize: 512},
+			"cipher_null-ecb - 0 7:0 0",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed CryptTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		// A 512-byte sector size is the default, and is not emitted
+		if test.target.SectorSize == 512 {
+			test.target.SectorSize = 0
+		}
+
+		if !reflect.DeepEqual(parsed, test.target) {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+}
+
+func TestCryptTargetInvalid(t *testing.T) {
+	for _, ct := range []CryptTarget{
+		{Cipher: "", Key: "00", Device: "7:0"},
+		{Cipher: "aes xts", Key: "00", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: "", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: "0g", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: ":32:logon", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: ":x:logon:foo", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: ":32:trusted:foo", Device: "7:0"},
+		{Cipher: "aes-xts-plain64", Key: "00", Device: ""},
+		{Cipher: "aes-xts-plain64", Key: "00", Device: "7:0", SectorSize: 1024 + 512},
+		{Cipher: "aes-xts-plain64", Key: "00", Device: "7:0", SectorSize: 8192},
+	} {
+		if _, err := ct.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", ct)
+		}
+	}
+
+	var ct CryptTarget
+
+	for _, target := range []dmTarget{
+		{0, 8, "linear", "7:0 0"},
+		{0, 8, "crypt", "aes-xts-plain64 00 0 7:0"},
+		{0, 8, "crypt", "aes-xts-plain64 00 0 7:0 0 1 bogus"},
+		{0, 8, "crypt", "aes-xts-plain64 00 0 7:0 0 2 allow_discards"},
+	} {
+		if err := ct.Unmarshal(target); err == nil {
+			t.Errorf("Expected error for %q", target.Params)
+		}
+	}
+}
+
+func TestRedactCryptKeys(t *testing.T) {
+	table := []dmTarget{
+		{0, 2048, "linear", "7:0 0"},
+		{2048, 2048, "crypt", "aes-xts-plain64 00112233445566778899aabbccddeeff 0 7:0 0 1 allow_discards"},
+		{4096, 2048, "crypt", "aes-xts-plain64 :32:logon:cryptsetup:test 0 7:0 0"},
+		{6144, 2048, "crypt", "cipher_null-ecb - 0 7:0 0"},
+	}
+
+	expected := []dmTarget{
+		table[0],
+		{2048, 2048, "crypt", "aes-xts-plain64 00000000000000000000000000000000 0 7:0 0 1 allow_discards"},
+		table[2],
+		table[3],
+	}
+
+	orig := table[1]
+
+	if redacted := redactCryptKeys(table); !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("Got %v, expected %v", redacted, expected)
+	}
+
+	if table[1] != orig {
+		t.Error("Original table was modified")
+	}
+}
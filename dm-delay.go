@@ -0,0 +1,119 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-delay Table Builder and Parser.
+// See dm-delay documentation at: https://www.kernel.org/doc/Documentation/device-mapper/delay.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DelayPath is a device to which a delay target sends a class of I/O, and the delay applied.
+type DelayPath struct {
+	Device string // Device path, or major:minor
+	Offset uint64 // Start sector on device
+	Delay  uint32 // Delay in milliseconds
+}
+
+func (p DelayPath) String() string {
+	return fmt.Sprintf("%s %d %d", p.Device, p.Offset, p.Delay)
+}
+
+// DelayTarget is a delay target, which delays I/O to a device. Reads, writes and flushes can be
+// delayed by different amounts, and even sent to different devices.
+type DelayTarget struct {
+	Start  uint64     // Start sector of target
+	Length uint64     // Length of target in sectors
+	Read   DelayPath  // Path for reads, and for all I/O if Write is nil
+	Write  *DelayPath // Path for writes; optional
+	Flush  *DelayPath // Path for flushes; optional, and requires Write
+}
+
+// Marshal returns the table target for a delay mapping.
+func (t DelayTarget) Marshal() (dmTarget, error) {
+	paths := []DelayPath{t.Read}
+
+	if t.Write != nil {
+		paths = append(paths, *t.Write)
+	}
+
+	if t.Flush != nil {
+		if t.Write == nil {
+			return dmTarget{}, fmt.Errorf("Delay flush path requires a write path")
+		}
+
+		paths = append(paths, *t.Flush)
+	}
+
+	params := make([]string, len(paths))
+
+	for x, p := range paths {
+		if err := checkDevice(p.Device); err != nil {
+			return dmTarget{}, err
+		}
+
+		params[x] = p.String()
+	}
+
+	return dmTarget{t.Start, t.Length, "delay", strings.Join(params, " ")}, nil
+}
+
+// Unmarshal parses a delay table target, as returned by GetDeviceTable.
+func (t *DelayTarget) Unmarshal(target dmTarget) error {
+	var d DelayTarget
+
+	if err := checkTargetType(target, "delay"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	for x := 0; r.more(); x++ {
+		var (
+			p   DelayPath
+			n   uint64
+			err error
+		)
+
+		if x == 3 {
+			return fmt.Errorf("Unexpected delay parameters %q", target.Params)
+		}
+
+		if p.Device, err = r.next(); err != nil {
+			return err
+		}
+
+		if p.Offset, err = r.uint64(); err != nil {
+			return err
+		}
+
+		if n, err = r.uint64(); err != nil {
+			return err
+		}
+
+		p.Delay = uint32(n)
+
+		switch x {
+		case 0:
+			d.Read = p
+		case 1:
+			d.Write = &p
+		case 2:
+			d.Flush = &p
+		}
+	}
+
+	if d.Read.Device == "" {
+		return fmt.Errorf("Missing delay parameters")
+	}
+
+	d.Start, d.Length = target.Start, target.Length
+	*t = d
+
+	return nil
+}
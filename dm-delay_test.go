@@ -0,0 +1,70 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-delay table builder and parser.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDelayTarget(t *testing.T) {
+	tests := []struct {
+		target DelayTarget
+		params string
+	}{
+		{
+			DelayTarget{Length: 2048, Read: DelayPath{"7:0", 0, 500}},
+			"7:0 0 500",
+		},
+		{
+			DelayTarget{Length: 2048, Read: DelayPath{"7:0", 0, 0}, Write: &DelayPath{"7:0", 0, 400}},
+			"7:0 0 0 7:0 0 400",
+		},
+		{
+			DelayTarget{Length: 2048, Read: DelayPath{"7:0", 0, 0}, Write: &DelayPath{"7:1", 8, 0},
+				Flush: &DelayPath{"/dev/loop2", 16, 333}},
+			"7:0 0 0 7:1 8 0 /dev/loop2 16 333",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed DelayTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(parsed, test.target) {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+
+	for _, d := range []DelayTarget{
+		{Read: DelayPath{"", 0, 0}},
+		{Read: DelayPath{"7:0", 0, 0}, Flush: &DelayPath{"7:0", 0, 0}},
+	} {
+		if _, err := d.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", d)
+		}
+	}
+
+	var parsed DelayTarget
+
+	for _, params := range []string{"", "7:0 0", "7:0 0 0 7:0 0", "7:0 0 0 7:0 0 0 7:0 0 0 7:0 0 0"} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "delay", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
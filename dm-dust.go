@@ -0,0 +1,111 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-dust Table Builder and Status Parser.
+// See dm-dust documentation at: https://www.kernel.org/doc/Documentation/admin-guide/device-mapper/dm-dust.rst
+
+package devmapper
+
+import "fmt"
+
+// DustStatus represents the status of a dust target.
+type DustStatus struct {
+	Device  string // Underlying device, as major:minor
+	Enabled bool   // Reads of bad blocks fail, rather than bypassing the bad block list
+	Quiet   bool   // Bad block reads are not logged
+}
+
+func parseDustStatus(params string) (interface{}, error) {
+	var (
+		s   DustStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.Device, err = r.next(); err != nil {
+		return nil, err
+	}
+
+	mode, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "fail_read_on_bad_block":
+		s.Enabled = true
+	case "bypass":
+	default:
+		return nil, fmt.Errorf("Unknown dust mode %q", mode)
+	}
+
+	if r.more() {
+		verbosity, _ := r.next()
+		s.Quiet = verbosity == "quiet"
+	}
+
+	return &s, nil
+}
+
+// DustTarget is a dust target, which emulates a device with bad blocks. Reads of blocks in the
+// bad block list fail once the target is enabled with DustEnable, and writes to a bad block
+// remove it from the list, as on a real drive which remaps sectors.
+type DustTarget struct {
+	Start     uint64 // Start sector of target
+	Length    uint64 // Length of target in sectors
+	Device    string // Underlying device path, or major:minor
+	Offset    uint64 // Start sector on underlying device
+	BlockSize uint32 // Size in bytes of the blocks addressed by bad block messages
+}
+
+// Marshal returns the table target for a dust mapping.
+func (t DustTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.Device); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.BlockSize < 512 || t.BlockSize&(t.BlockSize-1) != 0 {
+		return dmTarget{}, fmt.Errorf("Invalid dust block size %d", t.BlockSize)
+	}
+
+	return dmTarget{t.Start, t.Length, "dust", fmt.Sprintf("%s %d %d", t.Device, t.Offset, t.BlockSize)}, nil
+}
+
+// Unmarshal parses a dust table target, as returned by GetDeviceTable.
+func (t *DustTarget) Unmarshal(target dmTarget) error {
+	var (
+		d   DustTarget
+		n   uint64
+		err error
+	)
+
+	if err := checkTargetType(target, "dust"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if d.Device, err = r.next(); err != nil {
+		return err
+	}
+
+	if d.Offset, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	d.BlockSize = uint32(n)
+
+	if r.more() {
+		return fmt.Errorf("Unexpected dust parameters %q", target.Params)
+	}
+
+	d.Start, d.Length = target.Start, target.Length
+	*t = d
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-dust Bad Block Messages.
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DustAddBadBlock adds a block to the bad block list of a dust target.
+func DustAddBadBlock(name string, block uint64) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("addbadblock %d", block))
+	return err
+}
+
+// DustRemoveBadBlock removes a block from the bad block list of a dust target.
+func DustRemoveBadBlock(name string, block uint64) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("removebadblock %d", block))
+	return err
+}
+
+// DustClearBadBlocks removes all blocks from the bad block list of a dust target.
+func DustClearBadBlocks(name string) error {
+	_, err := SendMessage(name, 0, "clearbadblocks")
+	return err
+}
+
+// DustEnable causes reads of blocks in the bad block list of a dust target to fail.
+func DustEnable(name string) error {
+	_, err := SendMessage(name, 0, "enable")
+	return err
+}
+
+// DustDisable causes a dust target to ignore its bad block list, and pass all I/O through.
+func DustDisable(name string) error {
+	_, err := SendMessage(name, 0, "disable")
+	return err
+}
+
+// DustCountBadBlocks returns the number of blocks in the bad block list of a dust target. This
+// requires kernel 5.9 or later; older kernels log the result rather than returning it.
+func DustCountBadBlocks(name string) (int, error) {
+	res, err := SendMessage(name, 0, "countbadblocks")
+	if err != nil {
+		return 0, err
+	}
+
+	// e.g. "countbadblocks: 3 badblock(s) found"
+	fields := strings.Fields(res)
+	if len(fields) < 2 || fields[0] != "countbadblocks:" {
+		return 0, fmt.Errorf("Unexpected countbadblocks response %q", res)
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected countbadblocks response %q", res)
+	}
+
+	return n, nil
+}
+
+// DustQueryBlock reports whether a block is in the bad block list of a dust target. As with
+// DustCountBadBlocks, this requires kernel 5.9 or later.
+func DustQueryBlock(name string, block uint64) (bool, error) {
+	res, err := SendMessage(name, 0, fmt.Sprintf("queryblock %d", block))
+	if err != nil {
+		return false, err
+	}
+
+	// e.g. "dust_query_block: block 60 found in badblocklist"
+	switch {
+	case strings.HasSuffix(res, " not found in badblocklist"):
+		return false, nil
+	case strings.HasSuffix(res, " found in badblocklist"):
+		return true, nil
+	}
+
+	return false, fmt.Errorf("Unexpected queryblock response %q", res)
+}
@@ -0,0 +1,66 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-dust table builder and status parser.
+
+package devmapper
+
+import "testing"
+
+func TestParseDustStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected DustStatus
+	}{
+		{"7:0 bypass verbose", DustStatus{Device: "7:0"}},
+		{"7:0 fail_read_on_bad_block quiet", DustStatus{Device: "7:0", Enabled: true, Quiet: true}},
+	}
+
+	for _, test := range tests {
+		s, err := ParseTargetStatus(dmTarget{0, 8, "dust", test.params})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if *s.(*DustStatus) != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.params, *s.(*DustStatus), test.expected)
+		}
+	}
+
+	if _, err := parseDustStatus("7:0 bogus verbose"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func TestDustTarget(t *testing.T) {
+	dt := DustTarget{0, 2048, "7:0", 8, 4096}
+
+	target, err := dt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (dmTarget{0, 2048, "dust", "7:0 8 4096"}); target != expected {
+		t.Errorf("Got %v, expected %v", target, expected)
+	}
+
+	var parsed DustTarget
+	if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	} else if parsed != dt {
+		t.Errorf("Got %+v, expected %+v", parsed, dt)
+	}
+
+	for _, dt := range []DustTarget{{Device: "7:0", BlockSize: 256}, {Device: "7:0", BlockSize: 1000}, {BlockSize: 512}} {
+		if _, err := dt.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", dt)
+		}
+	}
+
+	for _, params := range []string{"7:0 8", "7:0 8 512 extra"} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "dust", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-error and dm-zero Table Builders and Parsers.
+// See dm-zero documentation at: https://www.kernel.org/doc/Documentation/device-mapper/zero.txt
+
+package devmapper
+
+import "fmt"
+
+// ErrorTarget fails all I/O to a range of sectors.
+type ErrorTarget struct {
+	Start  uint64 // Start sector of target
+	Length uint64 // Length of target in sectors
+}
+
+// Marshal returns the table target for an error mapping.
+func (t ErrorTarget) Marshal() (dmTarget, error) {
+	return dmTarget{t.Start, t.Length, "error", ""}, nil
+}
+
+// Unmarshal parses an error table target, as returned by GetDeviceTable.
+func (t *ErrorTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "error"); err != nil {
+		return err
+	}
+
+	if target.Params != "" {
+		return fmt.Errorf("Unexpected error parameters %q", target.Params)
+	}
+
+	*t = ErrorTarget{target.Start, target.Length}
+
+	return nil
+}
+
+// ZeroTarget returns zeros for all reads from a range of sectors, and discards all writes.
+type ZeroTarget struct {
+	Start  uint64 // Start sector of target
+	Length uint64 // Length of target in sectors
+}
+
+// Marshal returns the table target for a zero mapping.
+func (t ZeroTarget) Marshal() (dmTarget, error) {
+	return dmTarget{t.Start, t.Length, "zero", ""}, nil
+}
+
+// Unmarshal parses a zero table target, as returned by GetDeviceTable.
+func (t *ZeroTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "zero"); err != nil {
+		return err
+	}
+
+	if target.Params != "" {
+		return fmt.Errorf("Unexpected zero parameters %q", target.Params)
+	}
+
+	*t = ZeroTarget{target.Start, target.Length}
+
+	return nil
+}
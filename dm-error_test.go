@@ -0,0 +1,43 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-error and dm-zero table builders and parsers.
+
+package devmapper
+
+import "testing"
+
+func TestErrorZeroTargets(t *testing.T) {
+	table, err := Table(ErrorTarget{0, 2048}, ZeroTarget{2048, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dmTarget{{0, 2048, "error", ""}, {2048, 1024, "zero", ""}}
+	if table[0] != expected[0] || table[1] != expected[1] {
+		t.Errorf("Got %v, expected %v", table, expected)
+	}
+
+	var (
+		et ErrorTarget
+		zt ZeroTarget
+	)
+
+	if err := et.Unmarshal(table[0]); err != nil || et != (ErrorTarget{0, 2048}) {
+		t.Errorf("Got %+v (%v)", et, err)
+	}
+
+	if err := zt.Unmarshal(table[1]); err != nil || zt != (ZeroTarget{2048, 1024}) {
+		t.Errorf("Got %+v (%v)", zt, err)
+	}
+
+	if err := et.Unmarshal(table[1]); err == nil {
+		t.Error("Expected error for zero target")
+	}
+
+	if err := zt.Unmarshal(dmTarget{0, 8, "zero", "foo"}); err == nil {
+		t.Error("Expected error for zero parameters")
+	}
+}
@@ -0,0 +1,188 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-flakey Table Builder and Parser.
+// See dm-flakey documentation at: https://www.kernel.org/doc/Documentation/device-mapper/dm-flakey.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FlakeyCorruption specifies the corruption of a single byte of each matching bio while a flakey
+// target is down.
+type FlakeyCorruption struct {
+	Byte      uint32 // Offset of the byte to corrupt within each bio, starting from 1
+	Direction byte   // 'r' to corrupt reads, or 'w' to corrupt writes
+	Value     byte   // Value with which to overwrite the byte
+	Flags     uint32 // Only bios with all of these bi_opf flags set are corrupted
+}
+
+// FlakeyTarget is a flakey target, which behaves like a linear target, except that it is
+// periodically unreliable. The target is up, i.e. reliable, for UpInterval seconds, then down for
+// DownInterval seconds, and so on. While down, all I/O fails unless one of the optional write
+// behaviours or a corruption is specified.
+type FlakeyTarget struct {
+	Start        uint64 // Start sector of target
+	Length       uint64 // Length of target in sectors
+	Device       string // Underlying device path, or major:minor
+	Offset       uint64 // Start sector on underlying device
+	UpInterval   uint32 // Number of seconds for which the device is reliable
+	DownInterval uint32 // Number of seconds for which the device is unreliable
+
+	DropWrites     bool              // While down, silently discard writes, and pass reads through
+	ErrorWrites    bool              // While down, fail writes, and pass reads through
+	ErrorReads     bool              // While down, fail reads (kernel 6.5 or later)
+	CorruptBioByte *FlakeyCorruption // While down, corrupt a byte of matching bios
+}
+
+// Marshal returns the table target for a flakey mapping.
+func (t FlakeyTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.Device); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.DropWrites && t.ErrorWrites {
+		return dmTarget{}, fmt.Errorf("Flakey drop_writes and error_writes are mutually exclusive")
+	}
+
+	// Features are emitted in the same order as the kernel reports them
+	var features []string
+
+	if t.DropWrites {
+		features = append(features, "drop_writes")
+	}
+
+	if t.ErrorWrites {
+		features = append(features, "error_writes")
+	}
+
+	if t.ErrorReads {
+		features = append(features, "error_reads")
+	}
+
+	if c := t.CorruptBioByte; c != nil {
+		if c.Byte == 0 {
+			return dmTarget{}, fmt.Errorf("Flakey corrupt_bio_byte offset must be at least 1")
+		}
+
+		if c.Direction != 'r' && c.Direction != 'w' {
+			return dmTarget{}, fmt.Errorf("Invalid flakey corrupt_bio_byte direction %q", c.Direction)
+		}
+
+		features = append(features, "corrupt_bio_byte", strconv.FormatUint(uint64(c.Byte), 10),
+			string(c.Direction), strconv.Itoa(int(c.Value)), strconv.FormatUint(uint64(c.Flags), 10))
+	}
+
+	params := fmt.Sprintf("%s %d %d %d", t.Device, t.Offset, t.UpInterval, t.DownInterval)
+	if len(features) > 0 {
+		params += fmt.Sprintf(" %d %s", len(features), strings.Join(features, " "))
+	}
+
+	return dmTarget{t.Start, t.Length, "flakey", params}, nil
+}
+
+// Unmarshal parses a flakey table target, as returned by GetDeviceTable.
+func (t *FlakeyTarget) Unmarshal(target dmTarget) error {
+	var (
+		f   FlakeyTarget
+		n   uint64
+		err error
+	)
+
+	if err := checkTargetType(target, "flakey"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if f.Device, err = r.next(); err != nil {
+		return err
+	}
+
+	if f.Offset, err = r.uint64(); err != nil {
+		return err
+	}
+
+	for _, p := range []*uint32{&f.UpInterval, &f.DownInterval} {
+		if n, err = r.uint64(); err != nil {
+			return err
+		}
+
+		*p = uint32(n)
+	}
+
+	if r.more() {
+		features, err := r.counted()
+		if err != nil {
+			return err
+		}
+
+		for x := 0; x < len(features); x++ {
+			switch features[x] {
+			case "drop_writes":
+				f.DropWrites = true
+			case "error_writes":
+				f.ErrorWrites = true
+			case "error_reads":
+				f.ErrorReads = true
+			case "corrupt_bio_byte":
+				if x+4 >= len(features) {
+					return fmt.Errorf("Missing flakey corrupt_bio_byte parameters")
+				}
+
+				c, err := parseFlakeyCorruption(features[x+1 : x+5])
+				if err != nil {
+					return err
+				}
+
+				f.CorruptBioByte = c
+				x += 4
+			default:
+				return fmt.Errorf("Unknown flakey feature %q", features[x])
+			}
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected flakey parameters %q", target.Params)
+	}
+
+	f.Start, f.Length = target.Start, target.Length
+	*t = f
+
+	return nil
+}
+
+// parseFlakeyCorruption parses the four parameters of a corrupt_bio_byte feature.
+func parseFlakeyCorruption(args []string) (*FlakeyCorruption, error) {
+	var c FlakeyCorruption
+
+	offset, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flakey corrupt_bio_byte offset %q", args[0])
+	}
+
+	if args[1] != "r" && args[1] != "w" {
+		return nil, fmt.Errorf("Invalid flakey corrupt_bio_byte direction %q", args[1])
+	}
+
+	value, err := strconv.ParseUint(args[2], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flakey corrupt_bio_byte value %q", args[2])
+	}
+
+	flags, err := strconv.ParseUint(args[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flakey corrupt_bio_byte flags %q", args[3])
+	}
+
+	c.Byte, c.Direction, c.Value, c.Flags = uint32(offset), args[1][0], byte(value), uint32(flags)
+
+	return &c, nil
+}
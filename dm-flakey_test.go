@@ -0,0 +1,78 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-flakey table builder and parser.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlakeyTarget(t *testing.T) {
+	tests := []struct {
+		target FlakeyTarget
+		params string
+	}{
+		{
+			FlakeyTarget{Length: 2048, Device: "7:0", UpInterval: 5, DownInterval: 1},
+			"7:0 0 5 1",
+		},
+		{
+			FlakeyTarget{Length: 2048, Device: "/dev/loop0", Offset: 8, UpInterval: 0, DownInterval: 60, DropWrites: true},
+			"/dev/loop0 8 0 60 1 drop_writes",
+		},
+		{
+			FlakeyTarget{Length: 2048, Device: "7:0", UpInterval: 1, DownInterval: 1, ErrorWrites: true, ErrorReads: true,
+				CorruptBioByte: &FlakeyCorruption{Byte: 32, Direction: 'r', Value: 1, Flags: 0}},
+			"7:0 0 1 1 7 error_writes error_reads corrupt_bio_byte 32 r 1 0",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed FlakeyTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(parsed, test.target) {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+
+	for _, f := range []FlakeyTarget{
+		{Device: ""},
+		{Device: "7:0", DropWrites: true, ErrorWrites: true},
+		{Device: "7:0", CorruptBioByte: &FlakeyCorruption{Byte: 0, Direction: 'r'}},
+		{Device: "7:0", CorruptBioByte: &FlakeyCorruption{Byte: 1, Direction: 'x'}},
+	} {
+		if _, err := f.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", f)
+		}
+	}
+
+	var parsed FlakeyTarget
+
+	for _, params := range []string{
+		"7:0 0 5",
+		"7:0 0 5 1 1 bogus",
+		"7:0 0 5 1 4 corrupt_bio_byte 32 r 1",
+		"7:0 0 5 1 5 corrupt_bio_byte 32 x 1 0",
+		"7:0 0 5 1 5 corrupt_bio_byte 32 r 256 0",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "flakey", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
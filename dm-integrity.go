@@ -0,0 +1,401 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-integrity Table Builder, Status Parser and Superblock Reader.
+// See dm-integrity documentation at: https://www.kernel.org/doc/Documentation/device-mapper/dm-integrity.txt
+
+package devmapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IntegrityMode specifies how a dm-integrity target ensures that data and integrity tags are
+// written atomically.
+type IntegrityMode string
+
+const (
+	IntegrityJournal  IntegrityMode = "J" // Writes are journalled (default)
+	IntegrityBitmap   IntegrityMode = "B" // Dirty regions are tracked in a bitmap, and recalculated after a crash
+	IntegrityDirect   IntegrityMode = "D" // No journal; a crash may leave data and tags out of sync
+	IntegrityRecovery IntegrityMode = "R" // Read-only recovery mode, in which tags are not checked
+)
+
+// IntegrityStatus represents the status of an integrity target.
+type IntegrityStatus struct {
+	Mismatches          uint64 // Number of integrity tag mismatches detected
+	ProvidedDataSectors uint64 // Number of sectors available to the user
+	Recalculating       bool   // Tags are being recalculated
+	RecalcSector        uint64 // Sector up to which tags have been recalculated
+}
+
+func parseIntegrityStatus(params string) (interface{}, error) {
+	var (
+		s   IntegrityStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.Mismatches, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if s.ProvidedDataSectors, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	// Recalculation position, or "-" if not recalculating
+	if r.more() && r.peek() != "-" {
+		if s.RecalcSector, err = r.uint64(); err != nil {
+			return nil, err
+		}
+
+		s.Recalculating = true
+	}
+
+	return &s, nil
+}
+
+// IntegrityTarget is an integrity target, which emulates a device with additional per-sector
+// integrity tags. In standalone mode, i.e. with InternalHash set, the target computes and checks
+// the tags itself. A device whose superblock is zeroed is formatted when the table is loaded.
+type IntegrityTarget struct {
+	Start   uint64        // Start sector of target
+	Length  uint64        // Length of target in sectors
+	Device  string        // Underlying device path, or major:minor
+	Offset  uint64        // Start sector of the superblock on the underlying device
+	TagSize uint32        // Integrity tag size in bytes; zero to derive it from InternalHash
+	Mode    IntegrityMode // Journal, bitmap, direct or recovery mode
+
+	JournalSectors      uint32 // Size of the journal in sectors
+	InterleaveSectors   uint32 // Number of data sectors interleaved with tag sectors
+	BufferSectors       uint32 // Size of the metadata buffer in sectors
+	JournalWatermark    uint32 // Journal fill percentage at which a flush is triggered
+	CommitTime          uint32 // Journal commit interval in milliseconds
+	MetaDevice          string // Separate device for metadata, rather than interleaving it with data
+	BlockSize           uint32 // Data block size in bytes, 512 to 4096; 512 (the default) if zero
+	SectorsPerBit       uint64 // Number of sectors per bitmap bit, in bitmap mode
+	BitmapFlushInterval uint32 // Bitmap flush interval in milliseconds, in bitmap mode
+	InternalHash        string // Hash algorithm for standalone mode, e.g. "crc32c" or "sha256", optionally with ":<hex key>"
+	JournalCrypt        string // Journal encryption algorithm, optionally with ":<hex key>"
+	JournalMAC          string // Journal MAC algorithm, optionally with ":<hex key>"
+	Recalculate         bool   // Recalculate tags for the whole device in the background
+	AllowDiscards       bool   // Allow discards, in which case tags of discarded sectors are invalidated
+	FixPadding          bool   // Use correct padding of the journal, for devices formatted by kernel 5.6 or later
+	FixHMAC             bool   // Include the superblock salt in HMAC tags, for devices formatted by kernel 5.11 or later
+	LegacyRecalculate   bool   // Allow recalculation with a keyed internal hash, despite being insecure
+	ResetRecalculate    bool   // Restart tag recalculation from the beginning of the device
+}
+
+// Marshal returns the table target for an integrity mapping.
+func (t IntegrityTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.Device); err != nil {
+		return dmTarget{}, err
+	}
+
+	switch t.Mode {
+	case IntegrityJournal, IntegrityBitmap, IntegrityDirect, IntegrityRecovery:
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid integrity mode %q", t.Mode)
+	}
+
+	if t.BlockSize != 0 && (t.BlockSize < 512 || t.BlockSize > 4096 || t.BlockSize&(t.BlockSize-1) != 0) {
+		return dmTarget{}, fmt.Errorf("Invalid integrity block size %d", t.BlockSize)
+	}
+
+	if t.TagSize == 0 && t.InternalHash == "" {
+		return dmTarget{}, fmt.Errorf("Integrity tag size required without internal hash")
+	}
+
+	var args []string
+
+	for _, arg := range []struct {
+		name  string
+		value uint64
+	}{
+		{"journal_sectors", uint64(t.JournalSectors)},
+		{"interleave_sectors", uint64(t.InterleaveSectors)},
+		{"buffer_sectors", uint64(t.BufferSectors)},
+		{"journal_watermark", uint64(t.JournalWatermark)},
+		{"commit_time", uint64(t.CommitTime)},
+		{"sectors_per_bit", t.SectorsPerBit},
+		{"bitmap_flush_interval", uint64(t.BitmapFlushInterval)},
+	} {
+		if arg.value != 0 {
+			args = append(args, fmt.Sprintf("%s:%d", arg.name, arg.value))
+		}
+	}
+
+	if t.MetaDevice != "" {
+		if err := checkDevice(t.MetaDevice); err != nil {
+			return dmTarget{}, err
+		}
+
+		args = append(args, "meta_device:"+t.MetaDevice)
+	}
+
+	if t.BlockSize != 0 && t.BlockSize != 512 {
+		args = append(args, fmt.Sprintf("block_size:%d", t.BlockSize))
+	}
+
+	for _, arg := range []struct {
+		name, value string
+	}{
+		{"internal_hash", t.InternalHash},
+		{"journal_crypt", t.JournalCrypt},
+		{"journal_mac", t.JournalMAC},
+	} {
+		if arg.value == "" {
+			continue
+		}
+
+		if strings.IndexFunc(arg.value, func(r rune) bool { return r <= ' ' }) >= 0 {
+			return dmTarget{}, fmt.Errorf("Invalid integrity %s %q", arg.name, arg.value)
+		}
+
+		args = append(args, arg.name+":"+arg.value)
+	}
+
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{t.Recalculate, "recalculate"},
+		{t.ResetRecalculate, "reset_recalculate"},
+		{t.AllowDiscards, "allow_discards"},
+		{t.FixPadding, "fix_padding"},
+		{t.FixHMAC, "fix_hmac"},
+		{t.LegacyRecalculate, "legacy_recalculate"},
+	} {
+		if f.set {
+			args = append(args, f.name)
+		}
+	}
+
+	tagSize := "-"
+	if t.TagSize != 0 {
+		tagSize = strconv.FormatUint(uint64(t.TagSize), 10)
+	}
+
+	params := fmt.Sprintf("%s %d %s %s %d", t.Device, t.Offset, tagSize, t.Mode, len(args))
+	if len(args) > 0 {
+		params += " " + strings.Join(args, " ")
+	}
+
+	return dmTarget{t.Start, t.Length, "integrity", params}, nil
+}
+
+// Unmarshal parses an integrity table target, as returned by GetDeviceTable. Note that the kernel
+// reports the effective values of many optional arguments, even if they were not specified.
+func (t *IntegrityTarget) Unmarshal(target dmTarget) error {
+	var (
+		it  IntegrityTarget
+		err error
+	)
+
+	if err := checkTargetType(target, "integrity"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if it.Device, err = r.next(); err != nil {
+		return err
+	}
+
+	if it.Offset, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if r.peek() == "-" {
+		r.next()
+	} else {
+		n, err := r.uint64()
+		if err != nil {
+			return err
+		}
+
+		it.TagSize = uint32(n)
+	}
+
+	mode, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	it.Mode = IntegrityMode(mode)
+
+	args, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected integrity parameters")
+	}
+
+	uint32Args := map[string]*uint32{
+		"journal_sectors":       &it.JournalSectors,
+		"interleave_sectors":    &it.InterleaveSectors,
+		"buffer_sectors":        &it.BufferSectors,
+		"journal_watermark":     &it.JournalWatermark,
+		"commit_time":           &it.CommitTime,
+		"block_size":            &it.BlockSize,
+		"bitmap_flush_interval": &it.BitmapFlushInterval,
+	}
+
+	stringArgs := map[string]*string{
+		"meta_device":   &it.MetaDevice,
+		"internal_hash": &it.InternalHash,
+		"journal_crypt": &it.JournalCrypt,
+		"journal_mac":   &it.JournalMAC,
+	}
+
+	for _, arg := range args {
+		name, value := arg, ""
+		if x := strings.IndexByte(arg, ':'); x >= 0 {
+			name, value = arg[:x], arg[x+1:]
+		}
+
+		if p, ok := uint32Args[name]; ok {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid integrity option %q", arg)
+			}
+
+			*p = uint32(n)
+			continue
+		}
+
+		if p, ok := stringArgs[name]; ok {
+			*p = value
+			continue
+		}
+
+		switch name {
+		case "sectors_per_bit":
+			if it.SectorsPerBit, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return fmt.Errorf("Invalid integrity option %q", arg)
+			}
+		case "recalculate":
+			it.Recalculate = true
+		case "allow_discards":
+			it.AllowDiscards = true
+		case "fix_padding":
+			it.FixPadding = true
+		case "fix_hmac":
+			it.FixHMAC = true
+		case "legacy_recalculate":
+			it.LegacyRecalculate = true
+		case "reset_recalculate":
+			it.ResetRecalculate = true
+		default:
+			return fmt.Errorf("Unknown integrity option %q", arg)
+		}
+	}
+
+	it.Start, it.Length = target.Start, target.Length
+	*t = it
+
+	return nil
+}
+
+const (
+	integritySuperblockMagic = "integrt\x00"
+	integritySuperblockSize  = 64
+)
+
+// Integrity superblock flags.
+const (
+	IntegrityFlagJournalMAC    = 1 << iota // Journal is protected by a MAC
+	IntegrityFlagRecalculating             // Tags are being recalculated
+	IntegrityFlagDirtyBitmap               // Device is in bitmap mode
+	IntegrityFlagFixedPadding              // Journal uses correct padding
+	IntegrityFlagFixedHMAC                 // HMAC includes the superblock salt
+)
+
+// ErrNoIntegritySuperblock is returned by ReadIntegritySuperblock if a device does not contain
+// an integrity superblock, e.g. because it has never been activated with an integrity target.
+var ErrNoIntegritySuperblock = errors.New("Integrity superblock not found")
+
+// integritySuperblock is the on-disk superblock of a dm-integrity device. All fields are
+// little-endian.
+type integritySuperblock struct {
+	Magic                  [8]byte
+	Version                uint8
+	Log2InterleaveSectors  uint8
+	IntegrityTagSize       uint16
+	JournalSections        uint32
+	ProvidedDataSectors    uint64
+	Flags                  uint32
+	Log2SectorsPerBlock    uint8
+	Log2BlocksPerBitmapBit uint8
+	_                      [2]byte
+	RecalcSector           uint64
+	_                      [8]byte
+	Salt                   [16]byte
+}
+
+// IntegritySuperblock describes the format of a dm-integrity device, as recorded in its
+// superblock.
+type IntegritySuperblock struct {
+	Version             uint8    // Superblock version, 1 to 5
+	InterleaveSectors   uint32   // Number of data sectors interleaved with tag sectors
+	TagSize             uint16   // Integrity tag size in bytes
+	JournalSections     uint32   // Number of journal sections
+	ProvidedDataSectors uint64   // Number of sectors available to the user
+	Flags               uint32   // Bitwise OR of IntegrityFlag constants
+	BlockSize           uint32   // Data block size in bytes
+	SectorsPerBitmapBit uint64   // Number of sectors per bitmap bit, in bitmap mode
+	RecalcSector        uint64   // Sector up to which tags have been recalculated
+	Salt                [16]byte // Salt for HMACs, with superblock version 5 and later
+}
+
+// ReadIntegritySuperblock reads the superblock of an inactive dm-integrity device. The reader
+// must be positioned at the start of the superblock, i.e. the target's offset on the underlying
+// device (see io.NewSectionReader), or the start of the metadata device if one is used.
+func ReadIntegritySuperblock(dev io.ReaderAt) (*IntegritySuperblock, error) {
+	var raw integritySuperblock
+
+	buf := make([]byte, integritySuperblockSize)
+	if _, err := dev.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("Cannot read integrity superblock - %s", err)
+	}
+
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &raw)
+
+	if string(raw.Magic[:]) != integritySuperblockMagic {
+		return nil, ErrNoIntegritySuperblock
+	}
+
+	if raw.Version < 1 || raw.Version > 5 {
+		return nil, fmt.Errorf("Unsupported integrity superblock version %d", raw.Version)
+	}
+
+	if raw.Log2InterleaveSectors > 31 || raw.Log2SectorsPerBlock > 3 ||
+		int(raw.Log2SectorsPerBlock)+int(raw.Log2BlocksPerBitmapBit) > 63 {
+		return nil, fmt.Errorf("Corrupt integrity superblock")
+	}
+
+	sb := IntegritySuperblock{
+		Version:             raw.Version,
+		InterleaveSectors:   1 << raw.Log2InterleaveSectors,
+		TagSize:             raw.IntegrityTagSize,
+		JournalSections:     raw.JournalSections,
+		ProvidedDataSectors: raw.ProvidedDataSectors,
+		Flags:               raw.Flags,
+		BlockSize:           512 << raw.Log2SectorsPerBlock,
+		SectorsPerBitmapBit: 1 << (raw.Log2SectorsPerBlock + raw.Log2BlocksPerBitmapBit),
+		RecalcSector:        raw.RecalcSector,
+		Salt:                raw.Salt,
+	}
+
+	return &sb, nil
+}
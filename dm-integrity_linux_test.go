@@ -0,0 +1,70 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-integrity formatting by the kernel.
+
+package devmapper
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIntegrityFormat(t *testing.T) {
+	requireDM(t)
+
+	if _, err := GetTargetVersion("integrity"); err != nil {
+		t.Skip("Integrity target not available:", err)
+	}
+
+	loop := newTestLoopDev(t, 16*(1<<20))
+	defer loop.Close()
+
+	// Loading a table on a zeroed device formats it. The provided data sectors are not known until
+	// then, so map a single sector initially.
+	name := testDeviceName()
+	it := IntegrityTarget{Length: 1, Device: loop.path, Mode: IntegrityJournal, InternalHash: "crc32c"}
+
+	table, err := Table(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateDevice(name, "", table, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	status, err := GetDeviceStatus(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ParseTargetStatus(status[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveDevice(name, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(loop.backing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	sb, err := ReadIntegritySuperblock(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provided := s.(*IntegrityStatus).ProvidedDataSectors; sb.ProvidedDataSectors != provided || sb.TagSize != 4 {
+		t.Errorf("Got superblock %+v, expected %d provided data sectors", *sb, provided)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-integrity table builder, status parser and superblock reader.
+
+package devmapper
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseIntegrityStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected IntegrityStatus
+	}{
+		{"0 32112 -", IntegrityStatus{ProvidedDataSectors: 32112}},
+		{"3 32112 16384", IntegrityStatus{Mismatches: 3, ProvidedDataSectors: 32112, Recalculating: true, RecalcSector: 16384}},
+		{"0 32112", IntegrityStatus{ProvidedDataSectors: 32112}},
+	}
+
+	for _, test := range tests {
+		s, err := parseIntegrityStatus(test.params)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if *s.(*IntegrityStatus) != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.params, *s.(*IntegrityStatus), test.expected)
+		}
+	}
+
+	for _, params := range []string{"", "0", "0 foo", "0 32112 foo"} {
+		if _, err := parseIntegrityStatus(params); err == nil {
+			t.Errorf("Expected error for status %q", params)
+		}
+	}
+}
+
+func TestIntegrityTarget(t *testing.T) {
+	tests := []struct {
+		target IntegrityTarget
+		params string
+	}{
+		{
+			IntegrityTarget{Length: 32112, Device: "7:0", Mode: IntegrityJournal, InternalHash: "crc32c"},
+			"7:0 0 - J 1 internal_hash:crc32c",
+		},
+		{
+			IntegrityTarget{
+				Length:              8,
+				Device:              "/dev/loop0",
+				Offset:              8,
+				TagSize:             32,
+				Mode:                IntegrityBitmap,
+				JournalSectors:      1024,
+				InterleaveSectors:   32768,
+				BufferSectors:       128,
+				SectorsPerBit:       65536,
+				BitmapFlushInterval: 10000,
+				MetaDevice:          "7:1",
+				BlockSize:           4096,
+				InternalHash:        "sha256",
+				Recalculate:         true,
+				AllowDiscards:       true,
+				FixPadding:          true,
+				FixHMAC:             true,
+				LegacyRecalculate:   true,
+				ResetRecalculate:    true,
+			},
+			"/dev/loop0 8 32 B 14 journal_sectors:1024 interleave_sectors:32768 buffer_sectors:128 " +
+				"sectors_per_bit:65536 bitmap_flush_interval:10000 meta_device:7:1 block_size:4096 " +
+				"internal_hash:sha256 recalculate reset_recalculate allow_discards fix_padding fix_hmac " +
+				"legacy_recalculate",
+		},
+		{
+			IntegrityTarget{Length: 8, Device: "7:0", TagSize: 4, Mode: IntegrityDirect},
+			"7:0 0 4 D 0",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed IntegrityTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+		} else if parsed != test.target {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+
+	// Table as reported by the kernel
+	var parsed IntegrityTarget
+
+	err := parsed.Unmarshal(dmTarget{0, 32112, "integrity", "7:0 0 4 J 6 journal_sectors:1024 " +
+		"interleave_sectors:32768 buffer_sectors:128 journal_watermark:50 commit_time:10000 internal_hash:crc32c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := IntegrityTarget{Length: 32112, Device: "7:0", TagSize: 4, Mode: IntegrityJournal,
+		JournalSectors: 1024, InterleaveSectors: 32768, BufferSectors: 128, JournalWatermark: 50,
+		CommitTime: 10000, InternalHash: "crc32c"}
+
+	if parsed != expected {
+		t.Errorf("Got %+v, expected %+v", parsed, expected)
+	}
+
+	// HMAC device formatted by integritysetup, and a device being recalculated, in the order in
+	// which the kernel reports the optional arguments
+	for _, test := range []struct {
+		params   string
+		expected IntegrityTarget
+	}{
+		{
+			"7:0 0 32 J 8 journal_sectors:16320 interleave_sectors:32768 buffer_sectors:128 " +
+				"journal_watermark:50 commit_time:10000 fix_padding fix_hmac internal_hash:hmac(sha256):0011223344556677",
+			IntegrityTarget{Length: 32112, Device: "7:0", TagSize: 32, Mode: IntegrityJournal,
+				JournalSectors: 16320, InterleaveSectors: 32768, BufferSectors: 128, JournalWatermark: 50,
+				CommitTime: 10000, FixPadding: true, FixHMAC: true, InternalHash: "hmac(sha256):0011223344556677"},
+		},
+		{
+			"7:0 0 4 B 11 block_size:4096 recalculate reset_recalculate journal_sectors:8192 " +
+				"interleave_sectors:32768 buffer_sectors:128 sectors_per_bit:65536 bitmap_flush_interval:10000 " +
+				"fix_padding legacy_recalculate internal_hash:crc32c",
+			IntegrityTarget{Length: 32112, Device: "7:0", TagSize: 4, Mode: IntegrityBitmap, BlockSize: 4096,
+				Recalculate: true, ResetRecalculate: true, JournalSectors: 8192, InterleaveSectors: 32768,
+				BufferSectors: 128, SectorsPerBit: 65536, BitmapFlushInterval: 10000, FixPadding: true,
+				LegacyRecalculate: true, InternalHash: "crc32c"},
+		},
+	} {
+		var parsed IntegrityTarget
+
+		if err := parsed.Unmarshal(dmTarget{0, 32112, "integrity", test.params}); err != nil {
+			t.Error(err)
+		} else if parsed != test.expected {
+			t.Errorf("Got %+v, expected %+v", parsed, test.expected)
+		}
+	}
+
+	for _, it := range []IntegrityTarget{
+		{Device: "7:0", Mode: "X", TagSize: 4},
+		{Device: "7:0", Mode: IntegrityJournal},
+		{Device: "", Mode: IntegrityJournal, TagSize: 4},
+		{Device: "7:0", Mode: IntegrityJournal, TagSize: 4, BlockSize: 8192},
+		{Device: "7:0", Mode: IntegrityJournal, InternalHash: "hmac(sha256): 00"},
+	} {
+		if _, err := it.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", it)
+		}
+	}
+
+	for _, params := range []string{
+		"7:0 0 4 J",
+		"7:0 0 4 J 1 bogus",
+		"7:0 0 4 J 1 journal_sectors:foo",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "integrity", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
+
+// newSparseFile returns a zeroed sparse file of the specified size.
+func newSparseFile(t *testing.T, size int64) *os.File {
+	f, err := ioutil.TempFile("", "devmapper_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(f.Name())
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestReadIntegritySuperblock(t *testing.T) {
+	f := newSparseFile(t, 1<<20)
+	defer f.Close()
+
+	if _, err := ReadIntegritySuperblock(f); err != ErrNoIntegritySuperblock {
+		t.Errorf("Expected ErrNoIntegritySuperblock for zeroed device, got %v", err)
+	}
+
+	// Version 5 superblock at sector 8, with 4 KiB blocks, bitmap mode and recalculation in progress
+	sb, _ := hex.DecodeString("696e746567727400050f0400020000007004000000000000" +
+		"0e000000030c0000004000000000000000000000000000000102030405060708090a0b0c0d0e0f10")
+
+	if _, err := f.WriteAt(sb, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadIntegritySuperblock(io.NewSectionReader(f, 4096, 1<<20-4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := IntegritySuperblock{
+		Version:             5,
+		InterleaveSectors:   32768,
+		TagSize:             4,
+		JournalSections:     2,
+		ProvidedDataSectors: 1136,
+		Flags:               IntegrityFlagRecalculating | IntegrityFlagDirtyBitmap | IntegrityFlagFixedPadding,
+		BlockSize:           4096,
+		SectorsPerBitmapBit: 32768,
+		RecalcSector:        16384,
+		Salt:                [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+	}
+
+	if !reflect.DeepEqual(*got, expected) {
+		t.Errorf("Got %+v, expected %+v", *got, expected)
+	}
+
+	// Unsupported version
+	f.WriteAt([]byte{9}, 4096+8)
+
+	if _, err := ReadIntegritySuperblock(io.NewSectionReader(f, 4096, 1<<20-4096)); err == nil {
+		t.Error("Expected error for unsupported superblock version")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-linear Table Builder and Parser.
+// See dm-linear documentation at: https://www.kernel.org/doc/Documentation/device-mapper/linear.txt
+
+package devmapper
+
+import "fmt"
+
+// LinearTarget maps a range of a device linearly onto another device.
+type LinearTarget struct {
+	Start  uint64 // Start sector of target
+	Length uint64 // Length of target in sectors
+	Device string // Underlying device path, or major:minor
+	Offset uint64 // Start sector on underlying device
+}
+
+// Marshal returns the table target for a linear mapping.
+func (t LinearTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.Device); err != nil {
+		return dmTarget{}, err
+	}
+
+	return dmTarget{t.Start, t.Length, "linear", fmt.Sprintf("%s %d", t.Device, t.Offset)}, nil
+}
+
+// Unmarshal parses a linear table target, as returned by GetDeviceTable.
+func (t *LinearTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "linear"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	dev, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	offset, err := r.uint64()
+	if err != nil {
+		return err
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected linear parameters %q", target.Params)
+	}
+
+	*t = LinearTarget{target.Start, target.Length, dev, offset}
+
+	return nil
+}
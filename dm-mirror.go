@@ -0,0 +1,57 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-mirror Status Parser.
+// See dm-log documentation at: https://www.kernel.org/doc/Documentation/device-mapper/dm-log.txt
+
+package devmapper
+
+import "fmt"
+
+// MirrorStatus represents the status of a mirror target.
+type MirrorStatus struct {
+	Devices       []string // Mirror legs, as major:minor
+	InSyncRegions uint64   // Number of regions in sync
+	TotalRegions  uint64   // Total number of regions
+	Health        string   // One character per leg: 'A' alive, 'D' write failure, 'S' sync failure, 'R' read failure, 'U' unclassified failure
+	LogType       string   // e.g. "core" or "disk"
+	LogArgs       []string // Log-specific status, e.g. log device and health for a disk log
+}
+
+func parseMirrorStatus(params string) (interface{}, error) {
+	var (
+		s   MirrorStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.Devices, err = r.counted(); err != nil {
+		return nil, err
+	}
+
+	if s.InSyncRegions, s.TotalRegions, err = r.ratio(); err != nil {
+		return nil, err
+	}
+
+	// Health characters are always a single argument
+	health, err := r.counted()
+	if err != nil {
+		return nil, err
+	} else if len(health) != 1 {
+		return nil, fmt.Errorf("Unexpected mirror health argument count %d", len(health))
+	}
+
+	s.Health = health[0]
+
+	logArgs, err := r.counted()
+	if err != nil {
+		return nil, err
+	} else if len(logArgs) == 0 {
+		return nil, fmt.Errorf("Missing mirror log type")
+	}
+
+	s.LogType, s.LogArgs = logArgs[0], logArgs[1:]
+
+	return &s, nil
+}
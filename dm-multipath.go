@@ -0,0 +1,426 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-multipath Table Builder and Status Parser.
+// See dm-multipath source at: https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/drivers/md/dm-mpath.c
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MultipathStatus represents the status of a multipath target.
+type MultipathStatus struct {
+	Features    []string // Status feature args, i.e. queueing flag and pg_init count
+	QueueIO     bool     // I/O is being queued, e.g. because no paths are usable
+	PgInitCount int      // Number of path group initialisations performed
+	HWHandler   []string // Hardware handler status args
+	NextGroup   int      // Number of the path group to be used for the next I/O, starting from 1
+	Groups      []MultipathGroupStatus
+}
+
+// ActiveGroup returns the number of the priority group currently in use, starting from 1, or
+// zero if no group is active, e.g. before the first I/O.
+func (s *MultipathStatus) ActiveGroup() int {
+	for x, pg := range s.Groups {
+		if pg.State == MultipathGroupActive {
+			return x + 1
+		}
+	}
+
+	return 0
+}
+
+// FailedPaths returns the devices of all failed paths, in all priority groups.
+func (s *MultipathStatus) FailedPaths() []string {
+	var failed []string
+
+	for _, pg := range s.Groups {
+		for _, path := range pg.Paths {
+			if !path.Active {
+				failed = append(failed, path.Device)
+			}
+		}
+	}
+
+	return failed
+}
+
+// Multipath priority group states.
+const (
+	MultipathGroupActive   = "A" // Group is in use
+	MultipathGroupEnabled  = "E" // Group is usable, but not in use
+	MultipathGroupDisabled = "D" // Group is bypassed, e.g. by MultipathDisableGroup
+)
+
+// MultipathGroupStatus represents the status of a multipath priority group.
+type MultipathGroupStatus struct {
+	State        string   // MultipathGroupActive, MultipathGroupEnabled or MultipathGroupDisabled
+	SelectorArgs []string // Path selector status args for the group
+	Paths        []MultipathPathStatus
+}
+
+// MultipathPathStatus represents the status of a single path in a multipath priority group.
+type MultipathPathStatus struct {
+	Device       string   // Path device, as major:minor
+	Active       bool     // Path is active, i.e. not failed
+	FailCount    int      // Number of times the path has failed
+	SelectorArgs []string // Path selector status args for the path
+}
+
+func parseMultipathStatus(params string) (interface{}, error) {
+	var (
+		s   MultipathStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.Features, err = r.counted(); err != nil {
+		return nil, err
+	}
+
+	// Kernels since 2.6.29 report the queueing flag and the pg_init count
+	if len(s.Features) >= 2 {
+		s.QueueIO = s.Features[0] == "1"
+
+		if s.PgInitCount, err = strconv.Atoi(s.Features[1]); err != nil {
+			return nil, fmt.Errorf("Invalid pg_init count %q", s.Features[1])
+		}
+	}
+
+	if s.HWHandler, err = r.counted(); err != nil {
+		return nil, err
+	}
+
+	nrGroups, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.NextGroup, err = r.int(); err != nil {
+		return nil, err
+	}
+
+	for g := 0; g < nrGroups; g++ {
+		var pg MultipathGroupStatus
+
+		if pg.State, err = r.next(); err != nil {
+			return nil, err
+		}
+
+		switch pg.State {
+		case MultipathGroupActive, MultipathGroupEnabled, MultipathGroupDisabled:
+		default:
+			return nil, fmt.Errorf("Invalid priority group state %q", pg.State)
+		}
+
+		if pg.SelectorArgs, err = r.counted(); err != nil {
+			return nil, err
+		}
+
+		nrPaths, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+
+		nrSelectorArgs, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+
+		for p := 0; p < nrPaths; p++ {
+			var path MultipathPathStatus
+
+			if path.Device, err = r.next(); err != nil {
+				return nil, err
+			}
+
+			state, err := r.next()
+			if err != nil {
+				return nil, err
+			}
+
+			switch state {
+			case "A":
+				path.Active = true
+			case "F":
+			default:
+				return nil, fmt.Errorf("Invalid path state %q", state)
+			}
+
+			if path.FailCount, err = r.int(); err != nil {
+				return nil, err
+			}
+
+			if path.SelectorArgs, err = r.take(nrSelectorArgs); err != nil {
+				return nil, err
+			}
+
+			pg.Paths = append(pg.Paths, path)
+		}
+
+		s.Groups = append(s.Groups, pg)
+	}
+
+	return &s, nil
+}
+
+// Path selectors provided by the kernel.
+const (
+	MultipathRoundRobin            = "round-robin"             // Per-path args: repeat count
+	MultipathQueueLength           = "queue-length"            // Per-path args: repeat count
+	MultipathServiceTime           = "service-time"            // Per-path args: repeat count, relative throughput
+	MultipathHistoricalServiceTime = "historical-service-time" // Per-path args: none
+)
+
+// MultipathQueueMode specifies whether a multipath target is bio or request based.
+type MultipathQueueMode string
+
+const (
+	MultipathQueueModeRequest MultipathQueueMode = ""    // Request based (default)
+	MultipathQueueModeBio     MultipathQueueMode = "bio" // Bio based
+	MultipathQueueModeMQ      MultipathQueueMode = "mq"  // Request based, using blk-mq
+)
+
+// MultipathPath is a path of a multipath priority group.
+type MultipathPath struct {
+	Device string   // Path device path, or major:minor
+	Args   []string // Per-path selector args, e.g. repeat count
+}
+
+// MultipathGroup is a multipath priority group, i.e. a set of paths among which I/O is
+// distributed by a path selector.
+type MultipathGroup struct {
+	Selector     string   // Path selector, e.g. MultipathServiceTime
+	SelectorArgs []string // Path selector args for the group
+	Paths        []MultipathPath
+}
+
+// MultipathTarget is a multipath target, which distributes I/O among multiple paths to the same
+// device, and fails over between priority groups.
+type MultipathTarget struct {
+	Start  uint64 // Start sector of target
+	Length uint64 // Length of target in sectors
+
+	QueueIfNoPath           bool               // Queue I/O if no paths are usable, rather than failing it
+	PgInitRetries           uint32             // Number of times to retry path group initialisation
+	PgInitDelayMsecs        uint32             // Delay between path group initialisation retries
+	RetainAttachedHWHandler bool               // Use the hardware handler already attached to the paths, if any
+	QueueMode               MultipathQueueMode // Bio or request based
+
+	HWHandler     string   // Hardware handler, e.g. "alua" or "emc"; none if empty
+	HWHandlerArgs []string // Hardware handler args
+
+	InitialGroup int // Priority group to use initially, numbered from 1; the first group if zero
+	Groups       []MultipathGroup
+}
+
+// Marshal returns the table target for a multipath device.
+func (t MultipathTarget) Marshal() (dmTarget, error) {
+	var features []string
+
+	if t.QueueIfNoPath {
+		features = append(features, "queue_if_no_path")
+	}
+
+	if t.PgInitRetries != 0 {
+		features = append(features, "pg_init_retries", strconv.FormatUint(uint64(t.PgInitRetries), 10))
+	}
+
+	if t.PgInitDelayMsecs != 0 {
+		features = append(features, "pg_init_delay_msecs", strconv.FormatUint(uint64(t.PgInitDelayMsecs), 10))
+	}
+
+	if t.RetainAttachedHWHandler {
+		features = append(features, "retain_attached_hw_handler")
+	}
+
+	switch t.QueueMode {
+	case MultipathQueueModeRequest:
+	case MultipathQueueModeBio, MultipathQueueModeMQ:
+		features = append(features, "queue_mode", string(t.QueueMode))
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid multipath queue mode %q", t.QueueMode)
+	}
+
+	params := []string{strconv.Itoa(len(features))}
+	params = append(params, features...)
+
+	if t.HWHandler == "" {
+		if len(t.HWHandlerArgs) > 0 {
+			return dmTarget{}, fmt.Errorf("Multipath hardware handler args without hardware handler")
+		}
+
+		params = append(params, "0")
+	} else {
+		params = append(params, strconv.Itoa(1+len(t.HWHandlerArgs)), t.HWHandler)
+		params = append(params, t.HWHandlerArgs...)
+	}
+
+	if len(t.Groups) == 0 {
+		return dmTarget{}, fmt.Errorf("Multipath target requires at least one priority group")
+	}
+
+	if t.InitialGroup < 0 || t.InitialGroup > len(t.Groups) {
+		return dmTarget{}, fmt.Errorf("Invalid initial multipath group %d", t.InitialGroup)
+	}
+
+	initial := t.InitialGroup
+	if initial == 0 {
+		initial = 1
+	}
+
+	params = append(params, strconv.Itoa(len(t.Groups)), strconv.Itoa(initial))
+
+	for g, pg := range t.Groups {
+		if pg.Selector == "" || strings.IndexFunc(pg.Selector, unicode.IsSpace) >= 0 {
+			return dmTarget{}, fmt.Errorf("Invalid path selector %q in group %d", pg.Selector, g+1)
+		}
+
+		if len(pg.Paths) == 0 {
+			return dmTarget{}, fmt.Errorf("Multipath group %d has no paths", g+1)
+		}
+
+		// All paths of a group must have the same number of args
+		nrArgs := len(pg.Paths[0].Args)
+
+		params = append(params, pg.Selector, strconv.Itoa(len(pg.SelectorArgs)))
+		params = append(params, pg.SelectorArgs...)
+		params = append(params, strconv.Itoa(len(pg.Paths)), strconv.Itoa(nrArgs))
+
+		for _, path := range pg.Paths {
+			if err := checkDevice(path.Device); err != nil {
+				return dmTarget{}, err
+			}
+
+			if len(path.Args) != nrArgs {
+				return dmTarget{}, fmt.Errorf("Path %s has %d args, expected %d", path.Device, len(path.Args), nrArgs)
+			}
+
+			params = append(params, path.Device)
+			params = append(params, path.Args...)
+		}
+	}
+
+	return dmTarget{t.Start, t.Length, "multipath", strings.Join(params, " ")}, nil
+}
+
+// Unmarshal parses a multipath table target, as returned by GetDeviceTable.
+func (t *MultipathTarget) Unmarshal(target dmTarget) error {
+	var (
+		m   MultipathTarget
+		err error
+	)
+
+	if err := checkTargetType(target, "multipath"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	features, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	for x := 0; x < len(features); x++ {
+		switch f := features[x]; f {
+		case "queue_if_no_path":
+			m.QueueIfNoPath = true
+		case "retain_attached_hw_handler":
+			m.RetainAttachedHWHandler = true
+		case "pg_init_retries", "pg_init_delay_msecs", "queue_mode":
+			if x++; x == len(features) {
+				return fmt.Errorf("Missing value for multipath feature %q", f)
+			}
+
+			if f == "queue_mode" {
+				m.QueueMode = MultipathQueueMode(features[x])
+				break
+			}
+
+			n, err := strconv.ParseUint(features[x], 10, 32)
+			if err != nil {
+				return fmt.Errorf("Invalid value for multipath feature %q: %q", f, features[x])
+			}
+
+			if f == "pg_init_retries" {
+				m.PgInitRetries = uint32(n)
+			} else {
+				m.PgInitDelayMsecs = uint32(n)
+			}
+		default:
+			return fmt.Errorf("Unknown multipath feature %q", f)
+		}
+	}
+
+	hw, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	if len(hw) > 0 {
+		m.HWHandler, m.HWHandlerArgs = hw[0], hw[1:]
+	}
+
+	nrGroups, err := r.int()
+	if err != nil {
+		return err
+	}
+
+	if m.InitialGroup, err = r.int(); err != nil {
+		return err
+	}
+
+	for g := 0; g < nrGroups; g++ {
+		var pg MultipathGroup
+
+		if pg.Selector, err = r.next(); err != nil {
+			return err
+		}
+
+		if pg.SelectorArgs, err = r.counted(); err != nil {
+			return err
+		}
+
+		nrPaths, err := r.int()
+		if err != nil {
+			return err
+		}
+
+		nrArgs, err := r.int()
+		if err != nil {
+			return err
+		}
+
+		for p := 0; p < nrPaths; p++ {
+			var path MultipathPath
+
+			if path.Device, err = r.next(); err != nil {
+				return err
+			}
+
+			if path.Args, err = r.take(nrArgs); err != nil {
+				return err
+			}
+
+			pg.Paths = append(pg.Paths, path)
+		}
+
+		m.Groups = append(m.Groups, pg)
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected multipath parameters %q", target.Params)
+	}
+
+	m.Start, m.Length = target.Start, target.Length
+	*t = m
+
+	return nil
+}
@@ -0,0 +1,55 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-multipath Messages.
+
+package devmapper
+
+import "fmt"
+
+// MultipathFailPath marks a path of a multipath target as failed. The path may be specified as a
+// device path or as major:minor.
+func MultipathFailPath(name, path string) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("fail_path %s", path))
+	return err
+}
+
+// MultipathReinstatePath reinstates a failed path of a multipath target.
+func MultipathReinstatePath(name, path string) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("reinstate_path %s", path))
+	return err
+}
+
+// MultipathSwitchGroup makes the specified priority group of a multipath target the active
+// group, bypassing the normal group selection. Groups are numbered from 1.
+func MultipathSwitchGroup(name string, group int) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("switch_group %d", group))
+	return err
+}
+
+// MultipathDisableGroup marks a priority group of a multipath target as bypassed, so that it is
+// only used if no other group has usable paths. Groups are numbered from 1.
+func MultipathDisableGroup(name string, group int) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("disable_group %d", group))
+	return err
+}
+
+// MultipathEnableGroup reverses MultipathDisableGroup.
+func MultipathEnableGroup(name string, group int) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("enable_group %d", group))
+	return err
+}
+
+// MultipathQueueIfNoPath sets whether a multipath target queues I/O when no paths are usable,
+// rather than failing it. Disabling queueing fails any I/O which is currently queued.
+func MultipathQueueIfNoPath(name string, queue bool) error {
+	msg := "fail_if_no_path"
+	if queue {
+		msg = "queue_if_no_path"
+	}
+
+	_, err := SendMessage(name, 0, msg)
+	return err
+}
@@ -0,0 +1,170 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-multipath table builder and status parser.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMultipathStatus(t *testing.T) {
+	// iSCSI array with ALUA, two groups of two paths each, one path failed in the standby group
+	params := "2 0 3 0 2 1 A 0 2 2 8:32 A 0 0 1 8:64 A 0 1 1 E 0 2 2 8:48 A 0 0 1 8:80 F 2 0 1"
+
+	s, err := parseMultipathStatus(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &MultipathStatus{
+		Features:    []string{"0", "3"},
+		PgInitCount: 3,
+		HWHandler:   []string{},
+		NextGroup:   1,
+		Groups: []MultipathGroupStatus{
+			{
+				State:        MultipathGroupActive,
+				SelectorArgs: []string{},
+				Paths: []MultipathPathStatus{
+					{Device: "8:32", Active: true, SelectorArgs: []string{"0", "1"}},
+					{Device: "8:64", Active: true, SelectorArgs: []string{"1", "1"}},
+				},
+			},
+			{
+				State:        MultipathGroupEnabled,
+				SelectorArgs: []string{},
+				Paths: []MultipathPathStatus{
+					{Device: "8:48", Active: true, SelectorArgs: []string{"0", "1"}},
+					{Device: "8:80", FailCount: 2, SelectorArgs: []string{"0", "1"}},
+				},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Got %+v, expected %+v", s, expected)
+	}
+
+	ms := s.(*MultipathStatus)
+
+	if g := ms.ActiveGroup(); g != 1 {
+		t.Errorf("Got active group %d, expected 1", g)
+	}
+
+	if failed := ms.FailedPaths(); !reflect.DeepEqual(failed, []string{"8:80"}) {
+		t.Errorf("Got failed paths %v, expected [8:80]", failed)
+	}
+
+	// All paths failed, with I/O queued and the first group bypassed
+	s, err = parseMultipathStatus("2 1 0 0 2 2 D 0 1 0 8:16 F 1 E 0 1 0 8:32 F 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms = s.(*MultipathStatus)
+
+	if !ms.QueueIO || ms.ActiveGroup() != 0 || len(ms.FailedPaths()) != 2 {
+		t.Errorf("Unexpected status %+v", ms)
+	}
+
+	for _, params := range []string{
+		"2 0 0 0 1 1 X 0 1 0 8:16 A 0",
+		"2 0 0 0 1 1 A 0 1 0 8:16 X 0",
+		"2 0 x 0 1 1 A 0 1 0 8:16 A 0",
+	} {
+		if _, err := parseMultipathStatus(params); err == nil {
+			t.Errorf("Expected error for status %q", params)
+		}
+	}
+}
+
+func TestMultipathTarget(t *testing.T) {
+	mt := MultipathTarget{
+		Length:           209715200,
+		QueueIfNoPath:    true,
+		PgInitRetries:    50,
+		PgInitDelayMsecs: 2000,
+		QueueMode:        MultipathQueueModeMQ,
+		HWHandler:        "alua",
+		InitialGroup:     2,
+		Groups: []MultipathGroup{
+			{
+				Selector: MultipathServiceTime,
+				Paths: []MultipathPath{
+					{"8:32", []string{"1", "1"}},
+					{"/dev/sde", []string{"1", "2"}},
+				},
+			},
+			{
+				Selector: MultipathRoundRobin,
+				Paths:    []MultipathPath{{"8:48", []string{"1000"}}},
+			},
+			{
+				Selector: MultipathHistoricalServiceTime,
+				Paths:    []MultipathPath{{"8:96", nil}},
+			},
+		},
+	}
+
+	target, err := mt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := "7 queue_if_no_path pg_init_retries 50 pg_init_delay_msecs 2000 queue_mode mq 1 alua 3 2 " +
+		"service-time 0 2 2 8:32 1 1 /dev/sde 1 2 round-robin 0 1 1 8:48 1000 historical-service-time 0 1 0 8:96"
+
+	if target.Params != params {
+		t.Errorf("Got %q, expected %q", target.Params, params)
+	}
+
+	var parsed MultipathTarget
+	if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if again, err := parsed.Marshal(); err != nil || again != target {
+		t.Errorf("Got %v (%v), expected %v", again, err, target)
+	}
+
+	// Table as reported by the kernel
+	err = parsed.Unmarshal(dmTarget{0, 2097152, "multipath",
+		"1 retain_attached_hw_handler 0 1 1 queue-length 0 2 1 8:16 1 8:32 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !parsed.RetainAttachedHWHandler || parsed.HWHandler != "" || len(parsed.Groups) != 1 ||
+		parsed.Groups[0].Selector != MultipathQueueLength || len(parsed.Groups[0].Paths) != 2 ||
+		parsed.Groups[0].Paths[1].Device != "8:32" || !reflect.DeepEqual(parsed.Groups[0].Paths[1].Args, []string{"1"}) {
+		t.Errorf("Unexpected table %+v", parsed)
+	}
+
+	for _, mt := range []MultipathTarget{
+		{},
+		{QueueMode: "foo", Groups: []MultipathGroup{{Selector: MultipathRoundRobin, Paths: []MultipathPath{{"8:16", nil}}}}},
+		{HWHandlerArgs: []string{"1"}, Groups: []MultipathGroup{{Selector: MultipathRoundRobin, Paths: []MultipathPath{{"8:16", nil}}}}},
+		{InitialGroup: 2, Groups: []MultipathGroup{{Selector: MultipathRoundRobin, Paths: []MultipathPath{{"8:16", nil}}}}},
+		{Groups: []MultipathGroup{{Selector: "", Paths: []MultipathPath{{"8:16", nil}}}}},
+		{Groups: []MultipathGroup{{Selector: MultipathRoundRobin}}},
+		{Groups: []MultipathGroup{{Selector: MultipathRoundRobin, Paths: []MultipathPath{{"8:16", []string{"1"}}, {"8:32", nil}}}}},
+	} {
+		if _, err := mt.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", mt)
+		}
+	}
+
+	for _, params := range []string{
+		"1 bogus 0 1 1 round-robin 0 1 1 8:16 1000",
+		"1 pg_init_retries 0 1 1 round-robin 0 1 1 8:16 1000",
+		"0 0 1 1 round-robin 0 1 1 8:16",
+		"0 0 1 1 round-robin 0 1 1 8:16 1000 extra",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "multipath", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-raid Status Parser.
+// See dm-raid documentation at: https://www.kernel.org/doc/Documentation/device-mapper/dm-raid.txt
+
+package devmapper
+
+// RaidSyncAction is a sync action which can be requested of a raid target.
+type RaidSyncAction string
+
+const (
+	RaidActionIdle    RaidSyncAction = "idle"    // Stop the current sync action
+	RaidActionFrozen  RaidSyncAction = "frozen"  // Stop and prevent any sync action
+	RaidActionResync  RaidSyncAction = "resync"  // Resynchronise the array
+	RaidActionRecover RaidSyncAction = "recover" // Recover failed or replaced devices
+	RaidActionCheck   RaidSyncAction = "check"   // Scrub the array, counting mismatches
+	RaidActionRepair  RaidSyncAction = "repair"  // Scrub the array, correcting mismatches
+	RaidActionReshape RaidSyncAction = "reshape" // Reshape the array
+)
+
+// RaidStatus represents the status of a raid target. Fields following SyncTotal were added in
+// later kernel versions, and are left zero if not reported.
+type RaidStatus struct {
+	RaidType      string         // e.g. "raid1", "raid5_ls"
+	Devices       int            // Number of devices in the array
+	Health        string         // One character per device: 'A' alive and in-sync, 'a' alive but not in-sync, 'D' dead
+	SyncCurrent   uint64         // Number of sectors resynchronised / recovered so far
+	SyncTotal     uint64         // Total number of sectors to be resynchronised / recovered
+	SyncAction    RaidSyncAction // Current sync action
+	MismatchCount uint64         // Discrepancies found by the last "check" or "repair" action
+	DataOffset    uint64         // Offset of data on each component device, in sectors
+	Journal       string         // Journal device state: "A" active, "D" dead, or "-" if none
+}
+
+// Healthy returns true if all devices in the array are alive and in-sync.
+func (s *RaidStatus) Healthy() bool {
+	for _, c := range s.Health {
+		if c != 'A' {
+			return false
+		}
+	}
+
+	return s.Journal != "D"
+}
+
+func parseRaidStatus(params string) (interface{}, error) {
+	var (
+		s   RaidStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.RaidType, err = r.next(); err != nil {
+		return nil, err
+	}
+
+	if s.Devices, err = r.int(); err != nil {
+		return nil, err
+	}
+
+	if s.Health, err = r.next(); err != nil {
+		return nil, err
+	}
+
+	if s.SyncCurrent, s.SyncTotal, err = r.ratio(); err != nil {
+		return nil, err
+	}
+
+	if !r.more() {
+		return &s, nil
+	}
+
+	action, _ := r.next()
+	s.SyncAction = RaidSyncAction(action)
+
+	if s.MismatchCount, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if !r.more() {
+		return &s, nil
+	}
+
+	if s.DataOffset, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if r.more() {
+		s.Journal, _ = r.next()
+	}
+
+	return &s, nil
+}
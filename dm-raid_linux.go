@@ -0,0 +1,178 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-raid Sync Action Messages and Scrubbing.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RaidSetSyncAction requests a sync action, e.g. a "check" scrub, of a raid target.
+func RaidSetSyncAction(name string, action RaidSyncAction) error {
+	_, err := SendMessage(name, 0, string(action))
+	return err
+}
+
+// RaidCheck starts a "check" scrub of a raid target, which counts mismatches without correcting
+// them.
+func RaidCheck(name string) error {
+	return RaidSetSyncAction(name, RaidActionCheck)
+}
+
+// RaidRepair starts a "repair" scrub of a raid target, which corrects any mismatches found.
+func RaidRepair(name string) error {
+	return RaidSetSyncAction(name, RaidActionRepair)
+}
+
+// RaidIdle stops the current sync action of a raid target.
+func RaidIdle(name string) error {
+	return RaidSetSyncAction(name, RaidActionIdle)
+}
+
+// RaidFreeze stops the current sync action of a raid target, and prevents any further sync
+// actions from starting until another action is requested.
+func RaidFreeze(name string) error {
+	return RaidSetSyncAction(name, RaidActionFrozen)
+}
+
+// RaidRecover starts recovery of failed or replaced devices of a raid target.
+func RaidRecover(name string) error {
+	return RaidSetSyncAction(name, RaidActionRecover)
+}
+
+// getRaidStatus returns the parsed status of a device consisting of a single raid target.
+func getRaidStatus(name string) (*RaidStatus, error) {
+	status, err := GetDeviceStatus(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(status) != 1 || status[0].Type != "raid" {
+		return nil, fmt.Errorf("Device %s is not a raid device", name)
+	}
+
+	s, err := parseRaidStatus(status[0].Params)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.(*RaidStatus), nil
+}
+
+// RaidScrub runs a "check" scrub of a raid device, polling its status at the specified interval,
+// and returns the mismatch count once the check has finished. An error is returned if another
+// sync action is in progress, or if the check is interrupted by a different action.
+//
+// If ctx is done before the check finishes, the check is stopped and ctx.Err() is returned.
+func RaidScrub(ctx context.Context, name string, interval time.Duration) (uint64, error) {
+	if interval <= 0 {
+		return 0, fmt.Errorf("Invalid poll interval %v", interval)
+	}
+
+	s, err := getRaidStatus(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.SyncAction != RaidActionIdle {
+		return 0, fmt.Errorf("Device %s is busy with sync action %q", name, s.SyncAction)
+	}
+
+	if err := RaidCheck(name); err != nil {
+		return 0, err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			RaidIdle(name)
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+
+		if s, err = getRaidStatus(name); err != nil {
+			return 0, err
+		}
+
+		switch s.SyncAction {
+		case RaidActionCheck:
+			continue
+		case RaidActionIdle:
+			return s.MismatchCount, nil
+		default:
+			return 0, fmt.Errorf("Check of %s interrupted by sync action %q", name, s.SyncAction)
+		}
+	}
+}
+
+// A RaidScrubResult reports the outcome of a scheduled scrub of a raid device.
+type RaidScrubResult struct {
+	Name       string
+	Started    time.Time
+	Finished   time.Time
+	Mismatches uint64 // Mismatch count reported by the check
+	Err        error  // Set if the check failed or could not be started
+}
+
+// ScheduleRaidScrub runs a "check" scrub of a raid device immediately, and then repeatedly at the
+// specified period, reporting the result of each check on the returned channel. The status is
+// polled at the specified interval while a check is running. The channel is closed once ctx is
+// done. If period or interval is not positive, a single result reporting the error is sent, and
+// the channel is closed.
+func ScheduleRaidScrub(ctx context.Context, name string, period, interval time.Duration) <-chan RaidScrubResult {
+	if period <= 0 || interval <= 0 {
+		results := make(chan RaidScrubResult, 1)
+		now := time.Now()
+		results <- RaidScrubResult{
+			Name:     name,
+			Started:  now,
+			Finished: now,
+			Err:      fmt.Errorf("Invalid scrub period %v or poll interval %v", period, interval),
+		}
+		close(results)
+
+		return results
+	}
+
+	results := make(chan RaidScrubResult)
+
+	go func() {
+		defer close(results)
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			res := RaidScrubResult{Name: name, Started: time.Now()}
+			res.Mismatches, res.Err = RaidScrub(ctx, name, interval)
+			res.Finished = time.Now()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			select {
+			case results <- res:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return results
+}
@@ -0,0 +1,42 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-raid scrubbing.
+
+package devmapper
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRaidScrubErrors(t *testing.T) {
+	for _, d := range []struct {
+		period, interval time.Duration
+	}{
+		{0, time.Second},
+		{-time.Hour, time.Second},
+		{time.Hour, 0},
+		{time.Hour, -time.Second},
+	} {
+		if d.period > 0 {
+			if _, err := RaidScrub(context.Background(), "nonexistent", d.interval); err == nil {
+				t.Errorf("RaidScrub: expected error for interval %v", d.interval)
+			}
+		}
+
+		results := ScheduleRaidScrub(context.Background(), "nonexistent", d.period, d.interval)
+
+		if res, ok := <-results; !ok || res.Err == nil {
+			t.Errorf("ScheduleRaidScrub: expected error result for period %v, interval %v", d.period, d.interval)
+		}
+
+		if _, ok := <-results; ok {
+			t.Errorf("ScheduleRaidScrub: expected channel to be closed for period %v, interval %v",
+				d.period, d.interval)
+		}
+	}
+}
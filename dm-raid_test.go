@@ -0,0 +1,96 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-raid status parser.
+
+package devmapper
+
+import "testing"
+
+func TestParseRaidStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected RaidStatus
+		healthy  bool
+	}{
+		{
+			`raid5_ls 4 AAaA 1048576/3145728 recover 0 2048 A`,
+			RaidStatus{
+				RaidType:    "raid5_ls",
+				Devices:     4,
+				Health:      "AAaA",
+				SyncCurrent: 1048576,
+				SyncTotal:   3145728,
+				SyncAction:  RaidActionRecover,
+				DataOffset:  2048,
+				Journal:     "A",
+			},
+			false,
+		},
+		{
+			`raid1 2 AA 2097152/2097152 idle 128 0 -`,
+			RaidStatus{
+				RaidType:      "raid1",
+				Devices:       2,
+				Health:        "AA",
+				SyncCurrent:   2097152,
+				SyncTotal:     2097152,
+				SyncAction:    RaidActionIdle,
+				MismatchCount: 128,
+				Journal:       "-",
+			},
+			true,
+		},
+		{
+			`raid6_zr 5 AAAAA 4194304/4194304 idle 0 0 D`,
+			RaidStatus{
+				RaidType:    "raid6_zr",
+				Devices:     5,
+				Health:      "AAAAA",
+				SyncCurrent: 4194304,
+				SyncTotal:   4194304,
+				SyncAction:  RaidActionIdle,
+				Journal:     "D",
+			},
+			false,
+		},
+		{
+			// Kernels before dm-raid 1.9.0 report neither data offset nor journal state
+			`raid10 4 ADAA 1024/2048 check 12`,
+			RaidStatus{
+				RaidType:      "raid10",
+				Devices:       4,
+				Health:        "ADAA",
+				SyncCurrent:   1024,
+				SyncTotal:     2048,
+				SyncAction:    RaidActionCheck,
+				MismatchCount: 12,
+			},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		s, err := parseRaidStatus(test.params)
+		if err != nil {
+			t.Errorf("%q: %s", test.params, err)
+			continue
+		}
+
+		status := s.(*RaidStatus)
+
+		if *status != test.expected {
+			t.Errorf("Got %+v, expected %+v", *status, test.expected)
+		}
+
+		if status.Healthy() != test.healthy {
+			t.Errorf("%q: Healthy() = %t, expected %t", test.params, status.Healthy(), test.healthy)
+		}
+	}
+
+	for _, params := range []string{`raid1 2 AA 1024`, `raid1 2 AA 1024/2048 idle x`, `raid1 2 AA 1024/2048 idle 0 x`} {
+		if _, err := parseRaidStatus(params); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
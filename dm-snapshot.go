@@ -0,0 +1,184 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-snapshot Table Builders and Status Parser.
+// See dm-snapshot documentation at: https://www.kernel.org/doc/Documentation/device-mapper/snapshot.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SnapshotMode specifies whether a snapshot's exception store survives a reboot.
+type SnapshotMode string
+
+const (
+	SnapshotPersistent         SnapshotMode = "P"  // Exceptions are stored on the COW device
+	SnapshotPersistentOverflow SnapshotMode = "PO" // Persistent, and reports "Overflow" when full
+	SnapshotTransient          SnapshotMode = "N"  // Exceptions are kept in memory only
+)
+
+// SnapshotStatus represents the status of a snapshot or snapshot-merge target.
+type SnapshotStatus struct {
+	Invalid          bool   // Snapshot has been invalidated, and no other fields are valid
+	MergeFailed      bool   // Merging the snapshot into its origin failed, and no other fields are valid
+	Overflow         bool   // Snapshot COW device is full, and no other fields are valid
+	AllocatedSectors uint64 // Number of sectors allocated in the COW device, including metadata
+	TotalSectors     uint64 // Total number of sectors in the COW device
+	MetadataSectors  uint64 // Number of sectors used for metadata
+}
+
+func parseSnapshotStatus(params string) (interface{}, error) {
+	var (
+		s   SnapshotStatus
+		err error
+	)
+
+	switch params {
+	case "Invalid":
+		s.Invalid = true
+		return &s, nil
+	case "Merge failed":
+		s.MergeFailed = true
+		return &s, nil
+	case "Overflow":
+		s.Overflow = true
+		return &s, nil
+	}
+
+	r := newFieldReader(params)
+
+	if s.AllocatedSectors, s.TotalSectors, err = r.ratio(); err != nil {
+		return nil, err
+	}
+
+	if s.MetadataSectors, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// SnapshotOriginTarget is a snapshot-origin target, which maps an origin device and copies any
+// blocks about to be overwritten to the COW devices of the origin's snapshots.
+type SnapshotOriginTarget struct {
+	Start  uint64 // Start sector of target
+	Length uint64 // Length of target in sectors
+	Origin string // Origin device path, or major:minor
+}
+
+// Marshal returns the table target for a snapshot-origin.
+func (t SnapshotOriginTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.Origin); err != nil {
+		return dmTarget{}, err
+	}
+
+	return dmTarget{t.Start, t.Length, "snapshot-origin", t.Origin}, nil
+}
+
+// Unmarshal parses a snapshot-origin table target, as returned by GetDeviceTable.
+func (t *SnapshotOriginTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "snapshot-origin"); err != nil {
+		return err
+	}
+
+	fields := strings.Fields(target.Params)
+	if len(fields) != 1 {
+		return fmt.Errorf("Unexpected snapshot-origin parameters %q", target.Params)
+	}
+
+	*t = SnapshotOriginTarget{target.Start, target.Length, fields[0]}
+
+	return nil
+}
+
+// SnapshotTarget is a snapshot or snapshot-merge target. A snapshot presents the state of its
+// origin at the time the snapshot was taken, and stores changed blocks on a COW device. A
+// snapshot-merge target merges the changes back into the origin.
+type SnapshotTarget struct {
+	Start     uint64       // Start sector of target
+	Length    uint64       // Length of target in sectors
+	Origin    string       // Origin device path, or major:minor
+	COWDev    string       // COW device path, or major:minor
+	Mode      SnapshotMode // Persistence of exception store
+	ChunkSize uint64       // Granularity of copied blocks in sectors; a power of two
+	Merge     bool         // Build a snapshot-merge target rather than a snapshot target
+}
+
+func (t SnapshotTarget) targetType() string {
+	if t.Merge {
+		return "snapshot-merge"
+	}
+
+	return "snapshot"
+}
+
+// Marshal returns the table target for a snapshot or snapshot-merge.
+func (t SnapshotTarget) Marshal() (dmTarget, error) {
+	for _, dev := range []string{t.Origin, t.COWDev} {
+		if err := checkDevice(dev); err != nil {
+			return dmTarget{}, err
+		}
+	}
+
+	switch t.Mode {
+	case SnapshotPersistent, SnapshotPersistentOverflow, SnapshotTransient:
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid snapshot mode %q", t.Mode)
+	}
+
+	if t.ChunkSize == 0 || t.ChunkSize&(t.ChunkSize-1) != 0 {
+		return dmTarget{}, fmt.Errorf("Invalid snapshot chunk size %d", t.ChunkSize)
+	}
+
+	params := fmt.Sprintf("%s %s %s %d", t.Origin, t.COWDev, t.Mode, t.ChunkSize)
+
+	return dmTarget{t.Start, t.Length, t.targetType(), params}, nil
+}
+
+// Unmarshal parses a snapshot or snapshot-merge table target, as returned by GetDeviceTable.
+func (t *SnapshotTarget) Unmarshal(target dmTarget) error {
+	var (
+		s   SnapshotTarget
+		err error
+	)
+
+	switch target.Type {
+	case "snapshot":
+	case "snapshot-merge":
+		s.Merge = true
+	default:
+		return fmt.Errorf("Target type is %q, expected snapshot or snapshot-merge", target.Type)
+	}
+
+	r := newFieldReader(target.Params)
+
+	for _, dev := range []*string{&s.Origin, &s.COWDev} {
+		if *dev, err = r.next(); err != nil {
+			return err
+		}
+	}
+
+	mode, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	// Older kernels and tools accept lower case modes
+	s.Mode = SnapshotMode(strings.ToUpper(mode))
+
+	if s.ChunkSize, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected %s parameters %q", target.Type, target.Params)
+	}
+
+	s.Start, s.Length = target.Start, target.Length
+	*t = s
+
+	return nil
+}
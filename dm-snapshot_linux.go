@@ -0,0 +1,130 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Snapshot creation.
+
+package devmapper
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// TakeSnapshot creates a snapshot named snapshot of the device named origin, storing changed
+// blocks on cowDev. If the origin does not yet have any snapshots, its current table is moved to
+// a new device named "<origin>-real", and the origin is reloaded as a snapshot-origin of it. The
+// origin is suspended while the snapshot is created, so that the snapshot is consistent.
+func TakeSnapshot(origin, snapshot, cowDev string, mode SnapshotMode, chunkSize uint64) error {
+	info, err := GetDeviceInfo(origin)
+	if err != nil {
+		return err
+	}
+
+	// The table is copied to the real device, so must include any crypt keys
+	table, err := GetDeviceTableWithKeys(origin)
+	if err != nil {
+		return err
+	}
+
+	var (
+		length     uint64
+		realDev    string
+		originLoad []dmTarget
+		cleanup    []string // Devices to be removed if snapshot creation fails
+	)
+
+	for _, t := range table {
+		length += t.Length
+	}
+
+	// fail removes any devices created so far, most recent first, and returns err, along with
+	// any errors encountered while cleaning up.
+	fail := func(err error) error {
+		for x := len(cleanup) - 1; x >= 0; x-- {
+			if rerr := RemoveDevice(cleanup[x], false); rerr != nil {
+				return fmt.Errorf("%s; cannot remove %s - %s", err, cleanup[x], rerr)
+			}
+		}
+
+		return err
+	}
+
+	var so SnapshotOriginTarget
+
+	if len(table) == 1 && so.Unmarshal(table[0]) == nil {
+		// Origin already has snapshots
+		realDev = so.Origin
+	} else {
+		// Move the origin's table to a new device, which the snapshot-origin target will map
+		realName := origin + "-real"
+		if err := validateName("name", realName, unix.DM_NAME_LEN); err != nil {
+			return err
+		}
+
+		if err := CreateDevice(realName, "", table, info.ReadOnly); err != nil {
+			return err
+		}
+
+		cleanup = append(cleanup, realName)
+
+		realInfo, err := GetDeviceInfo(realName)
+		if err != nil {
+			return fail(err)
+		}
+
+		realDev = DevNo(realInfo.Major, realInfo.Minor)
+
+		target, err := SnapshotOriginTarget{0, length, realDev}.Marshal()
+		if err != nil {
+			return fail(err)
+		}
+
+		originLoad = []dmTarget{target}
+	}
+
+	snapTarget, err := SnapshotTarget{0, length, realDev, cowDev, mode, chunkSize, false}.Marshal()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := SuspendDevice(origin, false); err != nil {
+		return fail(err)
+	}
+
+	// failSuspended discards any snapshot-origin table queued for the origin, and resumes it with
+	// its original table, before removing the devices created so far.
+	failSuspended := func(err error) error {
+		if originLoad != nil {
+			if cerr := ClearInactiveTable(origin); cerr != nil {
+				return fmt.Errorf("%s; cannot clear inactive table of %s - %s", err, origin, cerr)
+			}
+		}
+
+		if rerr := ResumeDevice(origin); rerr != nil {
+			return fmt.Errorf("%s; cannot resume %s - %s", err, origin, rerr)
+		}
+
+		return fail(err)
+	}
+
+	if err := CreateDevice(snapshot, "", []dmTarget{snapTarget}, false); err != nil {
+		return failSuspended(err)
+	}
+
+	cleanup = append(cleanup, snapshot)
+
+	if originLoad != nil {
+		if err := LoadTable(origin, originLoad, info.ReadOnly); err != nil {
+			return failSuspended(err)
+		}
+	}
+
+	if err := ResumeDevice(origin); err != nil {
+		return failSuspended(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for snapshot creation.
+
+package devmapper
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTakeSnapshot(t *testing.T) {
+	requireDM(t)
+
+	if _, err := GetTargetVersion("snapshot"); err != nil {
+		t.Skip("Snapshot target not available:", err)
+	}
+
+	base := newTestLoopDev(t, 16*(1<<20))
+	defer base.Close()
+
+	cow := newTestLoopDev(t, 8*(1<<20))
+	defer cow.Close()
+
+	origin, snap := testDeviceName(), testDeviceName()
+
+	if err := CreateDevice(origin, "", []dmTarget{{0, 32768, "linear", base.path + " 0"}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(origin+"-real", false)
+	defer RemoveDevice(origin, false)
+
+	before := bytes.Repeat([]byte{0x11}, 4096)
+	after := bytes.Repeat([]byte{0x22}, 4096)
+
+	writeBlock := func(name string, b []byte) {
+		f, err := os.OpenFile("/dev/mapper/"+name, os.O_WRONLY|os.O_SYNC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeBlock(origin, before)
+
+	// A failed snapshot leaves the origin as it was
+	if err := TakeSnapshot(origin, snap, "/dev/nonexistent", SnapshotPersistent, 8); err == nil {
+		t.Fatal("Expected error for nonexistent COW device")
+	}
+
+	if info, err := GetDeviceInfo(origin); err != nil {
+		t.Fatal(err)
+	} else if info.Suspended || info.InactiveTable {
+		t.Errorf("Origin left suspended or with an inactive table: %+v", info)
+	}
+
+	for _, name := range []string{snap, origin + "-real"} {
+		if _, err := GetDeviceInfo(name); err != ErrDeviceNotFound {
+			t.Errorf("Device %s not removed after failed snapshot (%v)", name, err)
+		}
+	}
+
+	// The "-real" device name would exceed DM_NAME_LEN
+	long := origin + strings.Repeat("x", 125-len(origin))
+	if err := CreateDevice(long, "", []dmTarget{{0, 8, "zero", ""}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(long, false)
+
+	if err := TakeSnapshot(long, snap, cow.path, SnapshotPersistent, 8); err == nil {
+		t.Error("Expected error for origin name too long for a -real device")
+	} else if info, err := GetDeviceInfo(long); err != nil || info.Suspended {
+		t.Errorf("Origin with long name left suspended (%v)", err)
+	}
+
+	if err := TakeSnapshot(origin, snap, cow.path, SnapshotPersistent, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(snap, false)
+
+	writeBlock(origin, after)
+
+	f, err := os.Open("/dev/mapper/" + snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	got := make([]byte, len(before))
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, before) {
+		t.Error("Snapshot does not contain original data")
+	}
+
+	table, err := GetDeviceTable(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(table) != 1 || table[0].Type != "snapshot-origin" {
+		t.Errorf("Unexpected origin table %+v", table)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-snapshot table builders and status parser.
+
+package devmapper
+
+import "testing"
+
+func TestParseSnapshotStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected SnapshotStatus
+	}{
+		{`0/2097152 0`, SnapshotStatus{TotalSectors: 2097152}},
+		{`4096/2097152 16`, SnapshotStatus{AllocatedSectors: 4096, TotalSectors: 2097152, MetadataSectors: 16}},
+		{`Invalid`, SnapshotStatus{Invalid: true}},
+		{`Merge failed`, SnapshotStatus{MergeFailed: true}},
+		{`Overflow`, SnapshotStatus{Overflow: true}},
+	}
+
+	for _, test := range tests {
+		s, err := parseSnapshotStatus(test.params)
+		if err != nil {
+			t.Errorf("%q: %s", test.params, err)
+			continue
+		}
+
+		if *s.(*SnapshotStatus) != test.expected {
+			t.Errorf("Got %+v, expected %+v", *s.(*SnapshotStatus), test.expected)
+		}
+	}
+
+	for _, params := range []string{``, `Merge`, `4096 16`, `4096/2097152`} {
+		if _, err := parseSnapshotStatus(params); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
+
+func TestSnapshotTargets(t *testing.T) {
+	origin := SnapshotOriginTarget{0, 2097152, "253:7"}
+
+	target, err := origin.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (dmTarget{0, 2097152, "snapshot-origin", "253:7"}); target != expected {
+		t.Errorf("Got %+v, expected %+v", target, expected)
+	}
+
+	var parsedOrigin SnapshotOriginTarget
+	if err := parsedOrigin.Unmarshal(target); err != nil || parsedOrigin != origin {
+		t.Errorf("Got %+v, %v, expected %+v", parsedOrigin, err, origin)
+	}
+
+	for _, snap := range []SnapshotTarget{
+		{0, 2097152, "253:7", "/dev/vg0/snap-cow", SnapshotPersistent, 8, false},
+		{0, 2097152, "253:7", "253:9", SnapshotPersistentOverflow, 16, false},
+		{0, 2097152, "253:7", "253:9", SnapshotTransient, 128, false},
+		{0, 2097152, "253:7", "253:9", SnapshotPersistent, 8, true},
+	} {
+		target, err := snap.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var parsed SnapshotTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed != snap {
+			t.Errorf("Got %+v, expected %+v", parsed, snap)
+		}
+	}
+
+	target, _ = SnapshotTarget{0, 8, "253:7", "253:9", SnapshotPersistent, 8, true}.Marshal()
+	if expected := (dmTarget{0, 8, "snapshot-merge", "253:7 253:9 P 8"}); target != expected {
+		t.Errorf("Got %+v, expected %+v", target, expected)
+	}
+
+	for _, snap := range []SnapshotTarget{
+		{0, 8, "253:7", "253:9", "X", 8, false},
+		{0, 8, "253:7", "253:9", SnapshotPersistent, 0, false},
+		{0, 8, "253:7", "253:9", SnapshotPersistent, 12, false},
+		{0, 8, "253:7", "", SnapshotPersistent, 8, false},
+	} {
+		if _, err := snap.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", snap)
+		}
+	}
+
+	var parsed SnapshotTarget
+	if err := parsed.Unmarshal(dmTarget{0, 8, "linear", "253:7 0"}); err == nil {
+		t.Error("Expected error for linear target")
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-stats Region, Counter Parser and Rates.
+// See dm-stats documentation at: https://www.kernel.org/doc/Documentation/device-mapper/statistics.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A StatsRegion is a range of a device for which I/O statistics are collected. A region is
+// divided into areas of equal size (the last possibly smaller), each with its own counters.
+type StatsRegion struct {
+	ID                uint64          // Region ID assigned by the kernel
+	Start             uint64          // Start sector of region
+	Length            uint64          // Length of region in sectors; the whole device if zero when creating
+	Step              uint64          // Area size in sectors; see also Areas
+	Areas             uint64          // When creating, the number of areas if Step is zero; one if both are zero
+	ProgramID         string          // Identifies the program which created the region; optional
+	AuxData           string          // Arbitrary data associated with the region; optional
+	PreciseTimestamps bool            // Time counters have nanosecond rather than millisecond resolution
+	Histogram         []time.Duration // Latency histogram bucket boundaries, in increasing order; optional
+}
+
+// checkStatsWord returns an error if s cannot be used as a single word of a stats message.
+func checkStatsWord(field, s string) error {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' }) >= 0 {
+		return fmt.Errorf("Invalid stats %s %q", field, s)
+	}
+
+	return nil
+}
+
+// createMessage returns the @stats_create message for r.
+func (r StatsRegion) createMessage() (string, error) {
+	args := []string{"@stats_create"}
+
+	if r.Length == 0 {
+		args = append(args, "-")
+	} else {
+		args = append(args, fmt.Sprintf("%d+%d", r.Start, r.Length))
+	}
+
+	switch {
+	case r.Step != 0:
+		args = append(args, strconv.FormatUint(r.Step, 10))
+	case r.Areas != 0:
+		args = append(args, fmt.Sprintf("/%d", r.Areas))
+	default:
+		args = append(args, "/1")
+	}
+
+	var features []string
+
+	if r.PreciseTimestamps {
+		features = append(features, "precise_timestamps")
+	}
+
+	if len(r.Histogram) > 0 {
+		bounds := make([]string, len(r.Histogram))
+
+		for x, d := range r.Histogram {
+			if d <= 0 || (x > 0 && d <= r.Histogram[x-1]) {
+				return "", fmt.Errorf("Histogram boundaries must be positive and increasing")
+			}
+
+			if r.PreciseTimestamps {
+				bounds[x] = strconv.FormatInt(d.Nanoseconds(), 10)
+			} else if d%time.Millisecond != 0 {
+				return "", fmt.Errorf("Histogram boundary %s requires precise timestamps", d)
+			} else {
+				bounds[x] = strconv.FormatInt(int64(d/time.Millisecond), 10)
+			}
+		}
+
+		features = append(features, "histogram:"+strings.Join(bounds, ","))
+	}
+
+	// The feature count is always given if a program ID follows, so that a numeric program ID
+	// is not mistaken for it.
+	if len(features) > 0 || r.ProgramID != "" || r.AuxData != "" {
+		args = append(args, strconv.Itoa(len(features)))
+		args = append(args, features...)
+	}
+
+	if r.ProgramID != "" || r.AuxData != "" {
+		programID := r.ProgramID
+		if programID == "" {
+			programID = "-"
+		}
+
+		if err := checkStatsWord("program ID", programID); err != nil {
+			return "", err
+		}
+
+		args = append(args, programID)
+	}
+
+	if r.AuxData != "" {
+		if err := checkStatsWord("aux data", r.AuxData); err != nil {
+			return "", err
+		}
+
+		args = append(args, r.AuxData)
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+// parseStatsList parses the response to a @stats_list message, which contains one line per
+// region, e.g. "0: 0+2097152 262144 myprog - precise_timestamps histogram:1000,2000".
+func parseStatsList(res string) ([]StatsRegion, error) {
+	var regions []StatsRegion
+
+	for _, line := range strings.Split(res, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var (
+			s   StatsRegion
+			err error
+		)
+
+		r := newFieldReader(line)
+
+		id, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if s.ID, err = strconv.ParseUint(strings.TrimSuffix(id, ":"), 10, 64); err != nil || !strings.HasSuffix(id, ":") {
+			return nil, fmt.Errorf("Invalid stats region ID %q", id)
+		}
+
+		rng, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if s.Start, s.Length, err = parseStatsRange(rng); err != nil {
+			return nil, err
+		}
+
+		if s.Step, err = r.uint64(); err != nil {
+			return nil, err
+		}
+
+		if s.ProgramID, err = r.next(); err != nil {
+			return nil, err
+		}
+
+		if s.AuxData, err = r.next(); err != nil {
+			return nil, err
+		}
+
+		if s.ProgramID == "-" {
+			s.ProgramID = ""
+		}
+
+		if s.AuxData == "-" {
+			s.AuxData = ""
+		}
+
+		var bounds []string
+
+		for r.more() {
+			f, _ := r.next()
+
+			switch {
+			case f == "precise_timestamps":
+				s.PreciseTimestamps = true
+			case strings.HasPrefix(f, "histogram:"):
+				bounds = strings.Split(strings.TrimPrefix(f, "histogram:"), ",")
+			default:
+				return nil, fmt.Errorf("Unknown stats region feature %q", f)
+			}
+		}
+
+		// Histogram boundaries are in the same units as the time counters
+		unit := time.Millisecond
+		if s.PreciseTimestamps {
+			unit = time.Nanosecond
+		}
+
+		for _, b := range bounds {
+			n, err := strconv.ParseUint(b, 10, 63)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid histogram boundary %q", b)
+			}
+
+			s.Histogram = append(s.Histogram, time.Duration(n)*unit)
+		}
+
+		regions = append(regions, s)
+	}
+
+	return regions, nil
+}
+
+// parseStatsRange parses a "<start>+<length>" sector range.
+func parseStatsRange(s string) (start, length uint64, err error) {
+	x := strings.IndexByte(s, '+')
+	if x < 0 {
+		return 0, 0, fmt.Errorf("Invalid stats range %q", s)
+	}
+
+	if start, err = strconv.ParseUint(s[:x], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Invalid stats range %q", s)
+	}
+
+	if length, err = strconv.ParseUint(s[x+1:], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Invalid stats range %q", s)
+	}
+
+	return start, length, nil
+}
+
+// StatsCounters are the I/O counters of a single area of a dm-stats region. Time counters are
+// reported by the kernel in milliseconds, or nanoseconds if the region has precise timestamps.
+type StatsCounters struct {
+	Start           uint64        // Start sector of area
+	Length          uint64        // Length of area in sectors
+	ReadsCompleted  uint64        // Number of reads completed
+	ReadsMerged     uint64        // Number of reads merged
+	SectorsRead     uint64        // Number of sectors read
+	ReadTime        time.Duration // Time spent reading, summed over all reads
+	WritesCompleted uint64        // Number of writes completed
+	WritesMerged    uint64        // Number of writes merged
+	SectorsWritten  uint64        // Number of sectors written
+	WriteTime       time.Duration // Time spent writing, summed over all writes
+	InFlight        uint64        // Number of I/Os currently in progress
+	IOTime          time.Duration // Time during which I/Os were in progress
+	WeightedIOTime  time.Duration // Time spent doing I/Os, weighted by the number in progress
+	TotalReadTime   time.Duration // Time during which reads were in progress
+	TotalWriteTime  time.Duration // Time during which writes were in progress
+	Histogram       []uint64      // Number of I/Os in each latency histogram bucket; optional
+}
+
+// A StatsSample is the counters of every area of a dm-stats region, and the time at which they
+// were read.
+type StatsSample struct {
+	Time    time.Time
+	Region  StatsRegion
+	Areas   []StatsCounters
+	Cleared bool // Counters were reset when the sample was taken, by StatsPrintClear
+}
+
+// parseStatsPrint parses the response to a @stats_print message, which contains one line of
+// counters per area.
+func parseStatsPrint(res string, precise bool) ([]StatsCounters, error) {
+	var areas []StatsCounters
+
+	unit := time.Millisecond
+	if precise {
+		unit = time.Nanosecond
+	}
+
+	for _, line := range strings.Split(res, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var (
+			c   StatsCounters
+			err error
+		)
+
+		r := newFieldReader(line)
+
+		rng, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Start, c.Length, err = parseStatsRange(rng); err != nil {
+			return nil, err
+		}
+
+		var ms [6]uint64
+
+		fields := []*uint64{
+			&c.ReadsCompleted, &c.ReadsMerged, &c.SectorsRead, &ms[0],
+			&c.WritesCompleted, &c.WritesMerged, &c.SectorsWritten, &ms[1],
+			&c.InFlight, &ms[2], &ms[3], &ms[4], &ms[5],
+		}
+
+		times := []*time.Duration{
+			&c.ReadTime, &c.WriteTime, &c.IOTime, &c.WeightedIOTime, &c.TotalReadTime, &c.TotalWriteTime,
+		}
+
+		// The total read and write times were added in a later kernel
+		nFields := len(fields)
+		if len(r.fields)-r.pos < nFields {
+			nFields -= 2
+		}
+
+		for _, p := range fields[:nFields] {
+			if *p, err = r.uint64(); err != nil {
+				return nil, err
+			}
+		}
+
+		for x, p := range times {
+			*p = time.Duration(ms[x]) * unit
+		}
+
+		if r.more() {
+			hist, _ := r.next()
+
+			for _, b := range strings.Split(hist, ":") {
+				n, err := strconv.ParseUint(b, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid histogram %q", hist)
+				}
+
+				c.Histogram = append(c.Histogram, n)
+			}
+		}
+
+		if r.more() {
+			return nil, fmt.Errorf("Unexpected stats counters %q", line)
+		}
+
+		areas = append(areas, c)
+	}
+
+	return areas, nil
+}
+
+// StatsRates contains the rates of change of the counters of a dm-stats area between two
+// samples.
+type StatsRates struct {
+	Start           uint64        // Start sector of area
+	Length          uint64        // Length of area in sectors
+	Interval        time.Duration // Time between samples
+	ReadIOPS        float64       // Reads completed per second
+	WriteIOPS       float64       // Writes completed per second
+	ReadThroughput  float64       // Bytes read per second
+	WriteThroughput float64       // Bytes written per second
+	Utilization     float64       // Fraction of the interval during which I/Os were in progress, 0 to 1
+	AvgQueueSize    float64       // Average number of I/Os in progress
+	AvgReadLatency  time.Duration // Average time per read completed
+	AvgWriteLatency time.Duration // Average time per write completed
+	Histogram       []uint64      // Number of I/Os added to each latency histogram bucket
+}
+
+// StatsRatesBetween computes the rates of change of the counters of each area of a dm-stats
+// region from an earlier and a later sample. If the earlier sample was taken with
+// StatsPrintClear, the later sample's counters are used as they are. ErrCounterReset is returned
+// if any counter decreased, or the region's areas changed, between the samples.
+func StatsRatesBetween(prev, cur StatsSample) ([]StatsRates, error) {
+	interval := cur.Time.Sub(prev.Time)
+	if interval <= 0 {
+		return nil, fmt.Errorf("Samples are not in chronological order")
+	}
+
+	if prev.Region.ID != cur.Region.ID || len(prev.Areas) != len(cur.Areas) {
+		return nil, ErrCounterReset
+	}
+
+	secs := interval.Seconds()
+	rates := make([]StatsRates, len(cur.Areas))
+
+	for x := range cur.Areas {
+		p, c := prev.Areas[x], cur.Areas[x]
+
+		if p.Start != c.Start || p.Length != c.Length || len(p.Histogram) != len(c.Histogram) {
+			return nil, ErrCounterReset
+		}
+
+		// Counters of a cleared sample start from zero
+		if prev.Cleared {
+			p = StatsCounters{Histogram: make([]uint64, len(c.Histogram))}
+		}
+
+		counters := [][2]uint64{
+			{p.ReadsCompleted, c.ReadsCompleted},
+			{p.WritesCompleted, c.WritesCompleted},
+			{p.SectorsRead, c.SectorsRead},
+			{p.SectorsWritten, c.SectorsWritten},
+			{uint64(p.IOTime), uint64(c.IOTime)},
+			{uint64(p.WeightedIOTime), uint64(c.WeightedIOTime)},
+			{uint64(p.ReadTime), uint64(c.ReadTime)},
+			{uint64(p.WriteTime), uint64(c.WriteTime)},
+		}
+
+		delta := make([]uint64, len(counters))
+
+		for i, n := range counters {
+			if n[1] < n[0] {
+				return nil, ErrCounterReset
+			}
+
+			delta[i] = n[1] - n[0]
+		}
+
+		r := StatsRates{
+			Start:           c.Start,
+			Length:          c.Length,
+			Interval:        interval,
+			ReadIOPS:        float64(delta[0]) / secs,
+			WriteIOPS:       float64(delta[1]) / secs,
+			ReadThroughput:  float64(delta[2]*512) / secs,
+			WriteThroughput: float64(delta[3]*512) / secs,
+			Utilization:     float64(delta[4]) / float64(interval),
+			AvgQueueSize:    float64(delta[5]) / float64(interval),
+		}
+
+		// Time counters are updated at I/O completion, so may slightly exceed the interval
+		if r.Utilization > 1 {
+			r.Utilization = 1
+		}
+
+		if delta[0] > 0 {
+			r.AvgReadLatency = time.Duration(delta[6] / delta[0])
+		}
+
+		if delta[1] > 0 {
+			r.AvgWriteLatency = time.Duration(delta[7] / delta[1])
+		}
+
+		if len(c.Histogram) > 0 {
+			r.Histogram = make([]uint64, len(c.Histogram))
+
+			for i := range c.Histogram {
+				if c.Histogram[i] < p.Histogram[i] {
+					return nil, ErrCounterReset
+				}
+
+				r.Histogram[i] = c.Histogram[i] - p.Histogram[i]
+			}
+		}
+
+		rates[x] = r
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,119 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-stats Region Management and Counter Retrieval.
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsCreate creates a dm-stats region on a device, and returns the region as reported by the
+// kernel, including its ID.
+func StatsCreate(name string, region StatsRegion) (*StatsRegion, error) {
+	message, err := region.createMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := SendMessage(name, 0, message)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(res), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected @stats_create response %q", res)
+	}
+
+	regions, err := StatsRegions(name, region.ProgramID)
+	if err != nil {
+		return nil, err
+	}
+
+	for x := range regions {
+		if regions[x].ID == id {
+			return &regions[x], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Stats region %d not found after creation", id)
+}
+
+// StatsDelete deletes a dm-stats region.
+func StatsDelete(name string, regionID uint64) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("@stats_delete %d", regionID))
+	return err
+}
+
+// StatsClear resets the counters of a dm-stats region, except for the number of I/Os in
+// progress.
+func StatsClear(name string, regionID uint64) error {
+	_, err := SendMessage(name, 0, fmt.Sprintf("@stats_clear %d", regionID))
+	return err
+}
+
+// StatsSetAux sets the aux data of a dm-stats region.
+func StatsSetAux(name string, regionID uint64, auxData string) error {
+	if err := checkStatsWord("aux data", auxData); err != nil {
+		return err
+	}
+
+	_, err := SendMessage(name, 0, fmt.Sprintf("@stats_set_aux %d %s", regionID, auxData))
+	return err
+}
+
+// StatsList returns the kernel's list of dm-stats regions of a device. If programID is not empty,
+// only regions created with that program ID are listed.
+func StatsList(name, programID string) (string, error) {
+	message := "@stats_list"
+
+	if programID != "" {
+		message += " " + programID
+	}
+
+	return SendMessage(name, 0, message)
+}
+
+// StatsRegions returns the parsed list of dm-stats regions of a device. If programID is not
+// empty, only regions created with that program ID are listed.
+func StatsRegions(name, programID string) ([]StatsRegion, error) {
+	res, err := StatsList(name, programID)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStatsList(res)
+}
+
+// StatsPrint returns the counters of every area of a dm-stats region. The region determines the
+// units of the time counters, and should be obtained from StatsCreate or StatsRegions.
+func StatsPrint(name string, region StatsRegion) (*StatsSample, error) {
+	return statsPrint(name, region, "@stats_print")
+}
+
+// StatsPrintClear returns the counters of every area of a dm-stats region, as with StatsPrint,
+// and atomically resets them.
+func StatsPrintClear(name string, region StatsRegion) (*StatsSample, error) {
+	return statsPrint(name, region, "@stats_print_clear")
+}
+
+func statsPrint(name string, region StatsRegion, message string) (*StatsSample, error) {
+	res, err := SendMessage(name, 0, fmt.Sprintf("%s %d", message, region.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	areas, err := parseStatsPrint(res, region.PreciseTimestamps)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsSample{time.Now(), region, areas, message == "@stats_print_clear"}, nil
+}
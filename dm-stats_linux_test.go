@@ -0,0 +1,79 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-stats region management.
+
+package devmapper
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatsRegion(t *testing.T) {
+	requireDM(t)
+
+	loop := newTestLoopDev(t, 16*(1<<20))
+	defer loop.Close()
+
+	name := testDeviceName()
+
+	if err := CreateDevice(name, "", []dmTarget{{0, 32768, "linear", loop.path + " 0"}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	region, err := StatsCreate(name, StatsRegion{Areas: 4, ProgramID: "devmapper-test",
+		Histogram: []time.Duration{time.Millisecond, 10 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if region.Length != 32768 || region.Step != 8192 || len(region.Histogram) != 2 {
+		t.Errorf("Unexpected region %+v", region)
+	}
+
+	f, err := os.OpenFile("/dev/mapper/"+name, os.O_WRONLY|os.O_SYNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(bytes.Repeat([]byte{0xa5}, 8192))
+	f.Close()
+
+	sample, err := StatsPrintClear(name, *region)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sample.Areas) != 4 || sample.Areas[0].SectorsWritten < 16 || len(sample.Areas[0].Histogram) != 3 {
+		t.Errorf("Unexpected counters %+v", sample.Areas)
+	}
+
+	if sample, err = StatsPrint(name, *region); err != nil {
+		t.Fatal(err)
+	} else if sample.Areas[0].SectorsWritten != 0 {
+		t.Errorf("Counters not cleared: %+v", sample.Areas[0])
+	}
+
+	if err := StatsSetAux(name, region.ID, "updated"); err != nil {
+		t.Fatal(err)
+	}
+
+	if regions, err := StatsRegions(name, "devmapper-test"); err != nil || len(regions) != 1 || regions[0].AuxData != "updated" {
+		t.Errorf("Got regions %+v (%v)", regions, err)
+	}
+
+	if err := StatsDelete(name, region.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if regions, err := StatsRegions(name, ""); err != nil || len(regions) != 0 {
+		t.Errorf("Got regions %+v (%v) after delete", regions, err)
+	}
+}
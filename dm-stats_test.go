@@ -0,0 +1,198 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-stats messages, counter parser and rates.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsCreateMessage(t *testing.T) {
+	tests := []struct {
+		region  StatsRegion
+		message string
+	}{
+		{StatsRegion{}, "@stats_create - /1"},
+		{StatsRegion{Start: 2048, Length: 4096, Step: 512}, "@stats_create 2048+4096 512"},
+		{StatsRegion{Areas: 8, ProgramID: "1234"}, "@stats_create - /8 0 1234"},
+		{StatsRegion{AuxData: "foo"}, "@stats_create - /1 0 - foo"},
+		{
+			StatsRegion{PreciseTimestamps: true, Histogram: []time.Duration{500 * time.Microsecond, time.Millisecond}},
+			"@stats_create - /1 2 precise_timestamps histogram:500000,1000000",
+		},
+		{
+			StatsRegion{Histogram: []time.Duration{time.Millisecond, 10 * time.Millisecond}, ProgramID: "test"},
+			"@stats_create - /1 1 histogram:1,10 test",
+		},
+	}
+
+	for _, test := range tests {
+		message, err := test.region.createMessage()
+		if err != nil {
+			t.Error(err)
+		} else if message != test.message {
+			t.Errorf("Got %q, expected %q", message, test.message)
+		}
+	}
+
+	for _, r := range []StatsRegion{
+		{Histogram: []time.Duration{500 * time.Microsecond}},
+		{Histogram: []time.Duration{2 * time.Millisecond, time.Millisecond}},
+		{ProgramID: "my program"},
+		{AuxData: "a b"},
+	} {
+		if _, err := r.createMessage(); err == nil {
+			t.Errorf("Expected error for %+v", r)
+		}
+	}
+}
+
+func TestParseStatsList(t *testing.T) {
+	res := "0: 0+2097152 262144 - -\n" +
+		"1: 2048+4096 4096 myprog aux precise_timestamps histogram:500000,1000000\n" +
+		"2: 0+2097152 2097152 test - histogram:1,10\n"
+
+	regions, err := parseStatsList(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StatsRegion{
+		{ID: 0, Start: 0, Length: 2097152, Step: 262144},
+		{ID: 1, Start: 2048, Length: 4096, Step: 4096, ProgramID: "myprog", AuxData: "aux", PreciseTimestamps: true,
+			Histogram: []time.Duration{500 * time.Microsecond, time.Millisecond}},
+		{ID: 2, Start: 0, Length: 2097152, Step: 2097152, ProgramID: "test",
+			Histogram: []time.Duration{time.Millisecond, 10 * time.Millisecond}},
+	}
+
+	if !reflect.DeepEqual(regions, expected) {
+		t.Errorf("Got %+v, expected %+v", regions, expected)
+	}
+
+	if regions, err := parseStatsList(""); err != nil || len(regions) != 0 {
+		t.Errorf("Got %+v (%v) for empty list", regions, err)
+	}
+
+	for _, res := range []string{"0 0+8 8 - -", "0: 0-8 8 - -", "0: 0+8 8 -", "0: 0+8 8 - - bogus"} {
+		if _, err := parseStatsList(res); err == nil {
+			t.Errorf("Expected error for %q", res)
+		}
+	}
+}
+
+func TestParseStatsPrint(t *testing.T) {
+	res := "0+1024 10 2 160 30 20 0 640 50 1 70 90 28 48\n" +
+		"1024+1024 0 0 0 0 0 0 0 0 0 0 0 0 0\n"
+
+	areas, err := parseStatsPrint(res, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StatsCounters{
+		{
+			Start: 0, Length: 1024,
+			ReadsCompleted: 10, ReadsMerged: 2, SectorsRead: 160, ReadTime: 30 * time.Millisecond,
+			WritesCompleted: 20, WritesMerged: 0, SectorsWritten: 640, WriteTime: 50 * time.Millisecond,
+			InFlight: 1, IOTime: 70 * time.Millisecond, WeightedIOTime: 90 * time.Millisecond,
+			TotalReadTime: 28 * time.Millisecond, TotalWriteTime: 48 * time.Millisecond,
+		},
+		{Start: 1024, Length: 1024},
+	}
+
+	if !reflect.DeepEqual(areas, expected) {
+		t.Errorf("Got %+v, expected %+v", areas, expected)
+	}
+
+	// Precise timestamps and histogram, with the older set of counters
+	areas, err = parseStatsPrint("0+8 1 0 8 1500 0 0 0 0 0 1500 1500 0:1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(areas) != 1 || areas[0].ReadTime != 1500 || areas[0].IOTime != 1500 ||
+		!reflect.DeepEqual(areas[0].Histogram, []uint64{0, 1, 0}) {
+		t.Errorf("Unexpected counters %+v", areas)
+	}
+
+	for _, res := range []string{"0+8 1 2 3", "0+8 1 0 8 1500 0 0 0 0 0 1500 1500 0:x", "x 1 0 8 1 0 0 0 0 0 1 1"} {
+		if _, err := parseStatsPrint(res, false); err == nil {
+			t.Errorf("Expected error for %q", res)
+		}
+	}
+}
+
+func TestStatsRatesBetween(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	region := StatsRegion{ID: 3, Length: 1024, Step: 1024, Histogram: []time.Duration{time.Millisecond}}
+
+	prev := StatsSample{t0, region, []StatsCounters{{
+		Length: 1024, ReadsCompleted: 100, SectorsRead: 800, ReadTime: time.Second,
+		WritesCompleted: 50, SectorsWritten: 400, WriteTime: time.Second,
+		IOTime: time.Second, WeightedIOTime: 2 * time.Second, Histogram: []uint64{100, 50},
+	}}, false}
+
+	cur := StatsSample{t0.Add(10 * time.Second), region, []StatsCounters{{
+		Length: 1024, ReadsCompleted: 600, SectorsRead: 4800, ReadTime: 2 * time.Second,
+		WritesCompleted: 150, SectorsWritten: 2400, WriteTime: 3 * time.Second,
+		IOTime: 6 * time.Second, WeightedIOTime: 17 * time.Second, Histogram: []uint64{500, 250},
+	}}, false}
+
+	rates, err := StatsRatesBetween(prev, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StatsRates{{
+		Length:          1024,
+		Interval:        10 * time.Second,
+		ReadIOPS:        50,
+		WriteIOPS:       10,
+		ReadThroughput:  204800,
+		WriteThroughput: 102400,
+		Utilization:     0.5,
+		AvgQueueSize:    1.5,
+		AvgReadLatency:  2 * time.Millisecond,
+		AvgWriteLatency: 20 * time.Millisecond,
+		Histogram:       []uint64{400, 200},
+	}}
+
+	if !reflect.DeepEqual(rates, expected) {
+		t.Errorf("Got %+v, expected %+v", rates, expected)
+	}
+
+	// After a clear, the later sample contains only the deltas
+	prev.Cleared = true
+	cur.Areas[0] = StatsCounters{Length: 1024, ReadsCompleted: 500, SectorsRead: 4000, ReadTime: time.Second,
+		WritesCompleted: 100, SectorsWritten: 2000, WriteTime: 2 * time.Second, IOTime: 5 * time.Second,
+		WeightedIOTime: 15 * time.Second, Histogram: []uint64{400, 200}}
+
+	if rates, err = StatsRatesBetween(prev, cur); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rates, expected) {
+		t.Errorf("Got %+v, expected %+v", rates, expected)
+	}
+
+	// Counters reset by a reload
+	prev.Cleared = false
+	cur.Areas[0].ReadsCompleted = 50
+
+	if _, err := StatsRatesBetween(prev, cur); err != ErrCounterReset {
+		t.Errorf("Got %v, expected ErrCounterReset", err)
+	}
+
+	if _, err := StatsRatesBetween(cur, prev); err == nil {
+		t.Error("Expected error for samples in reverse order")
+	}
+
+	other := cur
+	other.Region.ID = 4
+
+	if _, err := StatsRatesBetween(prev, other); err != ErrCounterReset {
+		t.Errorf("Got %v, expected ErrCounterReset", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-stripe Table Builder and Parser.
+// See dm-stripe documentation at: https://www.kernel.org/doc/Documentation/device-mapper/striped.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Stripe is one of the devices of a striped target.
+type Stripe struct {
+	Device string // Device path, or major:minor
+	Offset uint64 // Start sector on device
+}
+
+// StripedTarget stripes a range of a device across multiple underlying devices.
+type StripedTarget struct {
+	Start     uint64 // Start sector of target
+	Length    uint64 // Length of target in sectors, a multiple of ChunkSize times the stripe count
+	ChunkSize uint64 // Number of sectors written to each stripe before moving to the next
+	Stripes   []Stripe
+}
+
+// Marshal returns the table target for a striped mapping.
+func (t StripedTarget) Marshal() (dmTarget, error) {
+	if len(t.Stripes) == 0 {
+		return dmTarget{}, fmt.Errorf("Striped target has no stripes")
+	}
+
+	if t.ChunkSize == 0 {
+		return dmTarget{}, fmt.Errorf("Invalid chunk size %d", t.ChunkSize)
+	}
+
+	if t.Length%(t.ChunkSize*uint64(len(t.Stripes))) != 0 {
+		return dmTarget{}, fmt.Errorf("Target length %d is not a multiple of %d stripes of %d sectors",
+			t.Length, len(t.Stripes), t.ChunkSize)
+	}
+
+	params := []string{fmt.Sprintf("%d %d", len(t.Stripes), t.ChunkSize)}
+
+	for _, s := range t.Stripes {
+		if err := checkDevice(s.Device); err != nil {
+			return dmTarget{}, err
+		}
+
+		params = append(params, fmt.Sprintf("%s %d", s.Device, s.Offset))
+	}
+
+	return dmTarget{t.Start, t.Length, "striped", strings.Join(params, " ")}, nil
+}
+
+// Unmarshal parses a striped table target, as returned by GetDeviceTable.
+func (t *StripedTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "striped"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	n, err := r.int()
+	if err != nil {
+		return err
+	}
+
+	chunkSize, err := r.uint64()
+	if err != nil {
+		return err
+	}
+
+	// Each stripe consists of a device and an offset
+	if n < 1 || n > (len(r.fields)-r.pos)/2 {
+		return fmt.Errorf("Invalid stripe count %d", n)
+	}
+
+	stripes := make([]Stripe, n)
+
+	for x := range stripes {
+		if stripes[x].Device, err = r.next(); err != nil {
+			return err
+		}
+
+		if stripes[x].Offset, err = r.uint64(); err != nil {
+			return err
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected striped parameters %q", target.Params)
+	}
+
+	*t = StripedTarget{target.Start, target.Length, chunkSize, stripes}
+
+	return nil
+}
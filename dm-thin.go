@@ -0,0 +1,337 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-thin Table Builders and Status Parsers.
+// See dm-thin documentation at: https://www.kernel.org/doc/Documentation/device-mapper/thin-provisioning.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	thinPoolMinBlockSize = 128     // 64 KiB, in sectors
+	thinPoolMaxBlockSize = 2097152 // 1 GiB, in sectors
+	thinMaxDevID         = 1<<24 - 1
+)
+
+// ThinPoolTarget is a thin-pool target, which provides storage for thinly-provisioned devices and
+// their snapshots.
+type ThinPoolTarget struct {
+	Start         uint64 // Start sector of target
+	Length        uint64 // Length of target in sectors
+	MetadataDev   string // Metadata device path, or major:minor
+	DataDev       string // Data device path, or major:minor
+	DataBlockSize uint64 // Allocation unit in sectors; a multiple of 128 (64 KiB), up to 1 GiB
+	LowWaterMark  uint64 // Free data blocks below which a device event is raised
+
+	SkipBlockZeroing  bool // Don't zero newly-provisioned blocks
+	IgnoreDiscard     bool // Disable discard support
+	NoDiscardPassdown bool // Don't pass discards down to the data device
+	ReadOnly          bool // Don't allow any changes to the pool metadata
+	ErrorIfNoSpace    bool // Error I/O when out of data space, instead of queueing it
+}
+
+// Marshal returns the table target for a thin-pool.
+func (t ThinPoolTarget) Marshal() (dmTarget, error) {
+	for _, dev := range []string{t.MetadataDev, t.DataDev} {
+		if err := checkDevice(dev); err != nil {
+			return dmTarget{}, err
+		}
+	}
+
+	if t.DataBlockSize < thinPoolMinBlockSize || t.DataBlockSize > thinPoolMaxBlockSize ||
+		t.DataBlockSize%thinPoolMinBlockSize != 0 {
+		return dmTarget{}, fmt.Errorf("Invalid thin-pool data block size %d", t.DataBlockSize)
+	}
+
+	// Features are emitted in the same order as the kernel reports them
+	var features []string
+
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{t.SkipBlockZeroing, "skip_block_zeroing"},
+		{t.IgnoreDiscard, "ignore_discard"},
+		{t.NoDiscardPassdown, "no_discard_passdown"},
+		{t.ReadOnly, "read_only"},
+		{t.ErrorIfNoSpace, "error_if_no_space"},
+	} {
+		if f.set {
+			features = append(features, f.name)
+		}
+	}
+
+	params := fmt.Sprintf("%s %s %d %d %d", t.MetadataDev, t.DataDev, t.DataBlockSize, t.LowWaterMark, len(features))
+	if len(features) > 0 {
+		params += " " + strings.Join(features, " ")
+	}
+
+	return dmTarget{t.Start, t.Length, "thin-pool", params}, nil
+}
+
+// Unmarshal parses a thin-pool table target, as returned by GetDeviceTable.
+func (t *ThinPoolTarget) Unmarshal(target dmTarget) error {
+	var (
+		p   ThinPoolTarget
+		err error
+	)
+
+	if err := checkTargetType(target, "thin-pool"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if p.MetadataDev, err = r.next(); err != nil {
+		return err
+	}
+
+	if p.DataDev, err = r.next(); err != nil {
+		return err
+	}
+
+	if p.DataBlockSize, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if p.LowWaterMark, err = r.uint64(); err != nil {
+		return err
+	}
+
+	features, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range features {
+		switch f {
+		case "skip_block_zeroing":
+			p.SkipBlockZeroing = true
+		case "ignore_discard":
+			p.IgnoreDiscard = true
+		case "no_discard_passdown":
+			p.NoDiscardPassdown = true
+		case "read_only":
+			p.ReadOnly = true
+		case "error_if_no_space":
+			p.ErrorIfNoSpace = true
+		default:
+			return fmt.Errorf("Unknown thin-pool feature %q", f)
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected thin-pool parameters %q", target.Params)
+	}
+
+	p.Start, p.Length = target.Start, target.Length
+	*t = p
+
+	return nil
+}
+
+// ThinTarget is a thinly-provisioned device, backed by a thin-pool.
+type ThinTarget struct {
+	Start          uint64 // Start sector of target
+	Length         uint64 // Length of target in sectors
+	PoolDev        string // Thin-pool device path, or major:minor
+	DevID          uint32 // 24-bit device ID, as passed to ThinPoolCreateThin
+	ExternalOrigin string // Optional read-only origin device, for unprovisioned blocks
+}
+
+// Marshal returns the table target for a thin device.
+func (t ThinTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.PoolDev); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.DevID > thinMaxDevID {
+		return dmTarget{}, fmt.Errorf("Thin device ID %d exceeds 24 bits", t.DevID)
+	}
+
+	params := fmt.Sprintf("%s %d", t.PoolDev, t.DevID)
+
+	if t.ExternalOrigin != "" {
+		if err := checkDevice(t.ExternalOrigin); err != nil {
+			return dmTarget{}, err
+		}
+
+		params += " " + t.ExternalOrigin
+	}
+
+	return dmTarget{t.Start, t.Length, "thin", params}, nil
+}
+
+// Unmarshal parses a thin table target, as returned by GetDeviceTable.
+func (t *ThinTarget) Unmarshal(target dmTarget) error {
+	if err := checkTargetType(target, "thin"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	pool, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	f, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	devID, err := strconv.ParseUint(f, 10, 24)
+	if err != nil {
+		return err
+	}
+
+	var origin string
+
+	if r.more() {
+		origin, _ = r.next()
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected thin parameters %q", target.Params)
+	}
+
+	*t = ThinTarget{target.Start, target.Length, pool, uint32(devID), origin}
+
+	return nil
+}
+
+// ThinPoolStatus represents the status of a thin-pool target. Fields following Mode were added in
+// later kernel versions, and are left zero if not reported.
+type ThinPoolStatus struct {
+	Failed               bool   // Pool has failed, and no other fields are valid
+	Error                bool   // Pool status could not be read, and no other fields are valid
+	TransactionID        uint64 // Userspace-defined metadata transaction ID
+	UsedMetadataBlocks   uint64 // Number of metadata blocks used
+	TotalMetadataBlocks  uint64 // Total number of metadata blocks
+	UsedDataBlocks       uint64 // Number of data blocks used
+	TotalDataBlocks      uint64 // Total number of data blocks
+	HeldMetadataRoot     uint64 // Location of held metadata snapshot root, or zero if none
+	Mode                 string // "rw", "ro" or "out_of_data_space"
+	DiscardMode          string // "discard_passdown", "no_discard_passdown" or "ignore_discard"
+	ErrorIfNoSpace       bool   // I/O is errored rather than queued when out of data space
+	NeedsCheck           bool   // Metadata must be checked with thin_check before the pool is reused
+	MetadataLowWatermark uint64 // Free metadata blocks below which a device event is raised
+}
+
+// ThinStatus represents the status of a thin target.
+type ThinStatus struct {
+	Failed              bool   // Pool has failed, and no other fields are valid
+	Error               bool   // Device status could not be read, and no other fields are valid
+	MappedSectors       uint64 // Number of sectors mapped to the device
+	HighestMappedSector uint64 // Highest mapped sector; only valid if MappedSectors > 0
+}
+
+func parseThinPoolStatus(params string) (interface{}, error) {
+	var (
+		s   ThinPoolStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	switch params {
+	case "Fail":
+		s.Failed = true
+		return &s, nil
+	case "Error":
+		s.Error = true
+		return &s, nil
+	}
+
+	if s.TransactionID, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if s.UsedMetadataBlocks, s.TotalMetadataBlocks, err = r.ratio(); err != nil {
+		return nil, err
+	}
+
+	if s.UsedDataBlocks, s.TotalDataBlocks, err = r.ratio(); err != nil {
+		return nil, err
+	}
+
+	if r.peek() == "-" {
+		r.next()
+	} else if s.HeldMetadataRoot, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if s.Mode, err = r.next(); err != nil {
+		return nil, err
+	}
+
+	if !r.more() {
+		return &s, nil
+	}
+
+	if s.DiscardMode, err = r.next(); err != nil {
+		return nil, err
+	}
+
+	if r.more() {
+		f, _ := r.next()
+
+		switch f {
+		case "error_if_no_space":
+			s.ErrorIfNoSpace = true
+		case "queue_if_no_space":
+		default:
+			return nil, fmt.Errorf("Unexpected no space mode %q", f)
+		}
+	}
+
+	if r.more() {
+		f, _ := r.next()
+		s.NeedsCheck = f == "needs_check"
+	}
+
+	if r.more() {
+		if s.MetadataLowWatermark, err = r.uint64(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
+
+func parseThinStatus(params string) (interface{}, error) {
+	var (
+		s   ThinStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	switch params {
+	case "Fail":
+		s.Failed = true
+		return &s, nil
+	case "Error":
+		s.Error = true
+		return &s, nil
+	}
+
+	if s.MappedSectors, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if r.peek() == "-" {
+		return &s, nil
+	}
+
+	if s.HighestMappedSector, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
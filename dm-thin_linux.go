@@ -0,0 +1,51 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-thin Thin-pool Messages.
+
+package devmapper
+
+import "fmt"
+
+// ThinPoolCreateThin creates a new thinly-provisioned device with the specified 24-bit device ID
+// in a thin-pool. The device is not activated; a thin target must be loaded to access it.
+func ThinPoolCreateThin(pool string, devID uint32) error {
+	_, err := SendMessage(pool, 0, fmt.Sprintf("create_thin %d", devID))
+	return err
+}
+
+// ThinPoolCreateSnap creates a new snapshot of thin device originID in a thin-pool, with the
+// specified device ID. If the origin is active, it must be suspended while the snapshot is taken.
+func ThinPoolCreateSnap(pool string, devID, originID uint32) error {
+	_, err := SendMessage(pool, 0, fmt.Sprintf("create_snap %d %d", devID, originID))
+	return err
+}
+
+// ThinPoolDelete deletes a thin device or snapshot from a thin-pool, releasing its data blocks.
+func ThinPoolDelete(pool string, devID uint32) error {
+	_, err := SendMessage(pool, 0, fmt.Sprintf("delete %d", devID))
+	return err
+}
+
+// ThinPoolSetTransactionID changes the userspace-defined transaction ID of a thin-pool from
+// currentID to newID. The change fails if currentID does not match the pool's transaction ID.
+func ThinPoolSetTransactionID(pool string, currentID, newID uint64) error {
+	_, err := SendMessage(pool, 0, fmt.Sprintf("set_transaction_id %d %d", currentID, newID))
+	return err
+}
+
+// ThinPoolReserveMetadataSnap takes a snapshot of the thin-pool metadata, which can be inspected
+// by userspace tools while the pool is live. The snapshot's location is reported in the
+// HeldMetadataRoot field of the pool status.
+func ThinPoolReserveMetadataSnap(pool string) error {
+	_, err := SendMessage(pool, 0, "reserve_metadata_snap")
+	return err
+}
+
+// ThinPoolReleaseMetadataSnap releases a metadata snapshot taken by ThinPoolReserveMetadataSnap.
+func ThinPoolReleaseMetadataSnap(pool string) error {
+	_, err := SendMessage(pool, 0, "release_metadata_snap")
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-thin table builders and status parsers.
+
+package devmapper
+
+import "testing"
+
+func TestParseThinPoolStatus(t *testing.T) {
+	params := `7 1510/262144 94772/1638400 1024 out_of_data_space no_discard_passdown error_if_no_space needs_check 2048`
+
+	s1 := ThinPoolStatus{
+		TransactionID:        7,
+		UsedMetadataBlocks:   1510,
+		TotalMetadataBlocks:  262144,
+		UsedDataBlocks:       94772,
+		TotalDataBlocks:      1638400,
+		HeldMetadataRoot:     1024,
+		Mode:                 "out_of_data_space",
+		DiscardMode:          "no_discard_passdown",
+		ErrorIfNoSpace:       true,
+		NeedsCheck:           true,
+		MetadataLowWatermark: 2048,
+	}
+
+	s2, err := parseThinPoolStatus(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s1 != *s2.(*ThinPoolStatus) {
+		t.Errorf("Got %+v, expected %+v", *s2.(*ThinPoolStatus), s1)
+	}
+
+	// Older kernels report fewer fields
+	s2, err = parseThinPoolStatus(`0 90/4096 0/16384 - ro`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s1 = ThinPoolStatus{UsedMetadataBlocks: 90, TotalMetadataBlocks: 4096, TotalDataBlocks: 16384, Mode: "ro"}
+	if s1 != *s2.(*ThinPoolStatus) {
+		t.Errorf("Got %+v, expected %+v", *s2.(*ThinPoolStatus), s1)
+	}
+
+	for _, params := range []string{"Fail", "Error"} {
+		s2, err := parseThinPoolStatus(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := s2.(*ThinPoolStatus); s.Failed != (params == "Fail") || s.Error != (params == "Error") {
+			t.Errorf("%s: got %+v", params, s)
+		}
+	}
+
+	if _, err := parseThinPoolStatus(`0 90/4096 0/16384 - rw discard_passdown sometimes_if_no_space`); err == nil {
+		t.Error("Expected error for invalid no space mode")
+	}
+}
+
+func TestParseThinStatus(t *testing.T) {
+	s1 := ThinStatus{MappedSectors: 2097152, HighestMappedSector: 4194303}
+
+	s2, err := parseThinStatus(`2097152 4194303`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s1 != *s2.(*ThinStatus) {
+		t.Errorf("Got %+v, expected %+v", *s2.(*ThinStatus), s1)
+	}
+
+	if s2, err := parseThinStatus("Error"); err != nil || !s2.(*ThinStatus).Error {
+		t.Errorf("Got %+v, %v", s2, err)
+	}
+}
+
+func TestThinPoolTarget(t *testing.T) {
+	pool := ThinPoolTarget{
+		Start:             0,
+		Length:            20971520,
+		MetadataDev:       "/dev/vg0/pool_tmeta",
+		DataDev:           "253:4",
+		DataBlockSize:     128,
+		LowWaterMark:      32768,
+		SkipBlockZeroing:  true,
+		NoDiscardPassdown: true,
+		ErrorIfNoSpace:    true,
+	}
+
+	target, err := pool.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := dmTarget{0, 20971520, "thin-pool",
+		"/dev/vg0/pool_tmeta 253:4 128 32768 3 skip_block_zeroing no_discard_passdown error_if_no_space"}
+
+	if target != expected {
+		t.Errorf("Got %+v, expected %+v", target, expected)
+	}
+
+	var parsed ThinPoolTarget
+	if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed != pool {
+		t.Errorf("Got %+v, expected %+v", parsed, pool)
+	}
+
+	// No features
+	target, _ = ThinPoolTarget{0, 8, "253:3", "253:4", 2097152, 0, false, false, false, false, false}.Marshal()
+	if target.Params != "253:3 253:4 2097152 0 0" {
+		t.Errorf("Got params %q", target.Params)
+	}
+
+	for _, size := range []uint64{0, 64, 192, 4194304} {
+		if _, err := (ThinPoolTarget{MetadataDev: "253:3", DataDev: "253:4", DataBlockSize: size}).Marshal(); err == nil {
+			t.Errorf("Expected error for data block size %d", size)
+		}
+	}
+
+	if err := parsed.Unmarshal(dmTarget{0, 8, "thin-pool", "253:3 253:4 128 0 1 go_faster"}); err == nil {
+		t.Error("Expected error for unknown feature")
+	}
+}
+
+func TestThinTarget(t *testing.T) {
+	for _, thin := range []ThinTarget{
+		{0, 2097152, "253:5", 1, ""},
+		{0, 2097152, "/dev/mapper/pool", 16777215, "/dev/vg0/golden"},
+	} {
+		target, err := thin.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var parsed ThinTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed != thin {
+			t.Errorf("Got %+v, expected %+v", parsed, thin)
+		}
+	}
+
+	if _, err := (ThinTarget{0, 8, "253:5", 1 << 24, ""}).Marshal(); err == nil {
+		t.Error("Expected error for over-length device ID")
+	}
+
+	var parsed ThinTarget
+	if err := parsed.Unmarshal(dmTarget{0, 8, "thin", "253:5 16777216"}); err == nil {
+		t.Error("Expected error for over-length device ID")
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-vdo Table Builder, Status Parser and Statistics Parser.
+// See dm-vdo documentation at: https://www.kernel.org/doc/Documentation/admin-guide/device-mapper/vdo.rst
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VDO operating modes.
+const (
+	VDOModeNormal     = "normal"
+	VDOModeRecovering = "recovering"
+	VDOModeReadOnly   = "read-only"
+)
+
+// VDOStatus represents the status of a vdo target.
+type VDOStatus struct {
+	Device              string // Name of the VDO volume
+	OperatingMode       string // VDOModeNormal, VDOModeRecovering or VDOModeReadOnly
+	InRecovery          bool   // Volume is recovering after an unclean shutdown
+	IndexState          string // Deduplication index state, e.g. "online", "offline" or "error"
+	CompressionState    string // "online" or "offline"
+	UsedPhysicalBlocks  uint64 // Number of physical blocks in use
+	TotalPhysicalBlocks uint64 // Number of physical blocks available to the volume
+}
+
+// UsedPerc returns the percentage of physical blocks in use.
+func (s *VDOStatus) UsedPerc() float64 {
+	if s.TotalPhysicalBlocks == 0 {
+		return 0
+	}
+
+	return float64(s.UsedPhysicalBlocks) / float64(s.TotalPhysicalBlocks) * 100
+}
+
+// ReadOnly reports whether the volume has entered read-only mode due to an error.
+func (s *VDOStatus) ReadOnly() bool {
+	return s.OperatingMode == VDOModeReadOnly
+}
+
+func parseVDOStatus(params string) (interface{}, error) {
+	var (
+		s   VDOStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	for _, p := range []*string{&s.Device, &s.OperatingMode} {
+		if *p, err = r.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	recovery, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	s.InRecovery = recovery == "recovering"
+
+	for _, p := range []*string{&s.IndexState, &s.CompressionState} {
+		if *p, err = r.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.UsedPhysicalBlocks, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	if s.TotalPhysicalBlocks, err = r.uint64(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// VDOStats contains the principal statistics of a VDO volume, as reported by the "stats" message.
+// Values are in blocks of BlockSize bytes. The complete statistics are available in Raw, keyed by
+// the kernel's field names, with nested groups flattened into dotted keys, e.g.
+// "packer.compressedFragmentsWritten".
+type VDOStats struct {
+	Version            uint64
+	DataBlocksUsed     uint64 // Physical blocks holding data
+	OverheadBlocksUsed uint64 // Physical blocks holding metadata
+	LogicalBlocksUsed  uint64 // Logical blocks which are mapped
+	PhysicalBlocks     uint64 // Total physical blocks
+	LogicalBlocks      uint64 // Total logical blocks
+	BlockMapCacheSize  uint64 // Block map cache size in bytes
+	BlockSize          uint64 // Block size in bytes
+	CompleteRecoveries uint64 // Number of recoveries after an unclean shutdown
+	ReadOnlyRecoveries uint64 // Number of rebuilds after entering read-only mode
+	Mode               string // VDOModeNormal, VDOModeRecovering or VDOModeReadOnly
+	InRecoveryMode     bool   // Volume is recovering
+	RecoveryPercentage uint64 // Progress of recovery or rebuild, in percent
+	Raw                map[string]string
+}
+
+// SavingPercent returns the percentage of space saved by deduplication and compression, i.e. the
+// proportion of mapped logical blocks which did not require a physical block of their own. This is
+// the "Space saving%" reported by vdostats. Zero is returned if no logical blocks are in use.
+func (s *VDOStats) SavingPercent() float64 {
+	if s.LogicalBlocksUsed == 0 || s.DataBlocksUsed >= s.LogicalBlocksUsed {
+		return 0
+	}
+
+	return float64(s.LogicalBlocksUsed-s.DataBlocksUsed) / float64(s.LogicalBlocksUsed) * 100
+}
+
+// UsedPerc returns the percentage of physical blocks in use, including metadata.
+func (s *VDOStats) UsedPerc() float64 {
+	if s.PhysicalBlocks == 0 {
+		return 0
+	}
+
+	return float64(s.DataBlocksUsed+s.OverheadBlocksUsed) / float64(s.PhysicalBlocks) * 100
+}
+
+// ReadOnly reports whether the volume has entered read-only mode due to an error.
+func (s *VDOStats) ReadOnly() bool {
+	return s.Mode == VDOModeReadOnly
+}
+
+// ParseVDOStats parses the response to a vdo "stats" message, e.g.
+// "{ version : 36, dataBlocksUsed : 10, ..., packer : { compressedFragmentsWritten : 0, }, }".
+func ParseVDOStats(res string) (*VDOStats, error) {
+	raw, err := parseVDODict(res)
+	if err != nil {
+		return nil, err
+	}
+
+	s := VDOStats{Mode: raw["mode"], Raw: raw}
+
+	for key, p := range map[string]*uint64{
+		"version":            &s.Version,
+		"dataBlocksUsed":     &s.DataBlocksUsed,
+		"overheadBlocksUsed": &s.OverheadBlocksUsed,
+		"logicalBlocksUsed":  &s.LogicalBlocksUsed,
+		"physicalBlocks":     &s.PhysicalBlocks,
+		"logicalBlocks":      &s.LogicalBlocks,
+		"blockMapCacheSize":  &s.BlockMapCacheSize,
+		"blockSize":          &s.BlockSize,
+		"completeRecoveries": &s.CompleteRecoveries,
+		"readOnlyRecoveries": &s.ReadOnlyRecoveries,
+		"recoveryPercentage": &s.RecoveryPercentage,
+	} {
+		v, ok := raw[key]
+		if !ok {
+			return nil, fmt.Errorf("VDO statistic %q not found", key)
+		}
+
+		if *p, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid VDO statistic %s: %q", key, v)
+		}
+	}
+
+	s.InRecoveryMode = raw["inRecoveryMode"] == "1"
+
+	return &s, nil
+}
+
+// parseVDODict parses the nested "{ key : value, key : { ... }, }" format of vdo statistics into
+// a flat map, in which the keys of nested groups are prefixed with the group name and a dot.
+func parseVDODict(s string) (map[string]string, error) {
+	// Split into words and the punctuation characters, which never occur within values
+	var tokens []string
+
+	for _, word := range strings.Fields(s) {
+		start := 0
+
+		for x, c := range word {
+			if strings.ContainsRune("{}:,", c) {
+				if x > start {
+					tokens = append(tokens, word[start:x])
+				}
+
+				tokens = append(tokens, string(c))
+				start = x + 1
+			}
+		}
+
+		if start < len(word) {
+			tokens = append(tokens, word[start:])
+		}
+	}
+
+	dict := make(map[string]string)
+
+	pos, err := parseVDOGroup(tokens, 0, "", dict)
+	if err != nil {
+		return nil, err
+	}
+
+	if pos != len(tokens) {
+		return nil, fmt.Errorf("Unexpected %q after VDO statistics", tokens[pos])
+	}
+
+	return dict, nil
+}
+
+// parseVDOGroup parses a brace-delimited group of statistics starting at tokens[pos], and returns
+// the position following the closing brace.
+func parseVDOGroup(tokens []string, pos int, prefix string, dict map[string]string) (int, error) {
+	expect := func(tok string) error {
+		if pos >= len(tokens) {
+			return fmt.Errorf("Unexpected end of VDO statistics")
+		}
+
+		if tokens[pos] != tok {
+			return fmt.Errorf("Unexpected %q in VDO statistics, expected %q", tokens[pos], tok)
+		}
+
+		pos++
+
+		return nil
+	}
+
+	if err := expect("{"); err != nil {
+		return 0, err
+	}
+
+	for {
+		if pos >= len(tokens) {
+			return 0, fmt.Errorf("Unexpected end of VDO statistics")
+		}
+
+		if tokens[pos] == "}" {
+			return pos + 1, nil
+		}
+
+		key := tokens[pos]
+		if strings.Contains("{}:,", key) {
+			return 0, fmt.Errorf("Unexpected %q in VDO statistics", key)
+		}
+
+		pos++
+
+		if err := expect(":"); err != nil {
+			return 0, err
+		}
+
+		if pos >= len(tokens) {
+			return 0, fmt.Errorf("Unexpected end of VDO statistics")
+		}
+
+		var err error
+
+		switch tokens[pos] {
+		case "{":
+			if pos, err = parseVDOGroup(tokens, pos, prefix+key+".", dict); err != nil {
+				return 0, err
+			}
+		case "}", ":", ",":
+			// Empty value, e.g. an unset string
+			dict[prefix+key] = ""
+		default:
+			dict[prefix+key] = tokens[pos]
+			pos++
+		}
+
+		// Items are separated, and optionally terminated, by commas
+		if pos < len(tokens) && tokens[pos] == "," {
+			pos++
+		}
+	}
+}
+
+// VDOTarget is a vdo target, which provides a thinly provisioned volume with inline deduplication
+// and compression. Only the V4 table format of the upstream dm-vdo target is supported.
+type VDOTarget struct {
+	Start               uint64 // Start sector of target
+	Length              uint64 // Length of target in sectors, i.e. the logical size of the volume
+	StorageDev          string // Storage device path, or major:minor
+	StorageBlocks       uint64 // Size of the storage device in 4 KiB blocks
+	MinIOSize           uint32 // Minimum I/O size in bytes, 512 or 4096
+	BlockMapCacheBlocks uint64 // Block map cache size in 4 KiB blocks, at least 32768 (128 MiB)
+	BlockMapEraLength   uint64 // Block map era length, 100 to 16380
+
+	MaxDiscardBlocks    uint32 // Maximum size of discard requests in 4 KiB blocks; kernel default if zero
+	AckThreads          uint32 // Number of threads completing bios; kernel default if zero
+	BioThreads          uint32 // Number of threads submitting bios to the storage device
+	BioRotationInterval uint32 // Number of bios enqueued on each bio thread before moving on
+	CPUThreads          uint32 // Number of threads for CPU-intensive work such as hashing
+	HashZoneThreads     uint32 // Number of hash zone threads
+	LogicalThreads      uint32 // Number of logical zone threads
+	PhysicalThreads     uint32 // Number of physical zone threads
+	NoDeduplication     bool   // Start with deduplication disabled
+	Compression         bool   // Start with compression enabled
+}
+
+// Marshal returns the table target for a VDO volume.
+func (t VDOTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.StorageDev); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.MinIOSize != 512 && t.MinIOSize != 4096 {
+		return dmTarget{}, fmt.Errorf("Invalid VDO minimum I/O size %d", t.MinIOSize)
+	}
+
+	if t.BlockMapCacheBlocks < 32768 {
+		return dmTarget{}, fmt.Errorf("VDO block map cache size %d blocks is less than 128 MiB", t.BlockMapCacheBlocks)
+	}
+
+	if t.BlockMapEraLength < 100 || t.BlockMapEraLength > 16380 {
+		return dmTarget{}, fmt.Errorf("Invalid VDO block map era length %d", t.BlockMapEraLength)
+	}
+
+	if t.Length%8 != 0 {
+		return dmTarget{}, fmt.Errorf("VDO logical size must be a multiple of 4 KiB")
+	}
+
+	params := fmt.Sprintf("V4 %s %d %d %d %d", t.StorageDev, t.StorageBlocks, t.MinIOSize,
+		t.BlockMapCacheBlocks, t.BlockMapEraLength)
+
+	for _, arg := range []struct {
+		name  string
+		value uint32
+	}{
+		{"maxDiscard", t.MaxDiscardBlocks},
+		{"ack", t.AckThreads},
+		{"bio", t.BioThreads},
+		{"bioRotationInterval", t.BioRotationInterval},
+		{"cpu", t.CPUThreads},
+		{"hash", t.HashZoneThreads},
+		{"logical", t.LogicalThreads},
+		{"physical", t.PhysicalThreads},
+	} {
+		if arg.value != 0 {
+			params += fmt.Sprintf(" %s %d", arg.name, arg.value)
+		}
+	}
+
+	if t.NoDeduplication {
+		params += " deduplication off"
+	}
+
+	if t.Compression {
+		params += " compression on"
+	}
+
+	return dmTarget{t.Start, t.Length, "vdo", params}, nil
+}
+
+// Unmarshal parses a vdo table target, as returned by GetDeviceTable.
+func (t *VDOTarget) Unmarshal(target dmTarget) error {
+	var (
+		v   VDOTarget
+		n   uint64
+		err error
+	)
+
+	if err := checkTargetType(target, "vdo"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	version, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	if version != "V4" {
+		return fmt.Errorf("Unsupported VDO table version %q", version)
+	}
+
+	if v.StorageDev, err = r.next(); err != nil {
+		return err
+	}
+
+	if v.StorageBlocks, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	v.MinIOSize = uint32(n)
+
+	if v.BlockMapCacheBlocks, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if v.BlockMapEraLength, err = r.uint64(); err != nil {
+		return err
+	}
+
+	uint32Args := map[string]*uint32{
+		"maxDiscard":          &v.MaxDiscardBlocks,
+		"ack":                 &v.AckThreads,
+		"bio":                 &v.BioThreads,
+		"bioRotationInterval": &v.BioRotationInterval,
+		"cpu":                 &v.CPUThreads,
+		"hash":                &v.HashZoneThreads,
+		"logical":             &v.LogicalThreads,
+		"physical":            &v.PhysicalThreads,
+	}
+
+	// Optional args are key-value pairs, in any order
+	for r.more() {
+		key, _ := r.next()
+
+		value, err := r.next()
+		if err != nil {
+			return fmt.Errorf("Missing value for VDO option %q", key)
+		}
+
+		switch key {
+		case "deduplication", "compression":
+			if value != "on" && value != "off" {
+				return fmt.Errorf("Invalid value for VDO option %q: %q", key, value)
+			}
+
+			if key == "deduplication" {
+				v.NoDeduplication = value == "off"
+			} else {
+				v.Compression = value == "on"
+			}
+		default:
+			p, ok := uint32Args[key]
+			if !ok {
+				return fmt.Errorf("Unknown VDO option %q", key)
+			}
+
+			if n, err = strconv.ParseUint(value, 10, 32); err != nil {
+				return fmt.Errorf("Invalid value for VDO option %q: %q", key, value)
+			}
+
+			*p = uint32(n)
+		}
+	}
+
+	v.Start, v.Length = target.Start, target.Length
+	*t = v
+
+	return nil
+}
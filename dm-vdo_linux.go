@@ -0,0 +1,18 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-vdo Statistics Message.
+
+package devmapper
+
+// GetVDOStats returns the statistics of a VDO volume.
+func GetVDOStats(name string) (*VDOStats, error) {
+	res, err := SendMessage(name, 0, "stats")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseVDOStats(res)
+}
@@ -0,0 +1,194 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-vdo table builder, status parser and statistics parser.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVDOStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected VDOStatus
+	}{
+		{
+			"/dev/sdb normal - online online 1077612 26214400",
+			VDOStatus{"/dev/sdb", VDOModeNormal, false, "online", "online", 1077612, 26214400},
+		},
+		{
+			"253:2 read-only recovering error offline 26214400 26214400",
+			VDOStatus{"253:2", VDOModeReadOnly, true, "error", "offline", 26214400, 26214400},
+		},
+	}
+
+	for _, test := range tests {
+		s, err := ParseTargetStatus(dmTarget{0, 8, "vdo", test.params})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if *s.(*VDOStatus) != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.params, *s.(*VDOStatus), test.expected)
+		}
+	}
+
+	s := VDOStatus{OperatingMode: VDOModeReadOnly, UsedPhysicalBlocks: 25, TotalPhysicalBlocks: 100}
+	if !s.ReadOnly() || s.UsedPerc() != 25 {
+		t.Errorf("Got read-only %t, used %f%%", s.ReadOnly(), s.UsedPerc())
+	}
+
+	if _, err := parseVDOStatus("/dev/sdb normal - online online 1077612"); err == nil {
+		t.Error("Expected error for truncated status")
+	}
+}
+
+// testVDOStats is "stats" message output, abridged to a few of the nested groups.
+const testVDOStats = `{ version : 36, dataBlocksUsed : 1000, overheadBlocksUsed : 77612, ` +
+	`logicalBlocksUsed : 4000, physicalBlocks : 26214400, logicalBlocks : 262144000, ` +
+	`blockMapCacheSize : 134217728, blockSize : 4096, completeRecoveries : 1, readOnlyRecoveries : 0, ` +
+	`mode : recovering, inRecoveryMode : 1, recoveryPercentage : 42, ` +
+	`packer : { compressedFragmentsWritten : 12, compressedBlocksWritten : 3, compressedFragmentsInPacker : 0, }, ` +
+	`hashLock : { dedupeAdviceValid : 2900, dedupeAdviceStale : 5, concurrentDataMatches : 0, ` +
+	`concurrentHashCollisions : 0, currDedupeQueries : 0, }, ` +
+	`biosIn : { read : 100, write : 4000, emptyFlush : 0, discard : 0, flush : 2, fua : 0, }, ` +
+	`instance : 0, }`
+
+func TestParseVDOStats(t *testing.T) {
+	s, err := ParseVDOStats(testVDOStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Raw) != 28 {
+		t.Errorf("Got %d raw statistics, expected 28", len(s.Raw))
+	}
+
+	for key, value := range map[string]string{
+		"packer.compressedFragmentsWritten": "12",
+		"hashLock.dedupeAdviceValid":        "2900",
+		"biosIn.write":                      "4000",
+		"instance":                          "0",
+	} {
+		if s.Raw[key] != value {
+			t.Errorf("%s: got %q, expected %q", key, s.Raw[key], value)
+		}
+	}
+
+	s.Raw = nil
+
+	expected := VDOStats{
+		Version:            36,
+		DataBlocksUsed:     1000,
+		OverheadBlocksUsed: 77612,
+		LogicalBlocksUsed:  4000,
+		PhysicalBlocks:     26214400,
+		LogicalBlocks:      262144000,
+		BlockMapCacheSize:  134217728,
+		BlockSize:          4096,
+		CompleteRecoveries: 1,
+		Mode:               VDOModeRecovering,
+		InRecoveryMode:     true,
+		RecoveryPercentage: 42,
+	}
+
+	if !reflect.DeepEqual(*s, expected) {
+		t.Errorf("Got %+v, expected %+v", *s, expected)
+	}
+
+	if p := s.SavingPercent(); p != 75 {
+		t.Errorf("Got saving %f%%, expected 75%%", p)
+	}
+
+	if s.ReadOnly() {
+		t.Error("Recovering volume reported as read-only")
+	}
+
+	for _, res := range []string{
+		"",
+		"{ version : 36, ",
+		"{ version : 36 } }",
+		"{ version 36, }",
+		"{ version : x, dataBlocksUsed : 0 }",
+		"{ dataBlocksUsed : 0, }",
+	} {
+		if _, err := ParseVDOStats(res); err == nil {
+			t.Errorf("Expected error for %q", res)
+		}
+	}
+}
+
+func TestVDOTarget(t *testing.T) {
+	tests := []struct {
+		target VDOTarget
+		params string
+	}{
+		{
+			VDOTarget{Length: 2097152000, StorageDev: "/dev/sdb", StorageBlocks: 26214400, MinIOSize: 4096,
+				BlockMapCacheBlocks: 32768, BlockMapEraLength: 16380},
+			"V4 /dev/sdb 26214400 4096 32768 16380",
+		},
+		{
+			VDOTarget{Length: 2097152000, StorageDev: "253:2", StorageBlocks: 26214400, MinIOSize: 512,
+				BlockMapCacheBlocks: 65536, BlockMapEraLength: 100, MaxDiscardBlocks: 1500, AckThreads: 1,
+				BioThreads: 4, BioRotationInterval: 64, CPUThreads: 2, HashZoneThreads: 1, LogicalThreads: 2,
+				PhysicalThreads: 1, NoDeduplication: true, Compression: true},
+			"V4 253:2 26214400 512 65536 100 maxDiscard 1500 ack 1 bio 4 bioRotationInterval 64 cpu 2 " +
+				"hash 1 logical 2 physical 1 deduplication off compression on",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed VDOTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+		} else if parsed != test.target {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+
+	valid := tests[0].target
+
+	for _, modify := range []func(*VDOTarget){
+		func(v *VDOTarget) { v.StorageDev = "" },
+		func(v *VDOTarget) { v.MinIOSize = 1024 },
+		func(v *VDOTarget) { v.BlockMapCacheBlocks = 1024 },
+		func(v *VDOTarget) { v.BlockMapEraLength = 99 },
+		func(v *VDOTarget) { v.Length = 2097151 },
+	} {
+		v := valid
+		modify(&v)
+
+		if _, err := v.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", v)
+		}
+	}
+
+	var parsed VDOTarget
+
+	for _, params := range []string{
+		"V2 /dev/sdb 26214400 4096 32768 16380",
+		"V4 /dev/sdb 26214400 4096 32768",
+		"V4 /dev/sdb 26214400 4096 32768 16380 ack",
+		"V4 /dev/sdb 26214400 4096 32768 16380 bogus 1",
+		"V4 /dev/sdb 26214400 4096 32768 16380 compression maybe",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "vdo", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
@@ -0,0 +1,685 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-verity Hash Tree Generator and Table Builder.
+// See dm-verity documentation at: https://www.kernel.org/doc/Documentation/device-mapper/verity.txt
+
+package devmapper
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	// Register hash functions supported by VerityParams
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	veritySignature      = "verity\x00\x00"
+	veritySuperblockSize = 512
+	verityMaxSaltSize    = 256
+)
+
+// ErrVerityMismatch is returned by VerityVerify if the hash tree does not match the data.
+var ErrVerityMismatch = errors.New("Verity hash mismatch")
+
+// verityHashes maps the hash algorithm names used in verity tables to their implementations.
+var verityHashes = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// veritySuperblock is the on-disk superblock written by veritysetup at the start of the hash
+// device. All fields are little-endian.
+type veritySuperblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [verityMaxSaltSize]byte
+	_             [168]byte
+}
+
+// VerityParams describes the layout of a verity hash tree, in veritysetup's on-disk format
+// (hash type 1, with a superblock at the start of the hash device).
+type VerityParams struct {
+	UUID          [16]byte // Identifies the hash device, as reported by veritysetup
+	Algorithm     string   // Hash algorithm, "sha256" or "sha512"
+	DataBlockSize uint32   // Data device block size in bytes
+	HashBlockSize uint32   // Hash device block size in bytes
+	DataBlocks    uint64   // Number of data blocks covered by the hash tree
+	Salt          []byte   // Salt prepended to each block before hashing, up to 256 bytes
+}
+
+// NewVerityParams returns veritysetup's default parameters for a data image of the specified
+// size, with a random salt and UUID. The size must be a multiple of the 4 KiB block size.
+func NewVerityParams(dataSize uint64) (*VerityParams, error) {
+	p := VerityParams{
+		Algorithm:     "sha256",
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		DataBlocks:    dataSize / 4096,
+		Salt:          make([]byte, 32),
+	}
+
+	if dataSize%4096 != 0 {
+		return nil, fmt.Errorf("Data size %d is not a multiple of block size %d", dataSize, p.DataBlockSize)
+	}
+
+	if _, err := rand.Read(p.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(p.UUID[:]); err != nil {
+		return nil, err
+	}
+
+	// RFC 4122 version 4 UUID
+	p.UUID[6] = p.UUID[6]&0x0f | 0x40
+	p.UUID[8] = p.UUID[8]&0x3f | 0x80
+
+	return &p, nil
+}
+
+func (p VerityParams) check() error {
+	if _, ok := verityHashes[p.Algorithm]; !ok {
+		return fmt.Errorf("Unsupported verity hash algorithm %q", p.Algorithm)
+	}
+
+	for _, size := range []uint32{p.DataBlockSize, p.HashBlockSize} {
+		if size < 512 || size > 1<<20 || size&(size-1) != 0 {
+			return fmt.Errorf("Invalid verity block size %d", size)
+		}
+	}
+
+	if int(p.HashBlockSize) < 2*p.digestSize() {
+		return fmt.Errorf("Hash block size %d too small for %s", p.HashBlockSize, p.Algorithm)
+	}
+
+	if p.DataBlocks == 0 {
+		return fmt.Errorf("Verity data must contain at least one block")
+	}
+
+	if len(p.Salt) > verityMaxSaltSize {
+		return fmt.Errorf("Verity salt exceeds %d bytes", verityMaxSaltSize)
+	}
+
+	return nil
+}
+
+func (p VerityParams) digestSize() int {
+	return verityHashes[p.Algorithm].Size()
+}
+
+// hashPerBlockBits returns log2 of the number of digests stored in each hash block. Digests are
+// stored at power-of-two intervals, so a hash block may have unused space at the end.
+func (p VerityParams) hashPerBlockBits() uint {
+	return uint(bits.Len32(p.HashBlockSize/uint32(p.digestSize())) - 1)
+}
+
+// levels returns the starting block on the hash device of each level of the hash tree, and the
+// number of blocks in each level. Level 0 hashes the data blocks, and the highest level is a
+// single block, whose hash is the root hash. As in the kernel, the highest level is stored first.
+func (p VerityParams) levels() (start, size []uint64) {
+	hpbBits := p.hashPerBlockBits()
+
+	var n uint
+	for hpbBits*n < 64 && (p.DataBlocks-1)>>(hpbBits*n) != 0 {
+		n++
+	}
+
+	start = make([]uint64, n)
+	size = make([]uint64, n)
+	pos := p.hashStartBlock()
+
+	for i := int(n) - 1; i >= 0; i-- {
+		shift := uint(i+1) * hpbBits
+		start[i] = pos
+		size[i] = (p.DataBlocks + 1<<shift - 1) >> shift
+		pos += size[i]
+	}
+
+	return start, size
+}
+
+// HashStartBlock returns the first block of the hash tree on the hash device, following the
+// superblock.
+func (p VerityParams) HashStartBlock() (uint64, error) {
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+
+	return p.hashStartBlock(), nil
+}
+
+func (p VerityParams) hashStartBlock() uint64 {
+	return (veritySuperblockSize + uint64(p.HashBlockSize) - 1) / uint64(p.HashBlockSize)
+}
+
+// HashDeviceSize returns the size in bytes of the hash device, including the superblock.
+func (p VerityParams) HashDeviceSize() (uint64, error) {
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+
+	blocks := p.hashStartBlock()
+
+	_, size := p.levels()
+	for _, s := range size {
+		blocks += s
+	}
+
+	return blocks * uint64(p.HashBlockSize), nil
+}
+
+// marshal returns the superblock describing p.
+func (p VerityParams) marshal() []byte {
+	sb := veritySuperblock{
+		Version:       1,
+		HashType:      1,
+		UUID:          p.UUID,
+		DataBlockSize: p.DataBlockSize,
+		HashBlockSize: p.HashBlockSize,
+		DataBlocks:    p.DataBlocks,
+		SaltSize:      uint16(len(p.Salt)),
+	}
+
+	copy(sb.Signature[:], veritySignature)
+	copy(sb.Algorithm[:], p.Algorithm)
+	copy(sb.Salt[:], p.Salt)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &sb)
+
+	return buf.Bytes()
+}
+
+// ReadVeritySuperblock reads the verity superblock from the start of a hash device.
+func ReadVeritySuperblock(hashDev io.ReaderAt) (*VerityParams, error) {
+	var sb veritySuperblock
+
+	buf := make([]byte, veritySuperblockSize)
+	if _, err := hashDev.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("Cannot read verity superblock - %s", err)
+	}
+
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &sb)
+
+	if string(sb.Signature[:]) != veritySignature {
+		return nil, fmt.Errorf("Verity superblock signature not found")
+	}
+
+	if sb.Version != 1 || sb.HashType != 1 {
+		return nil, fmt.Errorf("Unsupported verity superblock version %d, hash type %d", sb.Version, sb.HashType)
+	}
+
+	if sb.SaltSize > verityMaxSaltSize {
+		return nil, fmt.Errorf("Invalid verity salt size %d", sb.SaltSize)
+	}
+
+	p := VerityParams{
+		UUID:          sb.UUID,
+		Algorithm:     strings.ToLower(cString(sb.Algorithm[:])),
+		DataBlockSize: sb.DataBlockSize,
+		HashBlockSize: sb.HashBlockSize,
+		DataBlocks:    sb.DataBlocks,
+		Salt:          append([]byte{}, sb.Salt[:sb.SaltSize]...),
+	}
+
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// VerityHashDevice is a hash device to which a hash tree can be written. Lower levels of the
+// tree are read back while the upper levels are computed. *os.File satisfies this interface.
+type VerityHashDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// VerityFormat computes the hash tree of the data device, and writes it to the hash device,
+// preceded by a superblock. The root hash is returned, and must be supplied to the verity target
+// (see VerityParams.Target), typically from a trusted source such as a signed kernel command line.
+func VerityFormat(dataDev io.ReaderAt, hashDev VerityHashDevice, p VerityParams) ([]byte, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+
+	// The superblock is padded to the start of the hash tree
+	sb := make([]byte, p.hashStartBlock()*uint64(p.HashBlockSize))
+	copy(sb, p.marshal())
+
+	if _, err := hashDev.WriteAt(sb, 0); err != nil {
+		return nil, fmt.Errorf("Cannot write verity superblock - %s", err)
+	}
+
+	return p.hashTree(dataDev, hashDev, hashDev)
+}
+
+// VerityVerify verifies every block of the data device against the hash tree on the hash device,
+// and the tree against the root hash, in the manner of "veritysetup verify". ErrVerityMismatch
+// is returned if any hash does not match.
+func VerityVerify(dataDev, hashDev io.ReaderAt, p VerityParams, rootHash []byte) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+
+	calculated, err := p.hashTree(dataDev, hashDev, nil)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(calculated, rootHash) {
+		return ErrVerityMismatch
+	}
+
+	return nil
+}
+
+// hashTree computes the hash tree one level at a time, from the data blocks upwards, and returns
+// the root hash. Each level is computed from the level below it, as read back from hashIn. If
+// hashOut is nil, the computed hash blocks are compared against those on hashIn instead of being
+// written, i.e. the tree is verified.
+func (p VerityParams) hashTree(dataDev, hashIn io.ReaderAt, hashOut io.WriterAt) ([]byte, error) {
+	h := verityHashes[p.Algorithm].New()
+	start, size := p.levels()
+
+	// A single data block is hashed directly by the root hash
+	if len(start) == 0 {
+		block := make([]byte, p.DataBlockSize)
+		if _, err := dataDev.ReadAt(block, 0); err != nil {
+			return nil, fmt.Errorf("Cannot read data block 0 - %s", err)
+		}
+
+		return p.digest(h, block), nil
+	}
+
+	var (
+		stride  = int(p.HashBlockSize) >> p.hashPerBlockBits()
+		out     = make([]byte, p.HashBlockSize)
+		stored  = make([]byte, p.HashBlockSize)
+		hashBlk = int64(p.HashBlockSize)
+	)
+
+	for level := range start {
+		var (
+			in       io.ReaderAt
+			inStart  uint64
+			inBlocks uint64
+			block    []byte
+		)
+
+		if level == 0 {
+			in, inBlocks, block = dataDev, p.DataBlocks, make([]byte, p.DataBlockSize)
+		} else {
+			in, inStart, inBlocks, block = hashIn, start[level-1], size[level-1], make([]byte, p.HashBlockSize)
+		}
+
+		outBlock := start[level]
+		pos := 0
+
+		for x := uint64(0); x < inBlocks; x++ {
+			off := int64(inStart+x) * int64(len(block))
+			if _, err := in.ReadAt(block, off); err != nil {
+				return nil, fmt.Errorf("Cannot read level %d block %d - %s", level, x, err)
+			}
+
+			copy(out[pos:], p.digest(h, block))
+			pos += stride
+
+			// Flush the hash block when full, or after the last digest of the level
+			if pos < len(out) && x < inBlocks-1 {
+				continue
+			}
+
+			if hashOut != nil {
+				if _, err := hashOut.WriteAt(out, int64(outBlock)*hashBlk); err != nil {
+					return nil, fmt.Errorf("Cannot write hash block %d - %s", outBlock, err)
+				}
+			} else {
+				if _, err := hashIn.ReadAt(stored, int64(outBlock)*hashBlk); err != nil {
+					return nil, fmt.Errorf("Cannot read hash block %d - %s", outBlock, err)
+				}
+
+				if !bytes.Equal(out, stored) {
+					return nil, ErrVerityMismatch
+				}
+			}
+
+			for i := range out {
+				out[i] = 0
+			}
+
+			outBlock++
+			pos = 0
+		}
+	}
+
+	// The highest level is a single block
+	top := make([]byte, p.HashBlockSize)
+	if _, err := hashIn.ReadAt(top, int64(start[len(start)-1])*hashBlk); err != nil {
+		return nil, fmt.Errorf("Cannot read top hash block - %s", err)
+	}
+
+	return p.digest(h, top), nil
+}
+
+// digest returns the salted hash of a block. Hash type 1 prepends the salt to the block.
+func (p VerityParams) digest(h hash.Hash, block []byte) []byte {
+	h.Reset()
+	h.Write(p.Salt)
+	h.Write(block)
+
+	return h.Sum(nil)
+}
+
+// Target returns a verity target for the data and hash devices described by p, with the
+// specified root hash.
+func (p VerityParams) Target(dataDev, hashDev string, rootHash []byte) (VerityTarget, error) {
+	if err := p.check(); err != nil {
+		return VerityTarget{}, err
+	}
+
+	return VerityTarget{
+		Length:         p.DataBlocks * uint64(p.DataBlockSize) / 512,
+		Version:        1,
+		DataDev:        dataDev,
+		HashDev:        hashDev,
+		DataBlockSize:  p.DataBlockSize,
+		HashBlockSize:  p.HashBlockSize,
+		DataBlocks:     p.DataBlocks,
+		HashStartBlock: p.hashStartBlock(),
+		Algorithm:      p.Algorithm,
+		RootHash:       hex.EncodeToString(rootHash),
+		Salt:           hex.EncodeToString(p.Salt),
+	}, nil
+}
+
+// VerityMode specifies how a verity target handles corrupted blocks.
+type VerityMode string
+
+const (
+	VerityModeEIO     VerityMode = ""                      // Fail I/O to corrupted blocks (default)
+	VerityModeLogging VerityMode = "ignore_corruption"     // Log corrupted blocks, but allow I/O
+	VerityModeRestart VerityMode = "restart_on_corruption" // Restart the system
+	VerityModePanic   VerityMode = "panic_on_corruption"   // Panic the system
+)
+
+// VerityErrorMode specifies how a verity target handles I/O errors which cannot be corrected.
+type VerityErrorMode string
+
+const (
+	VerityErrorEIO     VerityErrorMode = ""                 // Fail the I/O (default)
+	VerityErrorRestart VerityErrorMode = "restart_on_error" // Restart the system
+	VerityErrorPanic   VerityErrorMode = "panic_on_error"   // Panic the system
+)
+
+// VerityTarget is a verity target, which provides read-only access to a data device whose blocks
+// are verified against a hash tree.
+type VerityTarget struct {
+	Start          uint64     // Start sector of target
+	Length         uint64     // Length of target in sectors
+	Version        uint32     // Hash type; 1 for veritysetup's default format
+	DataDev        string     // Data device path, or major:minor
+	HashDev        string     // Hash device path, or major:minor
+	DataBlockSize  uint32     // Data device block size in bytes
+	HashBlockSize  uint32     // Hash device block size in bytes
+	DataBlocks     uint64     // Number of data blocks
+	HashStartBlock uint64     // First block of the hash tree on the hash device
+	Algorithm      string     // Hash algorithm, e.g. "sha256"
+	RootHash       string     // Hex-encoded root hash
+	Salt           string     // Hex-encoded salt; empty for no salt
+	Mode           VerityMode // Corruption handling mode
+
+	ErrorMode          VerityErrorMode // I/O error handling mode
+	IgnoreZeroBlocks   bool            // Return zeros for data blocks expected to contain zeros, without verifying them
+	CheckAtMostOnce    bool            // Verify each data block only the first time it is read
+	VerifyInTasklet    bool            // Try to verify blocks in softirq context, to reduce latency
+	FECDev             string          // Forward error correction device path, or major:minor; empty for no FEC
+	FECBlocks          uint64          // Number of blocks covered by FEC, i.e. data, hash and metadata blocks
+	FECStart           uint64          // First block of the FEC data on the FEC device
+	FECRoots           uint32          // Number of Reed-Solomon parity bytes, 2 to 24
+	RootHashSigKeyDesc string          // Description of a kernel keyring key holding a signature of the root hash
+}
+
+// Marshal returns the table target for a verity mapping.
+func (t VerityTarget) Marshal() (dmTarget, error) {
+	if err := checkDevice(t.DataDev); err != nil {
+		return dmTarget{}, err
+	}
+
+	if err := checkDevice(t.HashDev); err != nil {
+		return dmTarget{}, err
+	}
+
+	if t.Version > 1 {
+		return dmTarget{}, fmt.Errorf("Invalid verity version %d", t.Version)
+	}
+
+	if t.Algorithm == "" || strings.IndexFunc(t.Algorithm, func(r rune) bool { return r <= ' ' }) >= 0 {
+		return dmTarget{}, fmt.Errorf("Invalid verity hash algorithm %q", t.Algorithm)
+	}
+
+	if _, err := hex.DecodeString(t.RootHash); err != nil || t.RootHash == "" {
+		return dmTarget{}, fmt.Errorf("Invalid verity root hash %q", t.RootHash)
+	}
+
+	salt := t.Salt
+	if salt == "" {
+		salt = "-"
+	} else if _, err := hex.DecodeString(salt); err != nil {
+		return dmTarget{}, fmt.Errorf("Invalid verity salt %q", salt)
+	}
+
+	var args []string
+
+	switch t.Mode {
+	case VerityModeEIO:
+	case VerityModeLogging, VerityModeRestart, VerityModePanic:
+		args = append(args, string(t.Mode))
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid verity mode %q", t.Mode)
+	}
+
+	switch t.ErrorMode {
+	case VerityErrorEIO:
+	case VerityErrorRestart, VerityErrorPanic:
+		args = append(args, string(t.ErrorMode))
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid verity error mode %q", t.ErrorMode)
+	}
+
+	if t.IgnoreZeroBlocks {
+		args = append(args, "ignore_zero_blocks")
+	}
+
+	if t.CheckAtMostOnce {
+		args = append(args, "check_at_most_once")
+	}
+
+	if t.VerifyInTasklet {
+		args = append(args, "try_verify_in_tasklet")
+	}
+
+	if t.FECDev != "" {
+		if err := checkDevice(t.FECDev); err != nil {
+			return dmTarget{}, err
+		}
+
+		if t.FECRoots < 2 || t.FECRoots > 24 {
+			return dmTarget{}, fmt.Errorf("Invalid verity FEC roots %d", t.FECRoots)
+		}
+
+		args = append(args, "use_fec_from_device", t.FECDev,
+			"fec_blocks", strconv.FormatUint(t.FECBlocks, 10),
+			"fec_start", strconv.FormatUint(t.FECStart, 10),
+			"fec_roots", strconv.FormatUint(uint64(t.FECRoots), 10))
+	}
+
+	if t.RootHashSigKeyDesc != "" {
+		if strings.IndexFunc(t.RootHashSigKeyDesc, func(r rune) bool { return r <= ' ' }) >= 0 {
+			return dmTarget{}, fmt.Errorf("Invalid root hash signature key description %q", t.RootHashSigKeyDesc)
+		}
+
+		args = append(args, "root_hash_sig_key_desc", t.RootHashSigKeyDesc)
+	}
+
+	params := fmt.Sprintf("%d %s %s %d %d %d %d %s %s %s", t.Version, t.DataDev, t.HashDev,
+		t.DataBlockSize, t.HashBlockSize, t.DataBlocks, t.HashStartBlock, t.Algorithm, t.RootHash, salt)
+
+	if len(args) > 0 {
+		params += fmt.Sprintf(" %d %s", len(args), strings.Join(args, " "))
+	}
+
+	return dmTarget{t.Start, t.Length, "verity", params}, nil
+}
+
+// Unmarshal parses a verity table target, as returned by GetDeviceTable.
+func (t *VerityTarget) Unmarshal(target dmTarget) error {
+	var (
+		v   VerityTarget
+		n   uint64
+		err error
+	)
+
+	if err := checkTargetType(target, "verity"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	v.Version = uint32(n)
+
+	if v.DataDev, err = r.next(); err != nil {
+		return err
+	}
+
+	if v.HashDev, err = r.next(); err != nil {
+		return err
+	}
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	v.DataBlockSize = uint32(n)
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	v.HashBlockSize = uint32(n)
+
+	if v.DataBlocks, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if v.HashStartBlock, err = r.uint64(); err != nil {
+		return err
+	}
+
+	if v.Algorithm, err = r.next(); err != nil {
+		return err
+	}
+
+	if v.RootHash, err = r.next(); err != nil {
+		return err
+	}
+
+	if v.Salt, err = r.next(); err != nil {
+		return err
+	}
+
+	if v.Salt == "-" {
+		v.Salt = ""
+	}
+
+	if r.more() {
+		args, err := r.counted()
+		if err != nil {
+			return err
+		}
+
+		for x := 0; x < len(args); x++ {
+			opt := args[x]
+
+			// Options which take a value
+			switch opt {
+			case "use_fec_from_device", "fec_blocks", "fec_start", "fec_roots", "root_hash_sig_key_desc":
+				if x++; x == len(args) {
+					return fmt.Errorf("Missing value for verity option %q", opt)
+				}
+			}
+
+			switch opt {
+			case string(VerityModeLogging), string(VerityModeRestart), string(VerityModePanic):
+				v.Mode = VerityMode(opt)
+			case string(VerityErrorRestart), string(VerityErrorPanic):
+				v.ErrorMode = VerityErrorMode(opt)
+			case "ignore_zero_blocks":
+				v.IgnoreZeroBlocks = true
+			case "check_at_most_once":
+				v.CheckAtMostOnce = true
+			case "try_verify_in_tasklet":
+				v.VerifyInTasklet = true
+			case "use_fec_from_device":
+				v.FECDev = args[x]
+			case "fec_blocks", "fec_start":
+				n, err := strconv.ParseUint(args[x], 10, 64)
+				if err != nil {
+					return fmt.Errorf("Invalid verity option %s %q", opt, args[x])
+				}
+
+				if opt == "fec_blocks" {
+					v.FECBlocks = n
+				} else {
+					v.FECStart = n
+				}
+			case "fec_roots":
+				n, err := strconv.ParseUint(args[x], 10, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid verity option %s %q", opt, args[x])
+				}
+
+				v.FECRoots = uint32(n)
+			case "root_hash_sig_key_desc":
+				v.RootHashSigKeyDesc = args[x]
+			default:
+				return fmt.Errorf("Unknown verity option %q", opt)
+			}
+		}
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected verity parameters")
+	}
+
+	v.Start, v.Length = target.Start, target.Length
+	*t = v
+
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-verity hash tree generator and table builder.
+
+package devmapper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// memDevice is an in-memory block device, which grows as necessary when written.
+type memDevice struct {
+	buf []byte
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d.buf)) {
+		return 0, bytes.ErrTooLarge
+	}
+
+	return copy(p, d.buf[off:]), nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(d.buf)) {
+		d.buf = append(d.buf, make([]byte, end-int64(len(d.buf)))...)
+	}
+
+	return copy(d.buf[off:], p), nil
+}
+
+// verityTests are known-answer vectors for veritysetup's on-disk format, covering a single-level
+// tree, a three-level tree and a single data block (no tree at all).
+var verityTests = []struct {
+	data      func() []byte
+	params    VerityParams
+	rootHash  string
+	imageHash string // SHA-256 of the complete hash device
+	imageSize uint64
+}{
+	{
+		func() []byte { return make([]byte, 8*4096) },
+		VerityParams{Algorithm: "sha256", DataBlockSize: 4096, HashBlockSize: 4096, DataBlocks: 8,
+			Salt: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+				0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f}},
+		"01481fa9a68ec9fd230c9f89013058f02060bc1be69f584f2b32261fed80086d",
+		"afdacf88815817a16f5071402ab267ded3adbb7cda66ec707fa43798df4ddf32",
+		8192,
+	},
+	{
+		func() []byte {
+			b := make([]byte, 300*512)
+			for x := range b {
+				b[x] = byte(x*7 + x/512)
+			}
+			return b
+		},
+		VerityParams{Algorithm: "sha512", DataBlockSize: 512, HashBlockSize: 512, DataBlocks: 300},
+		"69f4dab1e373a2d9ff98f3999602d5ec631275a73f30e861cc45f3e81bde5a03" +
+			"3de4a9c9074379160a6c63889d092092e8e4bf6f83bcbcea9f7d4cbf008151b8",
+		"a1eea9b977c3cee0c13fecb1cd53fec544a69590c2df10372dae36a9337d49ff",
+		23040,
+	},
+	{
+		func() []byte { return bytes.Repeat([]byte{0xa5}, 4096) },
+		VerityParams{Algorithm: "sha256", DataBlockSize: 4096, HashBlockSize: 4096, DataBlocks: 1,
+			Salt: []byte{1, 2, 3, 4}},
+		"8abe0f65e33ddeb62eafd5d0ac945059a60581de586afaea7d4250c29c744c50",
+		"51bbd98fec665161cdbf6d71bdf418bedca4e0cb0d2277830390f74908a18601",
+		4096,
+	},
+}
+
+func TestVerityFormat(t *testing.T) {
+	for _, test := range verityTests {
+		var (
+			data    = &memDevice{test.data()}
+			hashDev = new(memDevice)
+			p       = test.params
+		)
+
+		for x := range p.UUID {
+			p.UUID[x] = byte(x)
+		}
+
+		rootHash, err := VerityFormat(data, hashDev, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := hex.EncodeToString(rootHash); got != test.rootHash {
+			t.Errorf("%d x %d: got root hash %s, expected %s", p.DataBlocks, p.DataBlockSize, got, test.rootHash)
+		}
+
+		if got, err := p.HashDeviceSize(); err != nil {
+			t.Error(err)
+		} else if got != test.imageSize || uint64(len(hashDev.buf)) != got {
+			t.Errorf("%d x %d: got hash device size %d (%d written), expected %d", p.DataBlocks, p.DataBlockSize,
+				got, len(hashDev.buf), test.imageSize)
+		}
+
+		if got := sha256.Sum256(hashDev.buf); hex.EncodeToString(got[:]) != test.imageHash {
+			t.Errorf("%d x %d: got hash device checksum %x, expected %s", p.DataBlocks, p.DataBlockSize,
+				got, test.imageHash)
+		}
+
+		sb, err := ReadVeritySuperblock(hashDev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(p.Salt) == 0 {
+			p.Salt = []byte{}
+		}
+
+		if !reflect.DeepEqual(*sb, p) {
+			t.Errorf("Got superblock %+v, expected %+v", *sb, p)
+		}
+
+		if err := VerityVerify(data, hashDev, *sb, rootHash); err != nil {
+			t.Errorf("%d x %d: %s", p.DataBlocks, p.DataBlockSize, err)
+		}
+
+		// Corrupt the last data block
+		data.buf[len(data.buf)-1] ^= 0xff
+
+		if err := VerityVerify(data, hashDev, *sb, rootHash); err != ErrVerityMismatch {
+			t.Errorf("%d x %d: expected mismatch, got %v", p.DataBlocks, p.DataBlockSize, err)
+		}
+	}
+}
+
+func TestVerityVerifyCorruptTree(t *testing.T) {
+	test := verityTests[1]
+	data, hashDev := &memDevice{test.data()}, new(memDevice)
+
+	rootHash, err := VerityFormat(data, hashDev, test.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the unused space at the end of the last hash block, which must be zero
+	hashDev.buf[len(hashDev.buf)-1] = 1
+
+	if err := VerityVerify(data, hashDev, test.params, rootHash); err != ErrVerityMismatch {
+		t.Errorf("Expected mismatch, got %v", err)
+	}
+}
+
+func TestNewVerityParams(t *testing.T) {
+	p, err := NewVerityParams(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.DataBlocks != 256 || len(p.Salt) != 32 || p.UUID[6]>>4 != 4 {
+		t.Errorf("Unexpected parameters %+v", *p)
+	}
+
+	if _, err := NewVerityParams(1000); err == nil {
+		t.Error("Expected error for unaligned data size")
+	}
+}
+
+func TestVerityTarget(t *testing.T) {
+	p := verityTests[0].params
+	rootHash, _ := hex.DecodeString(verityTests[0].rootHash)
+
+	vt, err := p.Target("7:0", "7:1", rootHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vt.Mode = VerityModeRestart
+	vt.CheckAtMostOnce = true
+	vt.RootHashSigKeyDesc = "verity:test"
+
+	target, err := vt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := dmTarget{0, 64, "verity", "1 7:0 7:1 4096 4096 8 1 sha256 " + verityTests[0].rootHash + " " +
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f " +
+		"4 restart_on_corruption check_at_most_once root_hash_sig_key_desc verity:test"}
+
+	if target != expected {
+		t.Errorf("Got %v, expected %v", target, expected)
+	}
+
+	var parsed VerityTarget
+	if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed != vt {
+		t.Errorf("Got %+v, expected %+v", parsed, vt)
+	}
+
+	// No salt
+	if vt, err = verityTests[1].params.Target("7:0", "7:1", rootHash); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err = vt.Marshal(); err != nil {
+		t.Fatal(err)
+	} else if err := parsed.Unmarshal(target); err != nil {
+		t.Fatal(err)
+	} else if parsed != vt {
+		t.Errorf("Got %+v, expected %+v", parsed, vt)
+	}
+
+	for _, params := range []string{
+		"1 7:0 7:1 4096 4096 8 1 sha256 00",
+		"1 7:0 7:1 4096 4096 8 1 sha256 00 - 1 bogus",
+		"1 7:0 7:1 4096 4096 8 1 sha256 00 - 1 root_hash_sig_key_desc",
+		"1 7:0 7:1 4096 4096 8 1 sha256 00 - 1 use_fec_from_device",
+		"1 7:0 7:1 4096 4096 8 1 sha256 00 - 2 fec_roots x",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "verity", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
+
+func TestVerityTargetFEC(t *testing.T) {
+	// Table as reported by the kernel for a device opened by veritysetup with --fec-device
+	params := "1 7:0 7:1 4096 4096 262144 1 sha256 " +
+		"4392f5b5a2b0c4b7b2e6c7b3a0e4d5f6a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c " +
+		"000102030405060708090a0b0c0d0e0f " +
+		"11 restart_on_corruption restart_on_error ignore_zero_blocks " +
+		"use_fec_from_device 7:2 fec_blocks 264260 fec_start 0 fec_roots 2"
+
+	expected := VerityTarget{
+		Length:           2097152,
+		Version:          1,
+		DataDev:          "7:0",
+		HashDev:          "7:1",
+		DataBlockSize:    4096,
+		HashBlockSize:    4096,
+		DataBlocks:       262144,
+		HashStartBlock:   1,
+		Algorithm:        "sha256",
+		RootHash:         "4392f5b5a2b0c4b7b2e6c7b3a0e4d5f6a7b8c9d0e1f2a3b4c5d6e7f8091a2b3c",
+		Salt:             "000102030405060708090a0b0c0d0e0f",
+		Mode:             VerityModeRestart,
+		ErrorMode:        VerityErrorRestart,
+		IgnoreZeroBlocks: true,
+		FECDev:           "7:2",
+		FECBlocks:        264260,
+		FECRoots:         2,
+	}
+
+	var parsed VerityTarget
+	if err := parsed.Unmarshal(dmTarget{0, 2097152, "verity", params}); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed != expected {
+		t.Errorf("Got %+v, expected %+v", parsed, expected)
+	}
+
+	target, err := expected.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.Params != params {
+		t.Errorf("Got %q, expected %q", target.Params, params)
+	}
+
+	for _, vt := range []VerityTarget{
+		{FECDev: "7:2", FECRoots: 1},
+		{FECDev: "7:2", FECRoots: 25},
+		{FECDev: "", ErrorMode: "bogus"},
+	} {
+		vt.DataDev, vt.HashDev, vt.Algorithm, vt.RootHash = "7:0", "7:1", "sha256", "00"
+
+		if _, err := vt.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", vt)
+		}
+	}
+}
+
+func TestVerityParamsInvalid(t *testing.T) {
+	for _, p := range []VerityParams{
+		{Algorithm: "md5", DataBlockSize: 4096, HashBlockSize: 4096, DataBlocks: 1},
+		{Algorithm: "sha256", DataBlockSize: 4096, HashBlockSize: 0, DataBlocks: 1},
+	} {
+		if _, err := p.HashStartBlock(); err == nil {
+			t.Errorf("HashStartBlock: expected error for %+v", p)
+		}
+
+		if _, err := p.HashDeviceSize(); err == nil {
+			t.Errorf("HashDeviceSize: expected error for %+v", p)
+		}
+
+		if _, err := p.Target("7:0", "7:1", []byte{0}); err == nil {
+			t.Errorf("Target: expected error for %+v", p)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-writecache Table Builder and Status Parser.
+// See dm-writecache documentation at: https://www.kernel.org/doc/Documentation/device-mapper/writecache.txt
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WritecacheStatus represents the status of a writecache target. The block statistics were added
+// in writecache target version 1.5, and are zero on older kernels.
+type WritecacheStatus struct {
+	Error           int    // Zero, or a negative errno if the cache has failed
+	TotalBlocks     uint64 // Total number of cache blocks
+	FreeBlocks      uint64 // Number of free cache blocks
+	WritebackBlocks uint64 // Number of blocks under writeback
+
+	ReadBlocks              uint64 // Number of blocks read
+	ReadHits                uint64 // Number of blocks read from the cache
+	WriteBlocks             uint64 // Number of blocks written
+	WriteHitsUncommitted    uint64 // Number of blocks written which hit an uncommitted cache block
+	WriteHitsCommitted      uint64 // Number of blocks written which hit a committed cache block
+	WritesAround            uint64 // Number of blocks written which bypassed the cache
+	WritesAllocate          uint64 // Number of blocks written which were allocated in the cache
+	WritesBlockedOnFreelist uint64 // Number of write requests blocked waiting for a free cache block
+	Flushes                 uint64 // Number of flush requests
+	Discards                uint64 // Number of blocks discarded
+}
+
+// UsedPerc returns the percentage of cache blocks in use.
+func (s *WritecacheStatus) UsedPerc() float64 {
+	if s.TotalBlocks == 0 {
+		return 0
+	}
+
+	return float64(s.TotalBlocks-s.FreeBlocks) / float64(s.TotalBlocks) * 100
+}
+
+// ReadHitRatio returns the ratio of cache read hits to blocks read.
+func (s *WritecacheStatus) ReadHitRatio() float64 {
+	if s.ReadBlocks == 0 {
+		return 0
+	}
+
+	return float64(s.ReadHits) / float64(s.ReadBlocks)
+}
+
+func parseWritecacheStatus(params string) (interface{}, error) {
+	var (
+		s   WritecacheStatus
+		err error
+	)
+
+	r := newFieldReader(params)
+
+	if s.Error, err = r.int(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range []*uint64{&s.TotalBlocks, &s.FreeBlocks, &s.WritebackBlocks} {
+		if *p, err = r.uint64(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Statistics were added in a later kernel
+	if !r.more() {
+		return &s, nil
+	}
+
+	for _, p := range []*uint64{
+		&s.ReadBlocks, &s.ReadHits, &s.WriteBlocks, &s.WriteHitsUncommitted, &s.WriteHitsCommitted,
+		&s.WritesAround, &s.WritesAllocate, &s.WritesBlockedOnFreelist, &s.Flushes, &s.Discards,
+	} {
+		if *p, err = r.uint64(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
+
+// WritecacheMode specifies the type of a writecache's cache device.
+type WritecacheMode string
+
+const (
+	WritecachePMEM WritecacheMode = "p" // Persistent memory
+	WritecacheSSD  WritecacheMode = "s" // SSD or other block device
+)
+
+// WritecacheTarget is a writecache target, which caches writes to a slow origin device on a fast
+// persistent memory or SSD cache device. Unlike dm-cache, reads are not cached.
+type WritecacheTarget struct {
+	Start     uint64         // Start sector of target
+	Length    uint64         // Length of target in sectors, normally the size of the origin device
+	Mode      WritecacheMode // Type of cache device
+	OriginDev string         // Origin device path, or major:minor
+	CacheDev  string         // Cache device path, or major:minor
+	BlockSize uint32         // Cache block size in bytes, 512 up to the page size
+
+	StartSector      uint64 // Offset of the cache on the cache device, in sectors
+	HighWatermark    uint32 // Cache usage percentage at which writeback starts; kernel default if zero
+	LowWatermark     uint32 // Cache usage percentage at which writeback stops; kernel default if zero
+	WritebackJobs    uint32 // Maximum number of blocks under writeback at once; kernel default if zero
+	AutocommitBlocks uint32 // Number of blocks written after which the cache is committed (SSD mode)
+	AutocommitTime   uint32 // Interval in milliseconds after which the cache is committed (SSD mode)
+	MaxAge           uint32 // Maximum age of a cache block in milliseconds
+	Cleaner          bool   // Write back all blocks, and cache no new writes
+	FUA              bool   // Use FUA writes to commit persistent memory (PMEM mode)
+	NoFUA            bool   // Use flushes rather than FUA writes (PMEM mode)
+	MetadataOnly     bool   // Cache only metadata, with new data written to the origin (PMEM mode)
+	PauseWriteback   uint32 // Pause writeback for this many milliseconds after I/O to the origin
+}
+
+// Marshal returns the table target for a writecache.
+func (t WritecacheTarget) Marshal() (dmTarget, error) {
+	switch t.Mode {
+	case WritecachePMEM, WritecacheSSD:
+	default:
+		return dmTarget{}, fmt.Errorf("Invalid writecache mode %q", t.Mode)
+	}
+
+	for _, dev := range []string{t.OriginDev, t.CacheDev} {
+		if err := checkDevice(dev); err != nil {
+			return dmTarget{}, err
+		}
+	}
+
+	if t.BlockSize < 512 || t.BlockSize > 65536 || t.BlockSize&(t.BlockSize-1) != 0 {
+		return dmTarget{}, fmt.Errorf("Invalid writecache block size %d", t.BlockSize)
+	}
+
+	if t.HighWatermark > 100 || t.LowWatermark > 100 {
+		return dmTarget{}, fmt.Errorf("Invalid writecache watermarks %d, %d", t.HighWatermark, t.LowWatermark)
+	}
+
+	if t.FUA && t.NoFUA {
+		return dmTarget{}, fmt.Errorf("Writecache FUA and no FUA are mutually exclusive")
+	}
+
+	// Optional args are emitted in the same order as the kernel reports them
+	var args []string
+
+	for _, arg := range []struct {
+		name  string
+		value uint64
+	}{
+		{"start_sector", t.StartSector},
+		{"high_watermark", uint64(t.HighWatermark)},
+		{"low_watermark", uint64(t.LowWatermark)},
+		{"writeback_jobs", uint64(t.WritebackJobs)},
+		{"autocommit_blocks", uint64(t.AutocommitBlocks)},
+		{"autocommit_time", uint64(t.AutocommitTime)},
+		{"max_age", uint64(t.MaxAge)},
+	} {
+		if arg.value != 0 {
+			args = append(args, arg.name, strconv.FormatUint(arg.value, 10))
+		}
+	}
+
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{t.Cleaner, "cleaner"},
+		{t.FUA, "fua"},
+		{t.NoFUA, "nofua"},
+		{t.MetadataOnly, "metadata_only"},
+	} {
+		if f.set {
+			args = append(args, f.name)
+		}
+	}
+
+	if t.PauseWriteback != 0 {
+		args = append(args, "pause_writeback", strconv.FormatUint(uint64(t.PauseWriteback), 10))
+	}
+
+	params := fmt.Sprintf("%s %s %s %d %d", t.Mode, t.OriginDev, t.CacheDev, t.BlockSize, len(args))
+	if len(args) > 0 {
+		params += " " + strings.Join(args, " ")
+	}
+
+	return dmTarget{t.Start, t.Length, "writecache", params}, nil
+}
+
+// Unmarshal parses a writecache table target, as returned by GetDeviceTable.
+func (t *WritecacheTarget) Unmarshal(target dmTarget) error {
+	var (
+		w   WritecacheTarget
+		n   uint64
+		err error
+	)
+
+	if err := checkTargetType(target, "writecache"); err != nil {
+		return err
+	}
+
+	r := newFieldReader(target.Params)
+
+	mode, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	w.Mode = WritecacheMode(mode)
+
+	for _, dev := range []*string{&w.OriginDev, &w.CacheDev} {
+		if *dev, err = r.next(); err != nil {
+			return err
+		}
+	}
+
+	if n, err = r.uint64(); err != nil {
+		return err
+	}
+
+	w.BlockSize = uint32(n)
+
+	args, err := r.counted()
+	if err != nil {
+		return err
+	}
+
+	if r.more() {
+		return fmt.Errorf("Unexpected writecache parameters %q", target.Params)
+	}
+
+	uint32Args := map[string]*uint32{
+		"high_watermark":    &w.HighWatermark,
+		"low_watermark":     &w.LowWatermark,
+		"writeback_jobs":    &w.WritebackJobs,
+		"autocommit_blocks": &w.AutocommitBlocks,
+		"autocommit_time":   &w.AutocommitTime,
+		"max_age":           &w.MaxAge,
+		"pause_writeback":   &w.PauseWriteback,
+	}
+
+	for x := 0; x < len(args); x++ {
+		switch name := args[x]; name {
+		case "cleaner":
+			w.Cleaner = true
+		case "fua":
+			w.FUA = true
+		case "nofua":
+			w.NoFUA = true
+		case "metadata_only":
+			w.MetadataOnly = true
+		default:
+			p, ok := uint32Args[name]
+			if !ok && name != "start_sector" {
+				return fmt.Errorf("Unknown writecache option %q", name)
+			}
+
+			if x++; x == len(args) {
+				return fmt.Errorf("Missing value for writecache option %q", name)
+			}
+
+			if n, err = strconv.ParseUint(args[x], 10, 64); err != nil || (ok && n > 1<<32-1) {
+				return fmt.Errorf("Invalid value for writecache option %q: %q", name, args[x])
+			}
+
+			if ok {
+				*p = uint32(n)
+			} else {
+				w.StartSector = n
+			}
+		}
+	}
+
+	w.Start, w.Length = target.Start, target.Length
+	*t = w
+
+	return nil
+}
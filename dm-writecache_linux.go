@@ -0,0 +1,174 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// dm-writecache Flush Messages and Detach.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WritecacheFlush commits a writecache device, and writes back all cached blocks to the origin
+// device. It returns once writeback is complete.
+func WritecacheFlush(name string) error {
+	_, err := SendMessage(name, 0, "flush")
+	return err
+}
+
+// WritecacheFlushOnSuspend arranges for a writecache device to write back all cached blocks the
+// next time it is suspended. This is used prior to removing the cache.
+func WritecacheFlushOnSuspend(name string) error {
+	_, err := SendMessage(name, 0, "flush_on_suspend")
+	return err
+}
+
+// getWritecacheTable returns the live table of a device, which must consist of a single
+// writecache target.
+func getWritecacheTable(name string) (*WritecacheTarget, error) {
+	table, err := GetDeviceTableWithKeys(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(table) != 1 {
+		return nil, fmt.Errorf("Device %s has %d targets, expected a single writecache target", name, len(table))
+	}
+
+	var w WritecacheTarget
+	if err := w.Unmarshal(table[0]); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// getWritecacheStatus returns the parsed status of a device consisting of a single writecache
+// target.
+func getWritecacheStatus(name string) (*WritecacheStatus, error) {
+	status, err := GetDeviceStatus(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(status) != 1 || status[0].Type != "writecache" {
+		return nil, fmt.Errorf("Device %s is not a writecache device", name)
+	}
+
+	s, err := parseWritecacheStatus(status[0].Params)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := s.(*WritecacheStatus)
+	if ws.Error != 0 {
+		return nil, fmt.Errorf("Writecache device %s has failed with error %d", name, ws.Error)
+	}
+
+	return ws, nil
+}
+
+// WritecacheFlushAndDetach writes back all cached blocks of a writecache device, and replaces its
+// table with a linear mapping of the origin device, so that the cache device can be removed.
+//
+// On kernels which support it, the writecache is first switched to cleaner mode, and polled at
+// the specified interval until all blocks have been written back; otherwise, the cache is flushed
+// synchronously. The device is then suspended with flush_on_suspend set, to write back any blocks
+// written in the meantime, and the linear table is swapped in if the writecache reports no error.
+//
+// If ctx is done before the cache is drained, the device is left running in cleaner mode, and
+// ctx.Err() is returned.
+func WritecacheFlushAndDetach(ctx context.Context, name string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid poll interval %v", interval)
+	}
+
+	info, err := GetDeviceInfo(name)
+	if err != nil {
+		return err
+	}
+
+	w, err := getWritecacheTable(name)
+	if err != nil {
+		return err
+	}
+
+	linear, err := LinearTarget{w.Start, w.Length, w.OriginDev, 0}.Marshal()
+	if err != nil {
+		return err
+	}
+
+	cleaner, err := TargetSupports("writecache", "cleaner")
+	if err != nil {
+		return err
+	}
+
+	if cleaner {
+		if !w.Cleaner {
+			w.Cleaner = true
+
+			target, err := w.Marshal()
+			if err != nil {
+				return err
+			}
+
+			if err := ReplaceTable(name, []dmTarget{target}); err != nil {
+				return err
+			}
+		}
+
+		if err := waitWritecacheDrained(ctx, name, interval); err != nil {
+			return err
+		}
+	} else if err := WritecacheFlush(name); err != nil {
+		return err
+	}
+
+	if err := WritecacheFlushOnSuspend(name); err != nil {
+		return err
+	}
+
+	if err := SuspendDevice(name, false); err != nil {
+		return err
+	}
+
+	// The flush on suspend may have failed, in which case the cache must remain in place
+	if _, err = getWritecacheStatus(name); err == nil {
+		if err = LoadTable(name, []dmTarget{linear}, info.ReadOnly); err == nil {
+			return ResumeDevice(name)
+		}
+	}
+
+	if rerr := ResumeDevice(name); rerr != nil {
+		return rerr
+	}
+
+	return err
+}
+
+// waitWritecacheDrained polls a writecache device until no blocks remain in the cache.
+func waitWritecacheDrained(ctx context.Context, name string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s, err := getWritecacheStatus(name)
+		if err != nil {
+			return err
+		}
+
+		if s.FreeBlocks == s.TotalBlocks && s.WritebackBlocks == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
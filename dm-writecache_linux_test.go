@@ -0,0 +1,98 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-writecache flush and detach.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWritecacheFlushAndDetach(t *testing.T) {
+	if err := WritecacheFlushAndDetach(context.Background(), "nonexistent", 0); err == nil {
+		t.Error("Expected error for zero interval")
+	}
+
+	requireDM(t)
+
+	if _, err := GetTargetVersion("writecache"); err != nil {
+		t.Skip("Writecache target not available:", err)
+	}
+
+	fast := newTestLoopDev(t, 16*(1<<20))
+	defer fast.Close()
+
+	origin := newTestLoopDev(t, 64*(1<<20))
+	defer origin.Close()
+
+	name := testDeviceName()
+
+	target, err := WritecacheTarget{Length: 131072, Mode: WritecacheSSD, OriginDev: origin.path,
+		CacheDev: fast.path, BlockSize: 4096}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateDevice(name, "", []dmTarget{target}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(name, false)
+
+	f, err := os.OpenFile("/dev/mapper/"+name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Write(bytes.Repeat([]byte{0xa5}, 1<<20))
+	f.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WritecacheFlush(name); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := WritecacheFlushAndDetach(ctx, name, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := GetDeviceTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := dmTarget{0, 131072, "linear", origin.devNo + " 0"}
+	if len(table) != 1 || table[0] != expected {
+		t.Errorf("Got table %+v, expected %+v", table, expected)
+	}
+
+	// Data written via the cache must have reached the origin
+	o, err := os.Open(origin.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer o.Close()
+
+	got := make([]byte, 4096)
+	if _, err := o.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, bytes.Repeat([]byte{0xa5}, 4096)) {
+		t.Error("Cached data was not written back to origin")
+	}
+}
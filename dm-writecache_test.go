@@ -0,0 +1,140 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for dm-writecache table builder and status parser.
+
+package devmapper
+
+import "testing"
+
+func TestParseWritecacheStatus(t *testing.T) {
+	tests := []struct {
+		params   string
+		expected WritecacheStatus
+	}{
+		{
+			"0 4096 3968 16",
+			WritecacheStatus{TotalBlocks: 4096, FreeBlocks: 3968, WritebackBlocks: 16},
+		},
+		{
+			"-5 4096 0 0 1000 250 2000 10 20 30 1940 3 7 64",
+			WritecacheStatus{
+				Error:                   -5,
+				TotalBlocks:             4096,
+				ReadBlocks:              1000,
+				ReadHits:                250,
+				WriteBlocks:             2000,
+				WriteHitsUncommitted:    10,
+				WriteHitsCommitted:      20,
+				WritesAround:            30,
+				WritesAllocate:          1940,
+				WritesBlockedOnFreelist: 3,
+				Flushes:                 7,
+				Discards:                64,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		s, err := ParseTargetStatus(dmTarget{0, 8, "writecache", test.params})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if *s.(*WritecacheStatus) != test.expected {
+			t.Errorf("%q: got %+v, expected %+v", test.params, *s.(*WritecacheStatus), test.expected)
+		}
+	}
+
+	s := WritecacheStatus{TotalBlocks: 4096, FreeBlocks: 3072, ReadBlocks: 1000, ReadHits: 250}
+	if s.UsedPerc() != 25 || s.ReadHitRatio() != 0.25 {
+		t.Errorf("Got used %f%%, read hit ratio %f", s.UsedPerc(), s.ReadHitRatio())
+	}
+
+	for _, params := range []string{"0 4096 3968", "0 4096 3968 16 1000", "x 4096 3968 16"} {
+		if _, err := parseWritecacheStatus(params); err == nil {
+			t.Errorf("Expected error for status %q", params)
+		}
+	}
+}
+
+func TestWritecacheTarget(t *testing.T) {
+	tests := []struct {
+		target WritecacheTarget
+		params string
+	}{
+		{
+			WritecacheTarget{Length: 131072, Mode: WritecacheSSD, OriginDev: "7:0", CacheDev: "7:1", BlockSize: 4096},
+			"s 7:0 7:1 4096 0",
+		},
+		{
+			WritecacheTarget{
+				Length:           131072,
+				Mode:             WritecachePMEM,
+				OriginDev:        "/dev/vg0/slow",
+				CacheDev:         "/dev/pmem0",
+				BlockSize:        4096,
+				StartSector:      2048,
+				HighWatermark:    50,
+				LowWatermark:     45,
+				WritebackJobs:    1024,
+				AutocommitBlocks: 64,
+				AutocommitTime:   1000,
+				MaxAge:           60000,
+				Cleaner:          true,
+				NoFUA:            true,
+				MetadataOnly:     true,
+				PauseWriteback:   3000,
+			},
+			"p /dev/vg0/slow /dev/pmem0 4096 19 start_sector 2048 high_watermark 50 low_watermark 45 " +
+				"writeback_jobs 1024 autocommit_blocks 64 autocommit_time 1000 max_age 60000 cleaner nofua " +
+				"metadata_only pause_writeback 3000",
+		},
+	}
+
+	for _, test := range tests {
+		target, err := test.target.Marshal()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if target.Params != test.params {
+			t.Errorf("Got %q, expected %q", target.Params, test.params)
+		}
+
+		var parsed WritecacheTarget
+		if err := parsed.Unmarshal(target); err != nil {
+			t.Error(err)
+		} else if parsed != test.target {
+			t.Errorf("Got %+v, expected %+v", parsed, test.target)
+		}
+	}
+
+	for _, w := range []WritecacheTarget{
+		{Mode: "x", OriginDev: "7:0", CacheDev: "7:1", BlockSize: 4096},
+		{Mode: WritecacheSSD, OriginDev: "7:0", CacheDev: "", BlockSize: 4096},
+		{Mode: WritecacheSSD, OriginDev: "7:0", CacheDev: "7:1", BlockSize: 1000},
+		{Mode: WritecacheSSD, OriginDev: "7:0", CacheDev: "7:1", BlockSize: 4096, HighWatermark: 101},
+		{Mode: WritecachePMEM, OriginDev: "7:0", CacheDev: "7:1", BlockSize: 4096, FUA: true, NoFUA: true},
+	} {
+		if _, err := w.Marshal(); err == nil {
+			t.Errorf("Expected error for %+v", w)
+		}
+	}
+
+	var parsed WritecacheTarget
+
+	for _, params := range []string{
+		"s 7:0 7:1 4096",
+		"s 7:0 7:1 4096 1 bogus",
+		"s 7:0 7:1 4096 1 high_watermark",
+		"s 7:0 7:1 4096 2 high_watermark x",
+		"s 7:0 7:1 4096 0 extra",
+	} {
+		if err := parsed.Unmarshal(dmTarget{0, 8, "writecache", params}); err == nil {
+			t.Errorf("Expected error for %q", params)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Devmapper event waiting and change notification.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// eventPollFallback is the interval at which devices are polled for events on kernels which do
+// not support DM_DEV_ARM_POLL (i.e. prior to 4.13).
+const eventPollFallback = time.Second
+
+// An eventPoller waits for devmapper events. Once armed, the control device becomes readable when
+// any device raises an event, so waiting is a matter of poll(2); an eventfd is polled alongside it,
+// so that the wait can be interrupted when a context is done, without leaving anything behind.
+type eventPoller struct {
+	controlFd int
+	wakeFd    int
+	armed     bool // Whether the kernel supports DM_DEV_ARM_POLL
+}
+
+func newEventPoller() (*eventPoller, error) {
+	controlFd, err := unix.Open(dmControlPath, unix.O_RDWR|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open %s - %s", dmControlPath, err)
+	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(controlFd)
+		return nil, fmt.Errorf("Cannot create eventfd - %s", err)
+	}
+
+	return &eventPoller{controlFd: controlFd, wakeFd: wakeFd, armed: true}, nil
+}
+
+// arm records the current global event number, so that the control device becomes readable
+// once it changes. It must be called before checking device event numbers, so that no event can
+// be missed. If the kernel does not support DM_DEV_ARM_POLL, the poller falls back to waking
+// periodically.
+func (p *eventPoller) arm() {
+	if !p.armed {
+		return
+	}
+
+	hdr, _ := newDmIoctl("", 0)
+	buf := hdr.marshal(nil, dmIoctlSize)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(p.controlFd), unix.DM_DEV_ARM_POLL,
+		uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		p.armed = false
+	}
+}
+
+// wait blocks until an event may have occurred since the poller was last armed, the timeout (if
+// non-zero) elapses, or ctx is done, in which case ctx.Err() is returned.
+func (p *eventPoller) wait(ctx context.Context, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !p.armed && (timeout <= 0 || timeout > eventPollFallback) {
+		timeout = eventPollFallback
+	}
+
+	ms := -1
+	if timeout > 0 {
+		ms = int((timeout + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			var one [8]byte
+			nativeEndian.PutUint64(one[:], 1)
+			unix.Write(p.wakeFd, one[:])
+		case <-done:
+		}
+	}()
+
+	fds := []unix.PollFd{{Fd: int32(p.wakeFd), Events: unix.POLLIN}}
+	if p.armed {
+		fds = append(fds, unix.PollFd{Fd: int32(p.controlFd), Events: unix.POLLIN})
+	}
+
+	for {
+		if _, err := unix.Poll(fds, ms); err == nil {
+			break
+		} else if err != unix.EINTR {
+			return fmt.Errorf("Cannot poll %s - %s", dmControlPath, err)
+		}
+	}
+
+	return ctx.Err()
+}
+
+func (p *eventPoller) close() {
+	unix.Close(p.controlFd)
+	unix.Close(p.wakeFd)
+}
+
+// WaitEvent waits until the event number of a device differs from eventNr, and returns the new
+// event number. Targets raise events on noteworthy state changes, e.g. when a thin-pool reaches
+// its low water mark, or a raid device fails. If the device's event number already differs from
+// eventNr, WaitEvent returns immediately. If the device is removed while waiting,
+// ErrDeviceNotFound is returned.
+//
+// If ctx is done before an event occurs, WaitEvent returns ctx.Err().
+func WaitEvent(ctx context.Context, name string, eventNr uint32) (uint32, error) {
+	p, err := newEventPoller()
+	if err != nil {
+		return 0, err
+	}
+
+	defer p.close()
+
+	for {
+		p.arm()
+
+		info, err := GetDeviceInfo(name)
+		if err != nil {
+			return 0, err
+		}
+
+		if info.EventNr != eventNr {
+			return info.EventNr, nil
+		}
+
+		if err := p.wait(ctx, 0); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// DeviceEventType is the type of change reported by a DeviceEvent.
+type DeviceEventType int
+
+const (
+	DeviceAdded   DeviceEventType = iota // Device was created
+	DeviceRemoved                        // Device was removed
+	DeviceChanged                        // Device's event number changed
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceRemoved:
+		return "removed"
+	case DeviceChanged:
+		return "changed"
+	}
+
+	return "unknown"
+}
+
+// A DeviceEvent reports a change to a devmapper device.
+type DeviceEvent struct {
+	Type    DeviceEventType
+	Name    string
+	EventNr uint32 // Device's event number at the time of the change
+}
+
+// A Watcher monitors devmapper devices, and reports devices which are added or removed, and
+// devices whose event numbers change.
+type Watcher struct {
+	// Interval between rescans of the device list, to detect added devices. Event number changes
+	// and removed devices are reported as they occur, regardless of the interval (except on
+	// kernels prior to 4.13, where all changes are detected by rescanning). Defaults to one second
+	// if not set.
+	Interval time.Duration
+}
+
+// NewWatcher returns a Watcher which rescans the device list at the specified interval.
+func NewWatcher(interval time.Duration) *Watcher {
+	return &Watcher{Interval: interval}
+}
+
+// Watch starts monitoring devices, and returns a channel on which DeviceEvents are delivered.
+// Devices which already exist when Watch is called are not reported as added. The channel is
+// closed once ctx is done.
+func (w *Watcher) Watch(ctx context.Context) (<-chan DeviceEvent, error) {
+	p, err := newEventPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	p.arm()
+
+	devices, err := w.scan()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+
+	events := make(chan DeviceEvent)
+
+	go w.run(ctx, p, devices, events)
+
+	return events, nil
+}
+
+// scan returns the current event number of every device.
+func (w *Watcher) scan() (map[string]uint32, error) {
+	list, err := GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]uint32, len(list))
+
+	for _, dev := range list {
+		info, err := GetDeviceInfo(dev.Name)
+		if err == ErrDeviceNotFound {
+			// Device was removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		devices[dev.Name] = info.EventNr
+	}
+
+	return devices, nil
+}
+
+func (w *Watcher) run(ctx context.Context, p *eventPoller, devices map[string]uint32, events chan<- DeviceEvent) {
+	defer close(events)
+	defer p.close()
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	emit := func(ev DeviceEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		if err := p.wait(ctx, interval); err != nil {
+			return
+		}
+
+		p.arm()
+
+		current, err := w.scan()
+		if err != nil {
+			continue
+		}
+
+		for name, eventNr := range devices {
+			if _, ok := current[name]; !ok && !emit(DeviceEvent{DeviceRemoved, name, eventNr}) {
+				return
+			}
+		}
+
+		for name, eventNr := range current {
+			old, ok := devices[name]
+
+			switch {
+			case !ok:
+				if !emit(DeviceEvent{DeviceAdded, name, eventNr}) {
+					return
+				}
+			case eventNr != old:
+				if !emit(DeviceEvent{DeviceChanged, name, eventNr}) {
+					return
+				}
+			}
+		}
+
+		devices = current
+	}
+}
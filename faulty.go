@@ -0,0 +1,187 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Fault-injection device for storage tests.
+
+package devmapper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FaultyDevice is a devmapper device backed by a loop device and a sparse temporary file, whose
+// failure mode can be changed at runtime by swapping its table. It is intended for testing how
+// storage code copes with failing disks, e.g.
+//
+//	d, err := NewFaultyDevice("test-disk", 64<<20)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer d.Close()
+//
+//	d.BadBlocks(4096, 10, 11)
+//
+// Requires root privileges.
+type FaultyDevice struct {
+	Name string // Devmapper device name
+	Path string // Device node, e.g. "/dev/mapper/test-disk"
+
+	loopNr   int
+	loopPath string
+	backing  string
+	sectors  uint64
+	created  bool
+}
+
+// NewFaultyDevice creates a healthy device of the specified size in bytes, which must be a
+// multiple of 512.
+func NewFaultyDevice(name string, size int64) (*FaultyDevice, error) {
+	if size <= 0 || size%512 != 0 {
+		return nil, fmt.Errorf("Invalid faulty device size %d", size)
+	}
+
+	tmpfile, err := ioutil.TempFile("", "devmapper_faulty_")
+	if err != nil {
+		return nil, err
+	}
+
+	defer tmpfile.Close()
+
+	d := &FaultyDevice{Name: name, Path: "/dev/mapper/" + name, loopNr: -1, backing: tmpfile.Name(),
+		sectors: uint64(size) / 512}
+
+	if err := tmpfile.Truncate(size); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if d.loopNr, err = getFreeLoopDev(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("Cannot determine next available loop device - %s", err)
+	}
+
+	if err := attachLoopDev(d.loopNr, d.backing); err != nil {
+		d.loopNr = -1
+		d.Close()
+		return nil, err
+	}
+
+	d.loopPath = fmt.Sprintf("/dev/loop%d", d.loopNr)
+
+	table, err := Table(d.linear())
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if err := CreateDevice(name, "", table, false); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	d.created = true
+
+	return d, nil
+}
+
+func (d *FaultyDevice) linear() LinearTarget {
+	return LinearTarget{0, d.sectors, d.loopPath, 0}
+}
+
+// setTarget replaces the table of the device with a single target.
+func (d *FaultyDevice) setTarget(t Target) error {
+	table, err := Table(t)
+	if err != nil {
+		return err
+	}
+
+	return ReplaceTable(d.Name, table)
+}
+
+// Healthy restores the device to normal operation.
+func (d *FaultyDevice) Healthy() error {
+	return d.setTarget(d.linear())
+}
+
+// Fail causes all I/O to the device to fail.
+func (d *FaultyDevice) Fail() error {
+	return d.setTarget(ErrorTarget{0, d.sectors})
+}
+
+// Zero causes all reads from the device to return zeros, and all writes to be discarded.
+func (d *FaultyDevice) Zero() error {
+	return d.setTarget(ZeroTarget{0, d.sectors})
+}
+
+// Flakey causes the device to alternate between reliable and unreliable periods. The start,
+// length, device and offset of f are filled in; only the intervals and features need be set.
+func (d *FaultyDevice) Flakey(f FlakeyTarget) error {
+	f.Start, f.Length, f.Device, f.Offset = 0, d.sectors, d.loopPath, 0
+	return d.setTarget(f)
+}
+
+// Delay delays reads and writes to the device by the specified durations, which are rounded
+// down to whole milliseconds.
+func (d *FaultyDevice) Delay(read, write time.Duration) error {
+	return d.setTarget(DelayTarget{
+		Length: d.sectors,
+		Read:   DelayPath{d.loopPath, 0, uint32(read / time.Millisecond)},
+		Write:  &DelayPath{d.loopPath, 0, uint32(write / time.Millisecond)},
+	})
+}
+
+// BadBlocks causes reads of the specified blocks, of blockSize bytes each, to fail until they
+// are rewritten. Any previous bad blocks are forgotten.
+func (d *FaultyDevice) BadBlocks(blockSize uint32, blocks ...uint64) error {
+	if err := d.setTarget(DustTarget{0, d.sectors, d.loopPath, 0, blockSize}); err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		if err := DustAddBadBlock(d.Name, b); err != nil {
+			return err
+		}
+	}
+
+	return DustEnable(d.Name)
+}
+
+// Close removes the device, detaches its loop device and removes its backing file. If the device
+// cannot be removed (e.g. because it is still open), nothing else is torn down, and Close may be
+// retried. Otherwise the first error encountered is returned, but teardown always continues.
+func (d *FaultyDevice) Close() error {
+	var errs []error
+
+	if d.created {
+		if err := RemoveDevice(d.Name, false); err != nil {
+			return err
+		}
+
+		d.created = false
+	}
+
+	if d.loopNr >= 0 {
+		errs = append(errs, detachLoopDev(d.loopNr))
+		d.loopNr = -1
+	}
+
+	if d.backing != "" {
+		errs = append(errs, os.Remove(d.backing))
+		d.backing = ""
+	}
+
+	d.loopPath = ""
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
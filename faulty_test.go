@@ -0,0 +1,101 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for fault-injection device.
+
+package devmapper
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFaultyDevice(t *testing.T) {
+	requireDM(t)
+
+	d, err := NewFaultyDevice(testDeviceName(), 16*(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Close()
+
+	f, err := os.OpenFile(d.Path, os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	block := bytes.Repeat([]byte{0x5a}, 4096)
+
+	readBlock := func(nr int64) error {
+		// Bypass the page cache, which would otherwise mask failures
+		if err := unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+			return err
+		}
+
+		buf := make([]byte, len(block))
+		_, err := f.ReadAt(buf, nr*4096)
+
+		return err
+	}
+
+	if _, err := f.WriteAt(block, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readBlock(0); err != nil {
+		t.Fatal("Healthy device read failed:", err)
+	}
+
+	if err := d.Fail(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readBlock(0); err == nil {
+		t.Error("Expected read error from failed device")
+	}
+
+	if err := d.Healthy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readBlock(0); err != nil {
+		t.Error("Restored device read failed:", err)
+	}
+
+	if _, err := GetTargetVersion("dust"); err == nil {
+		if err := d.BadBlocks(4096, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := readBlock(3); err == nil {
+			t.Error("Expected read error from bad block")
+		}
+
+		if err := readBlock(2); err != nil {
+			t.Error("Good block read failed:", err)
+		}
+	}
+
+	// Close fails while the device is open, and may then be retried
+	if err := d.Close(); err == nil {
+		t.Fatal("Expected error closing open device")
+	}
+
+	f.Close()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetDeviceInfo(d.Name); err != ErrDeviceNotFound {
+		t.Errorf("Device still exists after Close (%v)", err)
+	}
+}
@@ -0,0 +1,327 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Encoding and decoding of devmapper ioctl buffers, as described in <linux/dm-ioctl.h>.
+
+package devmapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dmControlPath = "/dev/" + unix.DM_DIR + "/" + unix.DM_CONTROL_NODE
+
+	dmIoctlSize      = 312 // sizeof(struct dm_ioctl)
+	dmTargetSpecSize = 40  // sizeof(struct dm_target_spec)
+	dmNameListSize   = 12  // offsetof(struct dm_name_list, name)
+
+	dmTargetVersionsSize = 16 // offsetof(struct dm_target_versions, name)
+)
+
+// nativeEndian is the byte order of the host, which is also that of devmapper ioctl buffers.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// dmIoctl is the Go equivalent of struct dm_ioctl, the fixed-size header at the start of every
+// devmapper ioctl buffer. Any variable length data follows the header, at offset DataStart.
+type dmIoctl struct {
+	Version     [3]uint32 // Interface version; in/out
+	DataSize    uint32    // Total size of buffer, including this header
+	DataStart   uint32    // Offset to start of data, relative to start of this header
+	TargetCount uint32    // In/out
+	OpenCount   int32     // Out
+	Flags       uint32    // In/out
+	EventNr     uint32    // In/out
+	Padding     uint32
+	Dev         uint64 // In/out
+	Name        [unix.DM_NAME_LEN]byte
+	UUID        [unix.DM_UUID_LEN]byte
+	Data        [7]byte // Padding or data
+}
+
+// dmTargetSpec is the Go equivalent of struct dm_target_spec, which precedes the NUL-terminated
+// parameter string of each target in a table load or table / status result.
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32 // Offset to next target spec
+	TargetType  [unix.DM_MAX_TYPE_NAME]byte
+}
+
+// newDmIoctl returns a dm_ioctl header for device `name`, with the specified flags set.
+func newDmIoctl(name string, flags uint32) (*dmIoctl, error) {
+	hdr := &dmIoctl{
+		Version: [3]uint32{unix.DM_VERSION_MAJOR, 0, 0},
+		Flags:   flags,
+	}
+
+	if len(name) >= len(hdr.Name) {
+		return nil, fmt.Errorf("Device name too long: %q", name)
+	}
+
+	copy(hdr.Name[:], name)
+
+	return hdr, nil
+}
+
+// setUUID sets the device UUID stored in the header.
+func (d *dmIoctl) setUUID(uuid string) error {
+	if len(uuid) >= len(d.UUID) {
+		return fmt.Errorf("Device UUID too long: %q", uuid)
+	}
+
+	copy(d.UUID[:], uuid)
+
+	return nil
+}
+
+// marshal encodes the header and payload into a buffer of at least bufSize bytes, suitable for
+// passing to the kernel. The DataSize and DataStart fields are set accordingly.
+func (d *dmIoctl) marshal(payload []byte, bufSize int) []byte {
+	size := dmIoctlSize + len(payload)
+	if size < bufSize {
+		size = bufSize
+	}
+
+	d.DataSize = uint32(size)
+	d.DataStart = dmIoctlSize
+
+	var b bytes.Buffer
+	binary.Write(&b, nativeEndian, d)
+
+	buf := make([]byte, size)
+	copy(buf, b.Bytes())
+	copy(buf[dmIoctlSize:], payload)
+
+	return buf
+}
+
+// unmarshalDmIoctl decodes the dm_ioctl header at the start of buf, and returns it along with the
+// data area that follows it.
+func unmarshalDmIoctl(buf []byte) (*dmIoctl, []byte, error) {
+	var d dmIoctl
+
+	if len(buf) < dmIoctlSize {
+		return nil, nil, fmt.Errorf("Short dm_ioctl buffer: %d bytes", len(buf))
+	}
+
+	if err := binary.Read(bytes.NewReader(buf[:dmIoctlSize]), nativeEndian, &d); err != nil {
+		return nil, nil, err
+	}
+
+	start, end := int(d.DataStart), int(d.DataSize)
+	if end > len(buf) {
+		end = len(buf)
+	}
+
+	if start < dmIoctlSize || start > end {
+		return nil, nil, fmt.Errorf("Invalid dm_ioctl data offset %d (size %d)", start, end)
+	}
+
+	return &d, buf[start:end], nil
+}
+
+// name returns the device name stored in the header.
+func (d *dmIoctl) name() string {
+	return cString(d.Name[:])
+}
+
+// uuid returns the device UUID stored in the header.
+func (d *dmIoctl) uuid() string {
+	return cString(d.UUID[:])
+}
+
+// info returns the device info contained in the header of a successful ioctl result.
+func (d *dmIoctl) info() DeviceInfo {
+	return DeviceInfo{
+		Name:           d.name(),
+		UUID:           d.uuid(),
+		Exists:         true,
+		Suspended:      d.Flags&unix.DM_SUSPEND_FLAG != 0,
+		LiveTable:      d.Flags&unix.DM_ACTIVE_PRESENT_FLAG != 0,
+		InactiveTable:  d.Flags&unix.DM_INACTIVE_PRESENT_FLAG != 0,
+		ReadOnly:       d.Flags&unix.DM_READONLY_FLAG != 0,
+		DeferredRemove: d.Flags&unix.DM_DEFERRED_REMOVE != 0,
+		OpenCount:      d.OpenCount,
+		EventNr:        d.EventNr,
+		TargetCount:    int32(d.TargetCount),
+		Major:          unix.Major(d.Dev),
+		Minor:          unix.Minor(d.Dev),
+	}
+}
+
+// marshalTargets encodes a table as a sequence of dm_target_spec structs, each followed by its
+// NUL-terminated parameters, for use with DM_TABLE_LOAD. Each target spec's Next field is the
+// offset of the following spec, relative to the current one.
+func marshalTargets(targets []dmTarget) ([]byte, error) {
+	var b bytes.Buffer
+
+	for _, t := range targets {
+		spec := dmTargetSpec{SectorStart: t.Start, Length: t.Length}
+
+		if len(t.Type) >= len(spec.TargetType) {
+			return nil, fmt.Errorf("Target type too long: %q", t.Type)
+		}
+
+		copy(spec.TargetType[:], t.Type)
+
+		// Params are NUL-terminated, and the next spec must be 8-byte aligned
+		spec.Next = uint32(align8(dmTargetSpecSize + len(t.Params) + 1))
+
+		binary.Write(&b, nativeEndian, &spec)
+		b.WriteString(t.Params)
+		b.Write(make([]byte, int(spec.Next)-dmTargetSpecSize-len(t.Params)))
+	}
+
+	return b.Bytes(), nil
+}
+
+// marshalTargetMsg encodes a struct dm_target_msg, i.e. the target sector followed by the
+// NUL-terminated message, for use with DM_TARGET_MSG.
+func marshalTargetMsg(sector uint64, message string) []byte {
+	b := make([]byte, 8+len(message)+1)
+
+	nativeEndian.PutUint64(b, sector)
+	copy(b[8:], message)
+
+	return b
+}
+
+// unmarshalTargets decodes count targets from the data area of a DM_TABLE_STATUS result. Unlike
+// a table load, the Next field of each target spec returned by the kernel is an offset relative
+// to the start of the data area.
+func unmarshalTargets(data []byte, count int) ([]dmTarget, error) {
+	var (
+		targets []dmTarget
+		offset  int
+	)
+
+	for x := 0; x < count; x++ {
+		var spec dmTargetSpec
+
+		if offset+dmTargetSpecSize > len(data) {
+			return nil, fmt.Errorf("Target spec %d exceeds data buffer", x)
+		}
+
+		binary.Read(bytes.NewReader(data[offset:]), nativeEndian, &spec)
+
+		targets = append(targets, dmTarget{
+			spec.SectorStart,
+			spec.Length,
+			cString(spec.TargetType[:]),
+			cString(data[offset+dmTargetSpecSize:]),
+		})
+
+		offset = int(spec.Next)
+	}
+
+	return targets, nil
+}
+
+// unmarshalNames decodes the list of struct dm_name_list entries returned by DM_LIST_DEVICES.
+func unmarshalNames(data []byte) ([]dmDevice, error) {
+	var devices []dmDevice
+
+	// The kernel may return no data at all if there are no devices
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	for offset := 0; ; {
+		if offset+dmNameListSize > len(data) {
+			return nil, fmt.Errorf("Name list entry exceeds data buffer")
+		}
+
+		dev := nativeEndian.Uint64(data[offset:])
+		next := nativeEndian.Uint32(data[offset+8:])
+
+		// A device number of zero signals an empty list
+		if dev == 0 {
+			break
+		}
+
+		devices = append(devices, dmDevice{dev, cString(data[offset+dmNameListSize:])})
+
+		if next == 0 {
+			break
+		}
+
+		offset += int(next)
+	}
+
+	return devices, nil
+}
+
+// unmarshalDeps decodes the struct dm_target_deps returned by DM_TABLE_DEPS, i.e. a count
+// followed by an array of device numbers.
+func unmarshalDeps(data []byte) ([]uint64, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("Short dm_target_deps buffer: %d bytes", len(data))
+	}
+
+	count := int(nativeEndian.Uint32(data))
+	if len(data) < 8+count*8 {
+		return nil, fmt.Errorf("Device count %d exceeds data buffer", count)
+	}
+
+	deps := make([]uint64, count)
+	for x := range deps {
+		deps[x] = nativeEndian.Uint64(data[8+x*8:])
+	}
+
+	return deps, nil
+}
+
+// unmarshalVersions decodes the list of struct dm_target_versions entries returned by
+// DM_LIST_VERSIONS and DM_GET_TARGET_VERSION.
+func unmarshalVersions(data []byte) ([]TargetVersion, error) {
+	var versions []TargetVersion
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	for offset := 0; ; {
+		if offset+dmTargetVersionsSize > len(data) {
+			return nil, fmt.Errorf("Target version entry exceeds data buffer")
+		}
+
+		next := nativeEndian.Uint32(data[offset:])
+
+		versions = append(versions, TargetVersion{
+			cString(data[offset+dmTargetVersionsSize:]),
+			Version{
+				nativeEndian.Uint32(data[offset+4:]),
+				nativeEndian.Uint32(data[offset+8:]),
+				nativeEndian.Uint32(data[offset+12:]),
+			},
+		})
+
+		if next == 0 {
+			break
+		}
+
+		offset += int(next)
+	}
+
+	return versions, nil
+}
+
+// align8 rounds n up to the next multiple of 8.
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
@@ -0,0 +1,265 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for devmapper ioctl buffer encoding.
+
+package devmapper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Data areas as returned by the kernel on a little-endian (x86_64) host.
+const (
+	// DM_LIST_DEVICES: vg0-root (253:0, with UUID) and vg0-swap (253:1, without UUID)
+	listDevicesBlob = "00fd000000000000280000007667302d726f6f7400000000030000000100000" +
+		"04c564d2d6162630001fd000000000000000000007667302d737761700000000003000000020000" +
+		"00"
+
+	// DM_TABLE_STATUS with DM_STATUS_TABLE_FLAG: one linear and one striped target. Note that
+	// the target spec `next` fields are relative to the start of the data area.
+	tableStatusBlob = "0000000000000000000800000000000000000000380000006c696e6561720000000" +
+		"0000000000000373a302032303438000000000000000000080000000000000010000000000000000" +
+		"000007800000073747269706564000000000000000000322031323820373a31203020373a322030" +
+		"00000000000000"
+
+	// DM_TABLE_LOAD payload for the same table. Target spec `next` fields are relative to the
+	// start of each spec.
+	tableLoadBlob = "0000000000000000000800000000000000000000380000006c696e65617200000000" +
+		"000000000000373a302032303438000000000000000000080000000000000010000000000000000" +
+		"000004000000073747269706564000000000000000000322031323820373a31203020373a322030" +
+		"00000000000000"
+)
+
+// First 48 bytes of a DM_DEV_STATUS result header for a suspended, read-only device 253:3, with
+// one target and an open count of 2. The name and UUID fields follow at offsets 48 and 176.
+const devStatusHeaderBlob = "040000003000000000000000380100003801000001000000020000002300000005" +
+	"0000000000000003fd000000000000"
+
+var testTable = []dmTarget{
+	{0, 2048, "linear", "7:0 2048"},
+	{2048, 4096, "striped", "2 128 7:1 0 7:2 0"},
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func skipIfBigEndian(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("Test blobs are little-endian")
+	}
+}
+
+func TestDmIoctlSize(t *testing.T) {
+	if n := binary.Size(dmIoctl{}); n != dmIoctlSize {
+		t.Errorf("sizeof(struct dm_ioctl) = %d, expected %d", n, dmIoctlSize)
+	}
+
+	if n := binary.Size(dmTargetSpec{}); n != dmTargetSpecSize {
+		t.Errorf("sizeof(struct dm_target_spec) = %d, expected %d", n, dmTargetSpecSize)
+	}
+}
+
+func TestDmIoctlMarshal(t *testing.T) {
+	skipIfBigEndian(t)
+
+	hdr, err := newDmIoctl("test", unix.DM_STATUS_TABLE_FLAG)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte{1, 2, 3}
+	buf := hdr.marshal(payload, 1024)
+
+	if len(buf) != 1024 {
+		t.Fatalf("Buffer length %d, expected 1024", len(buf))
+	}
+
+	expected := map[int][]byte{
+		0:   {4, 0, 0, 0},             // version[0]
+		12:  {0x00, 0x04, 0x00, 0x00}, // data_size
+		16:  {0x38, 0x01, 0x00, 0x00}, // data_start
+		28:  {0x10, 0x00, 0x00, 0x00}, // flags
+		48:  []byte("test\x00"),       // name
+		312: payload,
+	}
+
+	for offset, b := range expected {
+		if !bytes.Equal(buf[offset:offset+len(b)], b) {
+			t.Errorf("Offset %d: got % x, expected % x", offset, buf[offset:offset+len(b)], b)
+		}
+	}
+
+	res, data, err := unmarshalDmIoctl(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.name() != "test" || res.Flags != unix.DM_STATUS_TABLE_FLAG || len(data) != 1024-dmIoctlSize {
+		t.Errorf("Unexpected round-trip result: %+v", res)
+	}
+}
+
+func TestDmIoctlInfo(t *testing.T) {
+	skipIfBigEndian(t)
+
+	buf := make([]byte, dmIoctlSize)
+	copy(buf, mustDecodeHex(t, devStatusHeaderBlob))
+	copy(buf[48:], "vg0-data")
+	copy(buf[176:], "LVM-xyz")
+
+	hdr, _, err := unmarshalDmIoctl(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DeviceInfo{
+		Name:        "vg0-data",
+		UUID:        "LVM-xyz",
+		Exists:      true,
+		Suspended:   true,
+		LiveTable:   true,
+		ReadOnly:    true,
+		OpenCount:   2,
+		EventNr:     5,
+		TargetCount: 1,
+		Major:       253,
+		Minor:       3,
+	}
+
+	if info := hdr.info(); info != expected {
+		t.Errorf("Got %+v, expected %+v", info, expected)
+	}
+}
+
+func TestDmIoctlLongName(t *testing.T) {
+	if _, err := newDmIoctl(string(make([]byte, unix.DM_NAME_LEN)), 0); err == nil {
+		t.Error("Expected error for over-length device name")
+	}
+}
+
+func TestUnmarshalDmIoctlShort(t *testing.T) {
+	if _, _, err := unmarshalDmIoctl(make([]byte, 100)); err == nil {
+		t.Error("Expected error for short buffer")
+	}
+}
+
+func TestUnmarshalNames(t *testing.T) {
+	skipIfBigEndian(t)
+
+	devices, err := unmarshalNames(mustDecodeHex(t, listDevicesBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []dmDevice{{0xfd00, "vg0-root"}, {0xfd01, "vg0-swap"}}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("Got %#v, expected %#v", devices, expected)
+	}
+
+	// No devices
+	for _, data := range [][]byte{nil, make([]byte, 16)} {
+		if devices, err := unmarshalNames(data); err != nil || len(devices) != 0 {
+			t.Errorf("Expected empty device list, got %#v, %v", devices, err)
+		}
+	}
+}
+
+func TestUnmarshalTargets(t *testing.T) {
+	skipIfBigEndian(t)
+
+	targets, err := unmarshalTargets(mustDecodeHex(t, tableStatusBlob), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(targets, testTable) {
+		t.Errorf("Got %#v, expected %#v", targets, testTable)
+	}
+
+	if _, err := unmarshalTargets(mustDecodeHex(t, tableStatusBlob), 3); err == nil {
+		t.Error("Expected error for target count exceeding data")
+	}
+}
+
+func TestMarshalTargets(t *testing.T) {
+	skipIfBigEndian(t)
+
+	b, err := marshalTargets(testTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := mustDecodeHex(t, tableLoadBlob); !bytes.Equal(b, expected) {
+		t.Errorf("Got\n%s\nexpected\n%s", hex.Dump(b), hex.Dump(expected))
+	}
+
+	if _, err := marshalTargets([]dmTarget{{0, 1, "a-very-long-target-type", ""}}); err == nil {
+		t.Error("Expected error for over-length target type")
+	}
+}
+
+func TestMarshalTargetMsg(t *testing.T) {
+	skipIfBigEndian(t)
+
+	expected := mustDecodeHex(t, "00080000000000006372656174655f7468696e203100")
+
+	if b := marshalTargetMsg(2048, "create_thin 1"); !bytes.Equal(b, expected) {
+		t.Errorf("Got % x, expected % x", b, expected)
+	}
+}
+
+func TestUnmarshalDeps(t *testing.T) {
+	skipIfBigEndian(t)
+
+	// Two devices, 8:1 and 253:0
+	data := mustDecodeHex(t, "02000000000000000108000000000000"+"00fd000000000000")
+
+	deps, err := unmarshalDeps(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []uint64{unix.Mkdev(8, 1), unix.Mkdev(253, 0)}; !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Got %v, expected %v", deps, expected)
+	}
+
+	if _, err := unmarshalDeps(data[:16]); err == nil {
+		t.Error("Expected error for device count exceeding data")
+	}
+}
+
+func TestUnmarshalVersions(t *testing.T) {
+	skipIfBigEndian(t)
+
+	// DM_LIST_VERSIONS: linear 1.4.0 and thin-pool 1.22.0
+	data := mustDecodeHex(t, "18000000010000000400000000000000"+"6c696e6561720000"+
+		"00000000010000001600000000000000"+"7468696e2d706f6f6c00000000000000")
+
+	versions, err := unmarshalVersions(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TargetVersion{{"linear", Version{1, 4, 0}}, {"thin-pool", Version{1, 22, 0}}}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("Got %#v, expected %#v", versions, expected)
+	}
+
+	if _, err := unmarshalVersions(data[:30]); err == nil {
+		t.Error("Expected error for truncated version list")
+	}
+}
@@ -1,4 +1,4 @@
-// +build linux
+// +build linux,cgo
 
 // Copyright 2017-18 Daniel Swarbrick. All rights reserved.
 // Use of this source code is governed by a GPL license that can be found in the LICENSE file.
@@ -10,27 +10,12 @@ package devmapper
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"testing"
-	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func randString(length int) string {
-	rand.Seed(time.Now().UnixNano())
-
-	letters := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]byte, length)
-
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-
-	return string(b)
-}
-
 // WIP: Create loop image, attach it to first available loop device
 // TODO: Break this up into subtests and fail fast if a preceding step fails
 // TODO: Reassess `defer` statements - certain setup actions must be torn down in a specific order,
@@ -0,0 +1,153 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Target status parsing.
+
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A dmTarget is a single target of a device table. Its Params field holds either the target's
+// table parameters or its status line, depending on how it was obtained.
+type dmTarget struct {
+	Start  uint64
+	Length uint64
+	Type   string
+	Params string
+}
+
+// statusParsers maps target types to functions which parse their status lines.
+var statusParsers = map[string]func(params string) (interface{}, error){
+	"cache":          parseCacheStatus,
+	"dust":           parseDustStatus,
+	"integrity":      parseIntegrityStatus,
+	"mirror":         parseMirrorStatus,
+	"multipath":      parseMultipathStatus,
+	"raid":           parseRaidStatus,
+	"snapshot":       parseSnapshotStatus,
+	"snapshot-merge": parseSnapshotStatus,
+	"thin":           parseThinStatus,
+	"thin-pool":      parseThinPoolStatus,
+	"vdo":            parseVDOStatus,
+	"writecache":     parseWritecacheStatus,
+}
+
+// ParseTargetStatus parses a target status line, as returned by GetDeviceStatus, into a typed
+// status struct according to the target type. The status lines of target types which have no
+// parser are returned as a raw string.
+func ParseTargetStatus(target dmTarget) (interface{}, error) {
+	if parse, ok := statusParsers[target.Type]; ok {
+		status, err := parse(target.Params)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse %s status %q: %s", target.Type, target.Params, err)
+		}
+
+		return status, nil
+	}
+
+	return target.Params, nil
+}
+
+// A fieldReader consumes the whitespace-separated fields of a target status or table line.
+type fieldReader struct {
+	fields []string
+	pos    int
+}
+
+func newFieldReader(params string) *fieldReader {
+	return &fieldReader{fields: strings.Fields(params)}
+}
+
+// more returns true if there are unconsumed fields.
+func (r *fieldReader) more() bool {
+	return r.pos < len(r.fields)
+}
+
+// peek returns the next field without consuming it, or an empty string if there are no more
+// fields.
+func (r *fieldReader) peek() string {
+	if !r.more() {
+		return ""
+	}
+
+	return r.fields[r.pos]
+}
+
+// next returns the next field.
+func (r *fieldReader) next() (string, error) {
+	if !r.more() {
+		return "", fmt.Errorf("Unexpected end of parameters")
+	}
+
+	r.pos++
+
+	return r.fields[r.pos-1], nil
+}
+
+// uint64 returns the next field as an unsigned integer.
+func (r *fieldReader) uint64() (uint64, error) {
+	f, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(f, 10, 64)
+}
+
+// int returns the next field as an integer.
+func (r *fieldReader) int() (int, error) {
+	f, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(f)
+}
+
+// ratio returns the next field, which must be of the form "<n>/<total>".
+func (r *fieldReader) ratio() (n, total uint64, err error) {
+	f, err := r.next()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	parts := strings.Split(f, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid ratio %q", f)
+	}
+
+	if n, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+
+	if total, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+
+	return n, total, nil
+}
+
+// counted returns a group of fields prefixed by their count, e.g. "3 a b c".
+func (r *fieldReader) counted() ([]string, error) {
+	n, err := r.int()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.take(n)
+}
+
+// take returns the next n fields.
+func (r *fieldReader) take(n int) ([]string, error) {
+	if n < 0 || r.pos+n > len(r.fields) {
+		return nil, fmt.Errorf("Unexpected end of parameters")
+	}
+
+	r.pos += n
+
+	return r.fields[r.pos-n : r.pos], nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for target status parsing.
+
+package devmapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetStatus(t *testing.T) {
+	tests := []struct {
+		target   dmTarget
+		expected interface{}
+	}{
+		{
+			dmTarget{0, 2097152, "thin-pool", "1 138/4096 2048/16384 - rw discard_passdown queue_if_no_space - 1024"},
+			&ThinPoolStatus{
+				TransactionID:        1,
+				UsedMetadataBlocks:   138,
+				TotalMetadataBlocks:  4096,
+				UsedDataBlocks:       2048,
+				TotalDataBlocks:      16384,
+				Mode:                 "rw",
+				DiscardMode:          "discard_passdown",
+				MetadataLowWatermark: 1024,
+			},
+		},
+		{
+			dmTarget{0, 2097152, "thin-pool", "Fail"},
+			&ThinPoolStatus{Failed: true},
+		},
+		{
+			dmTarget{0, 2097152, "thin", "262144 524287"},
+			&ThinStatus{MappedSectors: 262144, HighestMappedSector: 524287},
+		},
+		{
+			dmTarget{0, 2097152, "thin", "0 -"},
+			&ThinStatus{},
+		},
+		{
+			dmTarget{0, 2097152, "raid", "raid1 2 AA 2097152/2097152 idle 0 0 -"},
+			&RaidStatus{
+				RaidType:    "raid1",
+				Devices:     2,
+				Health:      "AA",
+				SyncCurrent: 2097152,
+				SyncTotal:   2097152,
+				SyncAction:  RaidActionIdle,
+				Journal:     "-",
+			},
+		},
+		{
+			dmTarget{0, 2097152, "snapshot", "16/409600 16"},
+			&SnapshotStatus{AllocatedSectors: 16, TotalSectors: 409600, MetadataSectors: 16},
+		},
+		{
+			dmTarget{0, 2097152, "snapshot", "Invalid"},
+			&SnapshotStatus{Invalid: true},
+		},
+		{
+			dmTarget{0, 2097152, "mirror", "2 253:2 253:3 512/1024 1 AD 3 disk 253:1 A"},
+			&MirrorStatus{
+				Devices:       []string{"253:2", "253:3"},
+				InSyncRegions: 512,
+				TotalRegions:  1024,
+				Health:        "AD",
+				LogType:       "disk",
+				LogArgs:       []string{"253:1", "A"},
+			},
+		},
+		{
+			dmTarget{0, 2097152, "multipath", "2 0 0 0 2 1 A 0 2 0 8:16 A 0 8:32 F 3 E 0 1 0 8:48 A 0"},
+			&MultipathStatus{
+				Features:  []string{"0", "0"},
+				HWHandler: []string{},
+				NextGroup: 1,
+				Groups: []MultipathGroupStatus{
+					{
+						State:        "A",
+						SelectorArgs: []string{},
+						Paths: []MultipathPathStatus{
+							{Device: "8:16", Active: true, SelectorArgs: []string{}},
+							{Device: "8:32", FailCount: 3, SelectorArgs: []string{}},
+						},
+					},
+					{
+						State:        "E",
+						SelectorArgs: []string{},
+						Paths: []MultipathPathStatus{
+							{Device: "8:48", Active: true, SelectorArgs: []string{}},
+						},
+					},
+				},
+			},
+		},
+		{
+			dmTarget{0, 2097152, "linear", ""},
+			"",
+		},
+		{
+			dmTarget{0, 2097152, "flakey", "some unknown status"},
+			"some unknown status",
+		},
+	}
+
+	for _, test := range tests {
+		status, err := ParseTargetStatus(test.target)
+		if err != nil {
+			t.Errorf("%s: %s", test.target.Type, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(status, test.expected) {
+			t.Errorf("%s: got %#v, expected %#v", test.target.Type, status, test.expected)
+		}
+	}
+}
+
+func TestParseTargetStatusErrors(t *testing.T) {
+	for _, target := range []dmTarget{
+		{0, 8, "thin-pool", "1 138/4096"},
+		{0, 8, "thin", "foo"},
+		{0, 8, "raid", "raid1 2 AA"},
+		{0, 8, "snapshot", "16 409600 16"},
+		{0, 8, "mirror", "2 253:2 253:3 512/1024 1 AD 0"},
+		{0, 8, "multipath", "2 0 0 0 1 1 A 0 2 0 8:16 A 0"},
+	} {
+		if _, err := ParseTargetStatus(target); err == nil {
+			t.Errorf("%s: expected error for status %q", target.Type, target.Params)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Typed table targets.
+
+package devmapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Target is a typed table target, which can be marshalled into the generic form accepted by
+// CreateDevice and LoadTable.
+type Target interface {
+	Marshal() (dmTarget, error)
+}
+
+// Table marshals a sequence of typed targets into a table.
+func Table(targets ...Target) ([]dmTarget, error) {
+	table := make([]dmTarget, len(targets))
+
+	for x, t := range targets {
+		var err error
+
+		if table[x], err = t.Marshal(); err != nil {
+			return nil, err
+		}
+	}
+
+	return table, nil
+}
+
+// checkTargetType returns an error if a table target is not of the expected type.
+func checkTargetType(target dmTarget, expected string) error {
+	if target.Type != expected {
+		return fmt.Errorf("Target type is %q, expected %q", target.Type, expected)
+	}
+
+	return nil
+}
+
+// checkDevice returns an error if dev cannot be used as a device in a table line. Devices may be
+// specified either by path, or as major:minor.
+func checkDevice(dev string) error {
+	if dev == "" {
+		return fmt.Errorf("Device not specified")
+	}
+
+	if strings.IndexFunc(dev, func(r rune) bool { return r <= ' ' }) >= 0 {
+		return fmt.Errorf("Invalid device %q", dev)
+	}
+
+	return nil
+}
+
+// DevNo returns the major:minor form of a device number, as used in tables.
+func DevNo(major, minor uint32) string {
+	return fmt.Sprintf("%d:%d", major, minor)
+}
@@ -0,0 +1,324 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Devmapper device dependency graph.
+
+package devmapper
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// A TopologyNode is a block device which is part of a devmapper device stack.
+type TopologyNode struct {
+	Major   uint32
+	Minor   uint32
+	Name    string          // Kernel block device name, e.g. "dm-0" or "sda"; empty if unknown
+	DMName  string          // Devmapper device name; empty if not a devmapper device
+	Holders []*TopologyNode // Devices stacked on top of this device
+	Slaves  []*TopologyNode // Devices underlying this device
+}
+
+// Dev returns the device number of the node, as major:minor.
+func (n *TopologyNode) Dev() string {
+	return fmt.Sprintf("%d:%d", n.Major, n.Minor)
+}
+
+func (n *TopologyNode) String() string {
+	name := n.DMName
+	if name == "" {
+		name = n.Name
+	}
+
+	return fmt.Sprintf("%s (%s)", name, n.Dev())
+}
+
+// A Topology is a directed graph of devmapper devices, the block devices underlying them, and any
+// devices stacked on top of them.
+type Topology struct {
+	Nodes []*TopologyNode // All nodes, ordered by device number
+}
+
+// GetTopology builds the topology of all devmapper devices, from their table dependencies and the
+// holders / slaves relationships of block devices in sysfs.
+func GetTopology() (*Topology, error) {
+	devices, err := GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+
+	deps, err := collectDeps(devices, GetDeviceDeps)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildTopology(devices, deps, "/sys")
+}
+
+// collectDeps returns the dependencies of each device, as reported by getDeps. Devices which no
+// longer exist are omitted.
+func collectDeps(devices []dmDevice, getDeps func(string) ([]uint64, error)) (map[string][]uint64, error) {
+	deps := make(map[string][]uint64, len(devices))
+
+	for _, dev := range devices {
+		d, err := getDeps(dev.Name)
+		if errors.Is(err, ErrDeviceNotFound) {
+			// Device was removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		deps[dev.Name] = d
+	}
+
+	return deps, nil
+}
+
+// buildTopology builds a Topology from a list of devmapper devices and their dependencies, and
+// the sysfs tree mounted at sysfs.
+func buildTopology(devices []dmDevice, deps map[string][]uint64, sysfs string) (*Topology, error) {
+	nodes := make(map[uint64]*TopologyNode)
+
+	node := func(dev uint64) *TopologyNode {
+		if n, ok := nodes[dev]; ok {
+			return n
+		}
+
+		n := &TopologyNode{Major: unix.Major(dev), Minor: unix.Minor(dev)}
+		nodes[dev] = n
+
+		return n
+	}
+
+	// Edges from each device to the devices underlying it
+	slaves := make(map[uint64]map[uint64]bool)
+
+	addEdge := func(holder, slave uint64) {
+		if slaves[holder] == nil {
+			slaves[holder] = make(map[uint64]bool)
+		}
+
+		slaves[holder][slave] = true
+	}
+
+	for _, dev := range devices {
+		node(dev.Dev).DMName = dev.Name
+
+		for _, d := range deps[dev.Name] {
+			addEdge(dev.Dev, d)
+		}
+	}
+
+	names, err := sysfsBlockDevices(sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]uint64, len(names))
+	for dev, name := range names {
+		byName[name] = dev
+	}
+
+	// Holders and slaves should mirror each other, but read both in case either is incomplete
+	for dev, name := range names {
+		for _, rel := range []string{"holders", "slaves"} {
+			entries, err := ioutil.ReadDir(filepath.Join(sysfs, "block", name, rel))
+			if err != nil {
+				// Partitions have no holders / slaves directories of their own in /sys/block
+				continue
+			}
+
+			for _, e := range entries {
+				other, ok := byName[e.Name()]
+				if !ok {
+					continue
+				}
+
+				if rel == "slaves" {
+					addEdge(dev, other)
+				} else {
+					addEdge(other, dev)
+				}
+			}
+		}
+	}
+
+	// Only include devices which are connected to a devmapper device
+	holders := make(map[uint64][]uint64)
+	for holder, s := range slaves {
+		for slave := range s {
+			holders[slave] = append(holders[slave], holder)
+		}
+	}
+
+	var queue []uint64
+	for _, dev := range devices {
+		queue = append(queue, dev.Dev)
+	}
+
+	for len(queue) > 0 {
+		dev := queue[0]
+		queue = queue[1:]
+
+		n := node(dev)
+		if n.Name == "" {
+			n.Name = names[dev]
+		}
+
+		for slave := range slaves[dev] {
+			if _, ok := nodes[slave]; !ok {
+				queue = append(queue, slave)
+			}
+
+			node(slave)
+		}
+
+		for _, holder := range holders[dev] {
+			if _, ok := nodes[holder]; !ok {
+				queue = append(queue, holder)
+			}
+
+			node(holder)
+		}
+	}
+
+	t := &Topology{}
+
+	for dev, n := range nodes {
+		for slave := range slaves[dev] {
+			s := nodes[slave]
+			n.Slaves = append(n.Slaves, s)
+			s.Holders = append(s.Holders, n)
+		}
+
+		t.Nodes = append(t.Nodes, n)
+	}
+
+	sortNodes(t.Nodes)
+
+	for _, n := range t.Nodes {
+		sortNodes(n.Holders)
+		sortNodes(n.Slaves)
+	}
+
+	return t, nil
+}
+
+// sysfsBlockDevices returns the kernel names of all block devices (including partitions) found in
+// sysfs, keyed by device number.
+func sysfsBlockDevices(sysfs string) (map[uint64]string, error) {
+	dir := filepath.Join(sysfs, "class", "block")
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make(map[uint64]string, len(entries))
+
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), "dev"))
+		if err != nil {
+			continue
+		}
+
+		var major, minor uint32
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &major, &minor); err != nil {
+			continue
+		}
+
+		names[unix.Mkdev(major, minor)] = e.Name()
+	}
+
+	return names, nil
+}
+
+func sortNodes(nodes []*TopologyNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Major != nodes[j].Major {
+			return nodes[i].Major < nodes[j].Major
+		}
+		return nodes[i].Minor < nodes[j].Minor
+	})
+}
+
+// Roots returns the nodes which have no holders, i.e. the tops of device stacks.
+func (t *Topology) Roots() (roots []*TopologyNode) {
+	for _, n := range t.Nodes {
+		if len(n.Holders) == 0 {
+			roots = append(roots, n)
+		}
+	}
+
+	return
+}
+
+// Leaves returns the nodes which have no slaves, i.e. the devices at the bottom of device stacks.
+func (t *Topology) Leaves() (leaves []*TopologyNode) {
+	for _, n := range t.Nodes {
+		if len(n.Slaves) == 0 {
+			leaves = append(leaves, n)
+		}
+	}
+
+	return
+}
+
+// TeardownOrder returns the devmapper devices in an order in which they can safely be removed,
+// i.e. every device precedes the devices underlying it.
+func (t *Topology) TeardownOrder() []*TopologyNode {
+	var (
+		order   []*TopologyNode
+		visited = make(map[*TopologyNode]bool)
+		visit   func(n *TopologyNode)
+	)
+
+	visit = func(n *TopologyNode) {
+		if visited[n] {
+			return
+		}
+
+		visited[n] = true
+
+		for _, h := range n.Holders {
+			visit(h)
+		}
+
+		if n.DMName != "" {
+			order = append(order, n)
+		}
+	}
+
+	for _, n := range t.Nodes {
+		visit(n)
+	}
+
+	return order
+}
+
+// ActivationOrder returns the devmapper devices in an order in which they can be activated, i.e.
+// every device is preceded by the devices underlying it.
+func (t *Topology) ActivationOrder() []*TopologyNode {
+	teardown := t.TeardownOrder()
+	order := make([]*TopologyNode, len(teardown))
+
+	for x, n := range teardown {
+		order[len(order)-1-x] = n
+	}
+
+	return order
+}
@@ -0,0 +1,218 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for devmapper device dependency graph.
+
+package devmapper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeFakeSysfs creates a minimal sysfs tree containing the specified block devices, and their
+// slaves / holders relationships.
+func makeFakeSysfs(t *testing.T, devices map[string]string, slaves, holders map[string][]string) string {
+	root, err := ioutil.TempDir("", "sysfs_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkfile := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, dev := range devices {
+		mkfile(filepath.Join(root, "class", "block", name, "dev"), dev+"\n")
+	}
+
+	for name, s := range slaves {
+		for _, slave := range s {
+			mkfile(filepath.Join(root, "block", name, "slaves", slave), "")
+		}
+	}
+
+	for name, h := range holders {
+		for _, holder := range h {
+			mkfile(filepath.Join(root, "block", name, "holders", holder), "")
+		}
+	}
+
+	return root
+}
+
+func nodeNames(nodes []*TopologyNode) (names []string) {
+	for _, n := range nodes {
+		names = append(names, n.String())
+	}
+
+	return
+}
+
+func TestBuildTopology(t *testing.T) {
+	sysfs := makeFakeSysfs(t,
+		map[string]string{
+			"sda": "8:0", "sda1": "8:1", "sdb": "8:16", "sdc": "8:32", "md0": "9:0",
+			"dm-0": "253:0", "dm-1": "253:1", "dm-2": "253:2",
+		},
+		map[string][]string{
+			"dm-0": {"sda1"},
+			"dm-2": {"dm-0", "dm-1"},
+			"md0":  {"sdc"},
+		},
+		map[string][]string{
+			"sdb": {"dm-1"},
+		},
+	)
+
+	defer os.RemoveAll(sysfs)
+
+	devices := []dmDevice{
+		{unix.Mkdev(253, 0), "vg-a"},
+		{unix.Mkdev(253, 1), "vg-b"},
+		{unix.Mkdev(253, 2), "top"},
+	}
+
+	// Deps of vg-b are deliberately omitted, and must be inferred from sysfs holders
+	deps := map[string][]uint64{
+		"vg-a": {unix.Mkdev(8, 1)},
+		"top":  {unix.Mkdev(253, 0), unix.Mkdev(253, 1)},
+	}
+
+	topo, err := buildTopology(devices, deps, sysfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		got      []*TopologyNode
+		expected []string
+	}{
+		{"nodes", topo.Nodes, []string{"sda1 (8:1)", "sdb (8:16)", "vg-a (253:0)", "vg-b (253:1)", "top (253:2)"}},
+		{"roots", topo.Roots(), []string{"top (253:2)"}},
+		{"leaves", topo.Leaves(), []string{"sda1 (8:1)", "sdb (8:16)"}},
+		{"teardown", topo.TeardownOrder(), []string{"top (253:2)", "vg-a (253:0)", "vg-b (253:1)"}},
+		{"activation", topo.ActivationOrder(), []string{"vg-b (253:1)", "vg-a (253:0)", "top (253:2)"}},
+	}
+
+	for _, test := range tests {
+		got := nodeNames(test.got)
+
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+			continue
+		}
+
+		for x := range got {
+			if got[x] != test.expected[x] {
+				t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestCollectDeps(t *testing.T) {
+	devices := []dmDevice{{Dev: unix.Mkdev(253, 0), Name: "a"}, {Dev: unix.Mkdev(253, 1), Name: "b"}}
+
+	getDeps := func(name string) ([]uint64, error) {
+		if name == "b" {
+			// Device removed between listing and querying its dependencies
+			return nil, &DMError{"DM_DEVICE_DEPS", unix.ENXIO}
+		}
+
+		return []uint64{unix.Mkdev(8, 0)}, nil
+	}
+
+	deps, err := collectDeps(devices, getDeps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deps) != 1 || len(deps["a"]) != 1 || deps["a"][0] != unix.Mkdev(8, 0) {
+		t.Errorf("Got deps %v, expected only device a", deps)
+	}
+
+	// Other errors are not ignored
+	getDeps = func(name string) ([]uint64, error) {
+		return nil, &DMError{"DM_DEVICE_DEPS", unix.EPERM}
+	}
+
+	if _, err := collectDeps(devices, getDeps); err == nil {
+		t.Error("Expected error for EPERM")
+	}
+}
+
+func TestGetTopology(t *testing.T) {
+	requireDM(t)
+
+	loop := newTestLoopDev(t, 16*(1<<20))
+	defer loop.Close()
+
+	lower, upper := testDeviceName(), testDeviceName()
+
+	if err := CreateDevice(lower, "", []dmTarget{{0, 8192, "linear", loop.path + " 0"}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(lower, false)
+
+	info, err := GetDeviceInfo(lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lowerDev := unix.Mkdev(info.Major, info.Minor)
+
+	deps, err := GetDeviceDeps(lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deps) != 1 || fmt.Sprintf("%d:%d", unix.Major(deps[0]), unix.Minor(deps[0])) != loop.devNo {
+		t.Fatalf("Got deps %v, expected %s", deps, loop.devNo)
+	}
+
+	table := []dmTarget{{0, 4096, "linear", fmt.Sprintf("%d:%d 0", info.Major, info.Minor)}}
+	if err := CreateDevice(upper, "", table, false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer RemoveDevice(upper, false)
+
+	topo, err := GetTopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, n := range topo.TeardownOrder() {
+		if n.DMName == lower || n.DMName == upper {
+			order = append(order, n.DMName)
+		}
+	}
+
+	if len(order) != 2 || order[0] != upper || order[1] != lower {
+		t.Errorf("Got teardown order %v, expected [%s %s]", order, upper, lower)
+	}
+
+	for _, n := range topo.Nodes {
+		if n.DMName == lower && (len(n.Holders) != 1 || n.Holders[0].DMName != upper || unix.Mkdev(n.Major, n.Minor) != lowerDev) {
+			t.Errorf("Unexpected node for %s: %+v", lower, n)
+		}
+	}
+}
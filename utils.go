@@ -6,6 +6,7 @@
 package devmapper
 
 import (
+	"bytes"
 	"fmt"
 
 	"golang.org/x/sys/unix"
@@ -76,3 +77,11 @@ func getFreeLoopDev() (int, error) {
 		return int(devNr), nil
 	}
 }
+
+// cString returns the contents of b up to the first NUL byte.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Devmapper target versions and capabilities.
+
+package devmapper
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTargetNotFound is returned when the kernel does not provide the specified target type.
+var ErrTargetNotFound = errors.New("Target type not found")
+
+// A Version is the major.minor.patch version of a devmapper target type.
+type Version struct {
+	Major uint32
+	Minor uint32
+	Patch uint32
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or +1 depending on whether v is older than, equal to, or newer than w.
+func (v Version) Compare(w Version) int {
+	a := [3]uint32{v.Major, v.Minor, v.Patch}
+	b := [3]uint32{w.Major, w.Minor, w.Patch}
+
+	for x := range a {
+		if a[x] < b[x] {
+			return -1
+		} else if a[x] > b[x] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// AtLeast returns true if v is equal to or newer than min.
+func (v Version) AtLeast(min Version) bool {
+	return v.Compare(min) >= 0
+}
+
+// A TargetVersion is a target type registered with the kernel, and its version.
+type TargetVersion struct {
+	Name    string
+	Version Version
+}
+
+// targetFeatures maps target types and their optional features (mostly table feature arguments)
+// to the target version which introduced them. Keep this in sync with the version histories in
+// the kernel's Documentation/admin-guide/device-mapper.
+var targetFeatures = map[string]map[string]Version{
+	"cache": {
+		"writeback":           {1, 0, 0},
+		"writethrough":        {1, 0, 0},
+		"metadata2":           {1, 10, 0},
+		"no_discard_passdown": {2, 1, 0},
+	},
+	"crypt": {
+		"allow_discards":         {1, 11, 0},
+		"same_cpu_crypt":         {1, 14, 0},
+		"submit_from_crypt_cpus": {1, 14, 0},
+		"keyring":                {1, 15, 0},
+		"integrity":              {1, 17, 0},
+		"sector_size":            {1, 17, 0},
+		"no_read_workqueue":      {1, 22, 0},
+		"no_write_workqueue":     {1, 22, 0},
+	},
+	"integrity": {
+		"recalculate": {1, 2, 0},
+		"bitmap":      {1, 3, 0},
+	},
+	"multipath": {
+		"retain_attached_hw_handler": {1, 6, 0},
+		"queue_mode":                 {1, 10, 0},
+	},
+	"raid": {
+		"journal_dev":  {1, 10, 0},
+		"journal_mode": {1, 11, 1},
+	},
+	"thin-pool": {
+		"skip_block_zeroing":  {1, 0, 0},
+		"ignore_discard":      {1, 1, 0},
+		"no_discard_passdown": {1, 1, 0},
+		"read_only":           {1, 8, 0},
+		"error_if_no_space":   {1, 10, 0},
+	},
+	"verity": {
+		"ignore_corruption":      {1, 3, 0},
+		"restart_on_corruption":  {1, 3, 0},
+		"ignore_zero_blocks":     {1, 3, 0},
+		"use_fec_from_device":    {1, 3, 0},
+		"check_at_most_once":     {1, 4, 0},
+		"root_hash_sig_key_desc": {1, 5, 0},
+	},
+	"writecache": {
+		"cleaner": {1, 2, 0},
+		"max_age": {1, 3, 0},
+	},
+}
+
+// TargetSupports reports whether the running kernel's version of a target type supports the
+// specified feature, e.g. TargetSupports("thin-pool", "no_discard_passdown"). If the kernel does
+// not provide the target type at all, TargetSupports returns false. An error is returned if the
+// feature is not listed in the package's table of target features.
+func TargetSupports(target, feature string) (bool, error) {
+	min, err := featureVersion(target, feature)
+	if err != nil {
+		return false, err
+	}
+
+	tv, err := GetTargetVersion(target)
+	if err == ErrTargetNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return tv.Version.AtLeast(min), nil
+}
+
+// featureVersion returns the target version which introduced the specified feature.
+func featureVersion(target, feature string) (Version, error) {
+	min, ok := targetFeatures[target][feature]
+	if !ok {
+		return Version{}, fmt.Errorf("Unknown %s feature %q", target, feature)
+	}
+
+	return min, nil
+}
+
+// findTargetVersion returns the entry for the named target type from a list of target versions.
+func findTargetVersion(versions []TargetVersion, name string) (*TargetVersion, error) {
+	for x := range versions {
+		if versions[x].Name == name {
+			return &versions[x], nil
+		}
+	}
+
+	return nil, ErrTargetNotFound
+}
+
+// getTargetVersionFromList returns the version of the named target type from the list of
+// registered target types, for kernels which do not support DM_GET_TARGET_VERSION.
+func getTargetVersionFromList(name string) (*TargetVersion, error) {
+	versions, err := ListTargetVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	return findTargetVersion(versions, name)
+}
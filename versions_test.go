@@ -0,0 +1,116 @@
+// +build linux
+
+// Copyright 2017-18 Daniel Swarbrick. All rights reserved.
+// Use of this source code is governed by a GPL license that can be found in the LICENSE file.
+
+// Tests for devmapper target versions and capabilities.
+
+package devmapper
+
+import (
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b     Version
+		expected int
+	}{
+		{Version{1, 0, 0}, Version{1, 0, 0}, 0},
+		{Version{1, 0, 0}, Version{1, 0, 1}, -1},
+		{Version{1, 10, 0}, Version{1, 9, 9}, 1},
+		{Version{1, 9, 0}, Version{1, 10, 0}, -1},
+		{Version{2, 0, 0}, Version{1, 22, 3}, 1},
+		{Version{0, 99, 99}, Version{1, 0, 0}, -1},
+	}
+
+	for _, test := range tests {
+		if got := test.a.Compare(test.b); got != test.expected {
+			t.Errorf("%s.Compare(%s) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+
+		if got := test.a.AtLeast(test.b); got != (test.expected >= 0) {
+			t.Errorf("%s.AtLeast(%s) = %t", test.a, test.b, got)
+		}
+	}
+
+	if s := (Version{1, 22, 3}).String(); s != "1.22.3" {
+		t.Errorf("Got %q, expected \"1.22.3\"", s)
+	}
+}
+
+func TestFeatureVersion(t *testing.T) {
+	tests := []struct {
+		target, feature string
+		version         Version
+		expected        bool
+	}{
+		{"thin-pool", "no_discard_passdown", Version{1, 0, 0}, false},
+		{"thin-pool", "no_discard_passdown", Version{1, 1, 0}, true},
+		{"thin-pool", "error_if_no_space", Version{1, 9, 0}, false},
+		{"thin-pool", "error_if_no_space", Version{1, 22, 0}, true},
+		{"cache", "no_discard_passdown", Version{1, 10, 0}, false},
+		{"cache", "no_discard_passdown", Version{2, 2, 0}, true},
+		{"crypt", "no_read_workqueue", Version{1, 21, 9}, false},
+		{"raid", "journal_mode", Version{1, 11, 1}, true},
+	}
+
+	for _, test := range tests {
+		min, err := featureVersion(test.target, test.feature)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.target, test.feature, err)
+			continue
+		}
+
+		if got := test.version.AtLeast(min); got != test.expected {
+			t.Errorf("%s %s %s: got %t, expected %t", test.target, test.version, test.feature, got, test.expected)
+		}
+	}
+
+	for _, f := range [][2]string{{"thin-pool", "no_such_feature"}, {"no-such-target", "read_only"}} {
+		if _, err := featureVersion(f[0], f[1]); err == nil {
+			t.Errorf("Expected error for unknown feature %s %s", f[0], f[1])
+		}
+	}
+}
+
+func TestFindTargetVersion(t *testing.T) {
+	versions := []TargetVersion{{"linear", Version{1, 4, 0}}, {"thin-pool", Version{1, 22, 0}}}
+
+	if tv, err := findTargetVersion(versions, "thin-pool"); err != nil || tv.Version != (Version{1, 22, 0}) {
+		t.Errorf("Got %+v, %v", tv, err)
+	}
+
+	if _, err := findTargetVersion(versions, "vdo"); err != ErrTargetNotFound {
+		t.Errorf("Got %v, expected ErrTargetNotFound", err)
+	}
+}
+
+func TestListTargetVersions(t *testing.T) {
+	requireDM(t)
+
+	// The linear target is built into the devmapper core, and is always available
+	tv, err := GetTargetVersion("linear")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := ListTargetVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listed, err := findTargetVersion(versions, "linear"); err != nil || *listed != *tv {
+		t.Errorf("Got %+v, %v, expected %+v", listed, err, tv)
+	}
+
+	if _, err := GetTargetVersion("no-such-target"); err != ErrTargetNotFound {
+		t.Errorf("Got %v, expected ErrTargetNotFound", err)
+	}
+
+	if ok, err := TargetSupports("thin-pool", "skip_block_zeroing"); err != nil {
+		t.Error(err)
+	} else {
+		t.Logf("thin-pool supports skip_block_zeroing: %t", ok)
+	}
+}